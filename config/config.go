@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -12,9 +13,35 @@ type Config struct {
 	GitHubClientID     string
 	GitHubClientSecret string
 	GithubRedirectURL  string
+	// GitLab OAuth and API settings, used when StorageBackend is "gitlab"
+	GitLabURL          string
+	GitLabClientID     string
+	GitLabClientSecret string
+	GitLabRedirectURL  string
 	JWTSecret          string
 	EncryptionKey      string
 	Production         bool
+	// LFSURL overrides the Git LFS server media is stored on, e.g. a local
+	// LFS server for development. Objects live under <LFSURL>/<owner>/<repo>.
+	LFSURL string
+	// StorageBackend selects where repositories live: "github" (default),
+	// "gitlab", or "local" for git repositories under LocalReposDir.
+	StorageBackend string
+	LocalReposDir  string
+	// LocalUserName and LocalUserEmail are who everyone signs in as, and
+	// commits as, with the local backend.
+	LocalUserName  string
+	LocalUserEmail string
+	// LocalPassword, when set, must be given (as HTTP basic auth) to sign in
+	// with the local backend. Without it only clients on the loopback
+	// interface may sign in, unless LocalAllowRemote opts out of that.
+	LocalPassword    string
+	LocalAllowRemote bool
+	// JanitorInterval is how often stale temporary branches are swept from
+	// recently used repositories (0 disables the sweeper), and
+	// JanitorBranchAge how old such a branch must be to be removed.
+	JanitorInterval  time.Duration
+	JanitorBranchAge time.Duration
 	// Add more config vars as needed
 }
 
@@ -35,12 +62,44 @@ func Load() *Config {
 	githubClientID := os.Getenv("GITHUB_CLIENT_ID")
 	githubClientSecret := os.Getenv("GITHUB_CLIENT_SECRET")
 	githubRedirectURL := os.Getenv("GITHUB_REDIRECT_URL")
+	gitlabURL := os.Getenv("GITLAB_URL")
+	if gitlabURL == "" {
+		gitlabURL = "https://gitlab.com"
+	}
+	gitlabClientID := os.Getenv("GITLAB_CLIENT_ID")
+	gitlabClientSecret := os.Getenv("GITLAB_CLIENT_SECRET")
+	gitlabRedirectURL := os.Getenv("GITLAB_REDIRECT_URL")
 	jwtSecret := os.Getenv("JWT_SECRET")
 	encryptionKey := os.Getenv("ENCRYPTION_KEY")
 
 	production := os.Getenv("PRODUCTION")
+	lfsURL := os.Getenv("LFS_URL")
+
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = "github"
+	}
+	localReposDir := os.Getenv("LOCAL_REPOS_DIR")
+	if localReposDir == "" {
+		localReposDir = "./repos"
+	}
+	localUserName := os.Getenv("LOCAL_USER_NAME")
+	if localUserName == "" {
+		localUserName = "admin"
+	}
+	localUserEmail := os.Getenv("LOCAL_USER_EMAIL")
+	if localUserEmail == "" {
+		localUserEmail = "admin@localhost"
+	}
+	localPassword := os.Getenv("LOCAL_PASSWORD")
+	localAllowRemote := os.Getenv("LOCAL_ALLOW_REMOTE")
 
-	if jwtSecret == "" {
+	janitorInterval := durationEnv("JANITOR_INTERVAL", time.Hour)
+	janitorBranchAge := durationEnv("JANITOR_BRANCH_AGE", time.Hour)
+
+	// The local backend signs sessions in without a third party, so a known
+	// secret would let anyone mint one; SetupStorage refuses to start then
+	if jwtSecret == "" && storageBackend != "local" {
 		jwtSecret = "default-secret-change-in-prod"
 	}
 	Cfg = &Config{
@@ -48,9 +107,37 @@ func Load() *Config {
 		GitHubClientID:     githubClientID,
 		GitHubClientSecret: githubClientSecret,
 		GithubRedirectURL:  githubRedirectURL,
+		GitLabURL:          gitlabURL,
+		GitLabClientID:     gitlabClientID,
+		GitLabClientSecret: gitlabClientSecret,
+		GitLabRedirectURL:  gitlabRedirectURL,
 		JWTSecret:          jwtSecret,
 		EncryptionKey:      encryptionKey,
 		Production:         production == "true",
+		LFSURL:             lfsURL,
+		StorageBackend:     storageBackend,
+		LocalReposDir:      localReposDir,
+		LocalUserName:      localUserName,
+		LocalUserEmail:     localUserEmail,
+		LocalPassword:      localPassword,
+		LocalAllowRemote:   localAllowRemote == "true",
+		JanitorInterval:    janitorInterval,
+		JanitorBranchAge:   janitorBranchAge,
 	}
 	return Cfg
 }
+
+// durationEnv parses an environment variable such as "90m", falling back to
+// def when it is unset or invalid
+func durationEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		fmt.Printf("[WARN] Invalid %s %q, using %s\n", name, value, def)
+		return def
+	}
+	return d
+}
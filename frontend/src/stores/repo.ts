@@ -25,6 +25,17 @@ export interface ContentTypeField {
   field_type: string
   is_required: boolean
   options: string[]
+  // Value a new entry starts with
+  default?: unknown
+  // Validation rules, enforced by the server as well
+  min_length?: number
+  max_length?: number
+  pattern?: string
+  min?: number
+  max?: number
+  step?: number
+  integer?: boolean
+  unique?: boolean
 }
 
 export const useRepoStore = defineStore('repo', () => {
@@ -5,16 +5,71 @@ interface Field {
   field_type: string
   is_required: boolean
   options: string[]
+  min_length?: number
+  max_length?: number
+  pattern?: string
+  min?: number
+  max?: number
+  step?: number
+  integer?: boolean
+}
+
+// Mirrors the server's rules: blank values are left to is_required
+function buildTextSchema(field: Field) {
+  let schema: z.ZodTypeAny = z.string()
+  if (field.min_length !== undefined) {
+    const min = field.min_length
+    schema = schema.refine((val: string) => val === '' || [...val].length >= min, {
+      message: `Must be at least ${min} characters long`
+    })
+  }
+  if (field.max_length !== undefined) {
+    const max = field.max_length
+    schema = schema.refine((val: string) => [...val].length <= max, {
+      message: `Must be at most ${max} characters long`
+    })
+  }
+  if (field.pattern) {
+    const pattern = new RegExp(field.pattern)
+    schema = schema.refine((val: string) => val === '' || pattern.test(val), {
+      message: `Must match the pattern ${field.pattern}`
+    })
+  }
+  return schema
+}
+
+function buildNumberSchema(field: Field) {
+  let schema = z.number()
+  if (field.integer) {
+    schema = schema.int({ message: 'Must be a whole number' })
+  }
+  if (field.min !== undefined) {
+    schema = schema.min(field.min, { message: `Must be at least ${field.min}` })
+  }
+  if (field.max !== undefined) {
+    schema = schema.max(field.max, { message: `Must be at most ${field.max}` })
+  }
+  if (field.step !== undefined) {
+    const step = field.step
+    const base = field.min ?? 0
+    return schema.refine((val: number) => {
+      const steps = (val - base) / step
+      return Math.abs(steps - Math.round(steps)) <= 1e-9
+    }, { message: `Must be in steps of ${step}` })
+  }
+  return schema
 }
 
 export function buildFieldSchema(field: Field) {
   let schema: z.ZodTypeAny
   switch (field.field_type) {
     case 'text':
-      schema = z.string()
+    case 'textarea':
+    case 'markdown':
+      schema = buildTextSchema(field)
       break
     case 'number':
-      schema = z.number()
+      schema = buildNumberSchema(field)
       break
     case 'boolean':
       schema = z.boolean()
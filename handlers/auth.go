@@ -1,13 +1,14 @@
 package handlers
 
 import (
-	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	githubapi "github.com/google/go-github/v62/github"
 	"github.com/vachanmn123/vachancms/config"
 	"github.com/vachanmn123/vachancms/services"
 	"golang.org/x/oauth2"
@@ -17,21 +18,43 @@ import (
 var oauthConfig *oauth2.Config = nil
 
 func InitAuthHandler() {
-	oauthConfig = &oauth2.Config{
-		ClientID:     config.Cfg.GitHubClientID,
-		ClientSecret: config.Cfg.GitHubClientSecret,
-		Scopes:       []string{"user:email", "repo"},
-		Endpoint:     githuboauth.Endpoint,
-		RedirectURL:  config.Cfg.GithubRedirectURL,
+	switch config.Cfg.StorageBackend {
+	case "local":
+		// Local repositories need no OAuth, see localLogin
+		return
+	case "gitlab":
+		gitlabURL := strings.TrimSuffix(config.Cfg.GitLabURL, "/")
+		oauthConfig = &oauth2.Config{
+			ClientID:     config.Cfg.GitLabClientID,
+			ClientSecret: config.Cfg.GitLabClientSecret,
+			Scopes:       []string{"api", "read_user"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  gitlabURL + "/oauth/authorize",
+				TokenURL: gitlabURL + "/oauth/token",
+			},
+			RedirectURL: config.Cfg.GitLabRedirectURL,
+		}
+	default:
+		oauthConfig = &oauth2.Config{
+			ClientID:     config.Cfg.GitHubClientID,
+			ClientSecret: config.Cfg.GitHubClientSecret,
+			Scopes:       []string{"user:email", "repo"},
+			Endpoint:     githuboauth.Endpoint,
+			RedirectURL:  config.Cfg.GithubRedirectURL,
+		}
 	}
 }
 
 func LoginHandler(c *gin.Context) {
+	if config.Cfg.StorageBackend == "local" {
+		localLogin(c)
+		return
+	}
 
 	// Generate random state
 	state, err := generateState()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate state"})
+		respondError(c, http.StatusInternalServerError, "Failed to generate state", err)
 		return
 	}
 
@@ -43,6 +66,7 @@ func LoginHandler(c *gin.Context) {
 }
 
 func CallbackHandler(c *gin.Context) {
+	ctx := c.Request.Context()
 	code := c.Query("code")
 	state := c.Query("state")
 
@@ -53,24 +77,23 @@ func CallbackHandler(c *gin.Context) {
 		return
 	}
 
-	token, err := oauthConfig.Exchange(context.Background(), code)
+	token, err := oauthConfig.Exchange(ctx, code)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to exchange code"})
+		respondError(c, http.StatusInternalServerError, "Failed to exchange code", err)
 		return
 	}
 
 	// Get user info
-	client := githubapi.NewClient(oauthConfig.Client(context.Background(), token))
-	user, _, err := client.Users.Get(context.Background(), "")
+	user, err := services.GetUser(ctx, token.AccessToken)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		respondError(c, http.StatusInternalServerError, "Failed to get user", err)
 		return
 	}
 
 	// Generate JWT
-	jwtToken, err := services.GenerateJWT(user.GetLogin(), token.AccessToken, config.Cfg)
+	jwtToken, err := services.GenerateJWT(user.Login, token.AccessToken, config.Cfg)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate JWT"})
+		respondError(c, http.StatusInternalServerError, "Failed to generate JWT", err)
 		return
 	}
 
@@ -82,20 +105,64 @@ func CallbackHandler(c *gin.Context) {
 }
 
 func GetMeHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	access_token := c.GetString("user_access_token")
+
+	user, err := services.GetUser(ctx, access_token)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "Failed to get user", err)
+		return
+	}
+
+	c.JSON(200, user)
+}
+
+// GetRateLimitHandler returns the signed-in user's remaining API budget as
+// last reported by the storage backend.
+func GetRateLimitHandler(c *gin.Context) {
 	access_token := c.GetString("user_access_token")
 
-	client := githubapi.NewClient(oauthConfig.Client(context.Background(), &oauth2.Token{AccessToken: access_token}))
-	user, _, err := client.Users.Get(context.Background(), "")
+	c.JSON(200, gin.H{"limits": services.GetRateLimits(access_token)})
+}
+
+// localLogin signs the configured local user in directly. With a password
+// configured the browser is asked for it through HTTP basic auth; without one
+// only loopback clients may sign in, unless remote sign-in was explicitly
+// allowed.
+func localLogin(c *gin.Context) {
+	if config.Cfg.LocalPassword != "" {
+		_, password, ok := c.Request.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(config.Cfg.LocalPassword)) != 1 {
+			c.Header("WWW-Authenticate", `Basic realm="VachanCMS", charset="UTF-8"`)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+	} else if !config.Cfg.LocalAllowRemote && !isLoopback(c.Request.RemoteAddr) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Sign-in is only allowed from this machine; set LOCAL_PASSWORD to allow it elsewhere"})
+		return
+	}
+
+	accessToken := services.LocalAccessToken(config.Cfg.LocalUserName, config.Cfg.LocalUserEmail)
+	jwtToken, err := services.GenerateJWT(config.Cfg.LocalUserName, accessToken, config.Cfg)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		respondError(c, http.StatusInternalServerError, "Failed to generate JWT", err)
 		return
 	}
 
-	c.JSON(200, gin.H{
-		"login":      user.GetLogin(),
-		"name":       user.GetName(),
-		"avatar_url": user.GetAvatarURL(),
-	})
+	c.SetCookie("auth_token", jwtToken, 86400, "/", "", false, true)
+	c.Redirect(http.StatusTemporaryRedirect, "/")
+}
+
+// isLoopback reports whether a request's remote address is on the loopback
+// interface. It deliberately ignores forwarding headers, which the client
+// controls.
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func generateState() (string, error) {
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vachanmn123/vachancms/config"
+	"github.com/vachanmn123/vachancms/services"
+)
+
+// staleBranchAge reads the optional max_age query parameter (e.g. "30m"),
+// defaulting to the janitor's configured age.
+func staleBranchAge(c *gin.Context) (time.Duration, bool) {
+	maxAge := config.Cfg.JanitorBranchAge
+	if value := c.Query("max_age"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_age parameter"})
+			return 0, false
+		}
+		maxAge = parsed
+	}
+	return maxAge, true
+}
+
+// ListStaleBranches lists the temporary branches the janitor would delete
+func ListStaleBranches(c *gin.Context) {
+	owner := c.Param("owner")
+	repo := c.Param("repo")
+	access_token := c.GetString("user_access_token")
+	ctx := c.Request.Context()
+
+	maxAge, ok := staleBranchAge(c)
+	if !ok {
+		return
+	}
+
+	branches, err := services.FindStaleBranches(ctx, access_token, owner, repo, maxAge)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "Failed to list branches", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"branches": branches})
+}
+
+// CleanupStaleBranches deletes stale temporary branches right away
+func CleanupStaleBranches(c *gin.Context) {
+	owner := c.Param("owner")
+	repo := c.Param("repo")
+	access_token := c.GetString("user_access_token")
+	ctx := c.Request.Context()
+
+	maxAge, ok := staleBranchAge(c)
+	if !ok {
+		return
+	}
+
+	result, err := services.CleanupStaleBranches(ctx, access_token, owner, repo, maxAge)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "Failed to clean up branches", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -2,7 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -11,13 +15,14 @@ import (
 )
 
 func ListContentTypes(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	access_token := c.GetString("user_access_token")
 
-	configFile, err := services.GetRepoConfig(access_token, owner, repo)
+	configFile, err := services.GetRepoConfig(ctx, access_token, owner, repo)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch or parse config"})
+		respondError(c, 500, "Failed to fetch or parse config", err)
 		return
 	}
 
@@ -25,6 +30,7 @@ func ListContentTypes(c *gin.Context) {
 }
 
 func CreateContentType(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	access_token := c.GetString("user_access_token")
@@ -37,54 +43,32 @@ func CreateContentType(c *gin.Context) {
 
 	contentType.Id = uuid.New().String()
 
-	// Validate and set defaults for ItemsPerPage
-	if contentType.ItemsPerPage <= 0 {
-		contentType.ItemsPerPage = 10 // Default
-	} else if contentType.ItemsPerPage > 100 {
-		c.JSON(400, gin.H{"error": "ItemsPerPage must be between 1 and 100"})
-		return
-	}
-
-	// Validate and set defaults for AddTo
-	if contentType.AddTo == "" {
-		contentType.AddTo = "bottom" // Default
-	} else if contentType.AddTo != "top" && contentType.AddTo != "bottom" {
-		c.JSON(400, gin.H{"error": "AddTo must be 'top' or 'bottom'"})
+	unlock, err := services.LockRepo(ctx, owner, repo, "config")
+	if err != nil {
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
 		return
 	}
+	defer unlock()
 
-	configFile, err := services.GetRepoConfig(access_token, owner, repo)
+	b, err := services.NewCommitBuilder(ctx, access_token, owner, repo)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch or parse config"})
+		respondError(c, 500, "Failed to start commit", err)
 		return
 	}
 
-	// Find if a content type with the same slug already exists
-	for _, ct := range configFile.ContentTypes {
-		if ct.Slug == contentType.Slug {
-			c.JSON(400, gin.H{"error": "Content type with the same slug already exists"})
-			return
-		}
-	}
-
-	configFile.ContentTypes = append(configFile.ContentTypes, contentType)
-
-	fileContent, err := json.Marshal(configFile)
+	configFile, err := services.LoadRepoConfig(ctx, b)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to marshal config file"})
+		respondError(c, 500, "Failed to fetch or parse config", err)
 		return
 	}
 
-	newBranchName := uuid.New().String()
-	err = services.CreateBranch(access_token, owner, repo, newBranchName)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create new branch."})
-		return
+	if err := validateContentType(c, b, &contentType, configFile, true); err != nil {
+		return // Error response already sent by validateContentType
 	}
 
-	err = services.CreateOrUpdateFile(access_token, owner, repo, "config/config.json", fmt.Sprintf("Create Content Type: %s", contentType.Name), string(fileContent), newBranchName)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to update config"})
+	configFile.ContentTypes = append(configFile.ContentTypes, contentType)
+	if err := services.SaveRepoConfig(b, configFile); err != nil {
+		respondError(c, 500, "Failed to save config", err)
 		return
 	}
 
@@ -99,7 +83,7 @@ func CreateContentType(c *gin.Context) {
 	}
 	contentTypeConfigFileJson, err := json.Marshal(contentTypeConfigFile)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to marshal content type config file"})
+		respondError(c, 500, "Failed to marshal content type config file", err)
 		return
 	}
 
@@ -109,28 +93,377 @@ func CreateContentType(c *gin.Context) {
 	}
 	contentValueIndexFileJson, err := json.Marshal(contentValueIndexFile)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to marshal content value index file"})
+		respondError(c, 500, "Failed to marshal content value index file", err)
 		return
 	}
 
 	// Create a new folder under the data/ directory for this content type
-	err = services.CreateOrUpdateFile(access_token, owner, repo, fmt.Sprintf("data/%s/config.json", contentType.Slug), fmt.Sprintf("Create data folder for content type: %s", contentType.Name), string(contentTypeConfigFileJson), newBranchName)
+	b.WriteFile(fmt.Sprintf("data/%s/config.json", contentType.Slug), string(contentTypeConfigFileJson))
+	b.WriteFile(fmt.Sprintf("data/%s/index-1.json", contentType.Slug), string(contentValueIndexFileJson))
+
+	err = b.Commit(ctx, fmt.Sprintf("Added new content type - %s", contentType.Name))
+	if err != nil {
+		respondCommitError(c, err)
+		return
+	}
+
+	c.JSON(201, contentType)
+}
+
+func UpdateContentType(c *gin.Context) {
+	ctx := c.Request.Context()
+	owner := c.Param("owner")
+	repo := c.Param("repo")
+	ctSlug := c.Param("ctSlug")
+	access_token := c.GetString("user_access_token")
+
+	var contentType models.ContentType
+	if err := c.BindJSON(&contentType); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if contentType.Slug != ctSlug {
+		c.JSON(400, gin.H{"error": "The slug of a content type cannot be changed"})
+		return
+	}
+
+	unlock, err := services.LockRepo(ctx, owner, repo, "config")
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create data folder and config file for content type"})
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
 		return
 	}
+	defer unlock()
+	unlockValues, err := services.LockRepo(ctx, owner, repo, ctSlug)
+	if err != nil {
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
+		return
+	}
+	defer unlockValues()
 
-	err = services.CreateOrUpdateFile(access_token, owner, repo, fmt.Sprintf("data/%s/index-1.json", contentType.Slug), fmt.Sprintf("Create index file for content type: %s", contentType.Name), string(contentValueIndexFileJson), newBranchName)
+	b, err := services.NewCommitBuilder(ctx, access_token, owner, repo)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create index file for content type"})
+		respondError(c, 500, "Failed to start commit", err)
 		return
 	}
 
-	err = services.MergeBranch(access_token, owner, repo, newBranchName, fmt.Sprintf("Added new content type - %s", contentType.Name))
+	configFile, err := services.LoadRepoConfig(ctx, b)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to merge branch"})
+		respondError(c, 500, "Failed to fetch or parse config", err)
 		return
 	}
 
-	c.JSON(201, contentType)
+	index := slices.IndexFunc(configFile.ContentTypes, func(ct models.ContentType) bool {
+		return ct.Slug == ctSlug
+	})
+	if index == -1 {
+		c.JSON(404, gin.H{"error": "Content type not found"})
+		return
+	}
+	existing := configFile.ContentTypes[index]
+	if err := validateContentType(c, b, &contentType, configFile, false); err != nil {
+		return // Error response already sent by validateContentType
+	}
+
+	// Removing a field or changing its type would leave existing entries
+	// invalid; the migrate endpoint rewrites them along with the definition
+	if changes := services.DestructiveFieldChanges(existing.Fields, contentType.Fields); len(changes) > 0 {
+		config, err := services.GetContentValueConfig(ctx, b, ctSlug)
+		if err != nil {
+			respondError(c, 500, "Failed to fetch content values config", err)
+			return
+		}
+		if len(config.Items) > 0 || len(config.Order) > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":  fmt.Sprintf("Existing entries hold values for removed or retyped fields; use POST /%s/%s/content-types/%s/migrate instead", owner, repo, ctSlug),
+				"fields": changes,
+			})
+			return
+		}
+	}
+	contentType.Id = existing.Id
+	configFile.ContentTypes[index] = contentType
+
+	if err := services.SaveRepoConfig(b, configFile); err != nil {
+		respondError(c, 500, "Failed to save config", err)
+		return
+	}
+
+	// Entries are paginated by ItemsPerPage and ordered by SortBy, so changing
+	// either means new indexes
+	resort := contentType.SortBy != "" && (contentType.SortBy != existing.SortBy || contentType.SortDirection != existing.SortDirection)
+	if contentType.ItemsPerPage != existing.ItemsPerPage || resort {
+		config, err := services.GetContentValueConfig(ctx, b, ctSlug)
+		if err != nil {
+			respondError(c, 500, "Failed to fetch content values config", err)
+			return
+		}
+
+		if err := services.MigrateConfigToOrder(ctx, b, ctSlug, config); err != nil {
+			respondError(c, 500, "Failed to migrate config", err)
+			return
+		}
+
+		config.ItemsPerPage = contentType.ItemsPerPage
+		if err := services.SortContentValues(ctx, b, ctSlug, config, &contentType); err != nil {
+			respondError(c, 500, "Failed to sort content values", err)
+			return
+		}
+		if err := services.RegenerateIndexes(ctx, b, ctSlug, config); err != nil {
+			respondError(c, 500, "Failed to regenerate indexes", err)
+			return
+		}
+
+		if err := services.SaveContentValueConfig(b, ctSlug, config); err != nil {
+			respondError(c, 500, "Failed to save config", err)
+			return
+		}
+	}
+
+	err = b.Commit(ctx, fmt.Sprintf("Updated content type - %s", contentType.Name))
+	if err != nil {
+		respondCommitError(c, err)
+		return
+	}
+
+	c.JSON(200, contentType)
+}
+
+func DeleteContentType(c *gin.Context) {
+	ctx := c.Request.Context()
+	owner := c.Param("owner")
+	repo := c.Param("repo")
+	ctSlug := c.Param("ctSlug")
+	access_token := c.GetString("user_access_token")
+
+	unlock, err := services.LockRepo(ctx, owner, repo, "config")
+	if err != nil {
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
+		return
+	}
+	defer unlock()
+	unlockValues, err := services.LockRepo(ctx, owner, repo, ctSlug)
+	if err != nil {
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
+		return
+	}
+	defer unlockValues()
+
+	b, err := services.NewCommitBuilder(ctx, access_token, owner, repo)
+	if err != nil {
+		respondError(c, 500, "Failed to start commit", err)
+		return
+	}
+
+	configFile, err := services.LoadRepoConfig(ctx, b)
+	if err != nil {
+		respondError(c, 500, "Failed to fetch or parse config", err)
+		return
+	}
+
+	index := slices.IndexFunc(configFile.ContentTypes, func(ct models.ContentType) bool {
+		return ct.Slug == ctSlug
+	})
+	if index == -1 {
+		c.JSON(404, gin.H{"error": "Content type not found"})
+		return
+	}
+	contentType := configFile.ContentTypes[index]
+
+	if referrers := services.ContentTypeReferrers(configFile, ctSlug); len(referrers) > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":         fmt.Sprintf("Content type %s is still referenced by other content types", contentType.Name),
+			"referenced_by": referrers,
+		})
+		return
+	}
+
+	configFile.ContentTypes = slices.Delete(configFile.ContentTypes, index, index+1)
+	if err := services.SaveRepoConfig(b, configFile); err != nil {
+		respondError(c, 500, "Failed to save config", err)
+		return
+	}
+
+	if err := b.DeleteDir(ctx, fmt.Sprintf("data/%s", ctSlug)); err != nil {
+		respondError(c, 500, "Failed to remove content values", err)
+		return
+	}
+
+	err = b.Commit(ctx, fmt.Sprintf("Deleted content type - %s", contentType.Name))
+	if err != nil {
+		respondCommitError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Content type deleted successfully"})
+}
+
+type MigrateContentTypeRequest struct {
+	Operations []services.FieldMigration `json:"operations" binding:"required"`
+	// ClearInvalid removes values that cannot be converted instead of
+	// refusing to migrate
+	ClearInvalid bool `json:"clear_invalid"`
+	// DryRun reports what the migration would do without committing it
+	DryRun bool `json:"dry_run"`
+}
+
+func MigrateContentType(c *gin.Context) {
+	ctx := c.Request.Context()
+	owner := c.Param("owner")
+	repo := c.Param("repo")
+	ctSlug := c.Param("ctSlug")
+	access_token := c.GetString("user_access_token")
+
+	var req MigrateContentTypeRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	unlock, err := services.LockRepo(ctx, owner, repo, "config")
+	if err != nil {
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
+		return
+	}
+	defer unlock()
+	unlockValues, err := services.LockRepo(ctx, owner, repo, ctSlug)
+	if err != nil {
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
+		return
+	}
+	defer unlockValues()
+
+	b, err := services.NewCommitBuilder(ctx, access_token, owner, repo)
+	if err != nil {
+		respondError(c, 500, "Failed to start commit", err)
+		return
+	}
+
+	configFile, err := services.LoadRepoConfig(ctx, b)
+	if err != nil {
+		respondError(c, 500, "Failed to fetch or parse config", err)
+		return
+	}
+
+	result, err := services.MigrateContentType(ctx, access_token, owner, repo, b, configFile, ctSlug, req.Operations, req.ClearInvalid)
+	if err != nil {
+		var notFound *services.FileNotFoundError
+		var invalid *services.InvalidMigrationError
+		switch {
+		case errors.As(err, &notFound):
+			c.JSON(404, gin.H{"error": "Content type not found"})
+		case errors.As(err, &invalid):
+			c.JSON(400, gin.H{"error": invalid.Message})
+		default:
+			respondError(c, 500, "Failed to migrate content type", err)
+		}
+		return
+	}
+
+	// Nothing is committed while entries would be left in the old shape
+	if len(result.Failed) > 0 && !req.ClearInvalid {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":  "Some entries could not be converted",
+			"result": result,
+		})
+		return
+	}
+	if req.DryRun {
+		c.JSON(200, result)
+		return
+	}
+
+	err = b.Commit(ctx, fmt.Sprintf("Migrated content type - %s", result.ContentType.Name))
+	if err != nil {
+		respondCommitError(c, err)
+		return
+	}
+
+	c.JSON(200, result)
+}
+
+// validateContentType checks a content type definition against the other
+// content types in configFile and fills in the defaults of its settings.
+// Every problem is sent back at once, located by the definition key it is
+// about, e.g. slug or fields[2]. The slug is only checked for new types, as
+// it cannot change afterwards.
+func validateContentType(c *gin.Context, b *services.CommitBuilder, contentType *models.ContentType, configFile *models.ConfigFile, isNew bool) error {
+	problems := []models.FieldError{}
+	problem := func(key, format string, args ...any) {
+		problems = append(problems, models.FieldError{Field: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if strings.TrimSpace(contentType.Name) == "" {
+		problem("name", "Name cannot be blank")
+	}
+
+	if isNew {
+		if !slugRegex.MatchString(contentType.Slug) {
+			problem("slug", "Slug must be lowercase alphanumeric with hyphens (e.g., 'blog-posts')")
+		} else if services.IsReservedSlug(contentType.Slug) {
+			problem("slug", "Slug %s is reserved, please choose another", contentType.Slug)
+		}
+		if services.GetContentTypeFromConfig(configFile, contentType.Slug) != nil {
+			problem("slug", "Content type with the same slug already exists")
+		}
+	}
+
+	// Validate and set defaults for ItemsPerPage
+	if contentType.ItemsPerPage <= 0 {
+		contentType.ItemsPerPage = 10 // Default
+	} else if contentType.ItemsPerPage > 100 {
+		problem("items_per_page", "ItemsPerPage must be between 1 and 100")
+	}
+
+	// Validate and set defaults for AddTo
+	if contentType.AddTo == "" {
+		contentType.AddTo = "bottom" // Default
+	} else if contentType.AddTo != "top" && contentType.AddTo != "bottom" {
+		problem("add_to", "AddTo must be 'top' or 'bottom'")
+	}
+
+	problems = append(problems, services.ValidateFieldDefinitions(contentType.Fields, "")...)
+	problems = append(problems, services.ValidateReferenceTargets(contentType.Fields, "", contentType.Slug, configFile)...)
+
+	fc := services.FieldContext{Token: c.GetString("user_access_token"), Owner: c.Param("owner"), Repo: c.Param("repo"), Builder: b}
+	defaultProblems, err := services.ValidateFieldDefaults(c.Request.Context(), fc, contentType.Fields, "")
+	if err != nil {
+		respondError(c, 500, "Failed to validate field defaults", err)
+		return err
+	}
+	problems = append(problems, defaultProblems...)
+
+	// Validate and set defaults for sorting
+	if contentType.SortBy == "" {
+		contentType.SortDirection = ""
+	} else {
+		sortField := slices.IndexFunc(contentType.Fields, func(f models.ContentTypeField) bool {
+			return f.FieldName == contentType.SortBy
+		})
+		if sortField == -1 || !isSortableField(contentType.Fields[sortField]) {
+			problem("sort_by", "SortBy must name a field of a sortable type, such as date, datetime, number or text")
+		}
+		if contentType.SortDirection == "" {
+			contentType.SortDirection = "asc" // Default
+		} else if contentType.SortDirection != "asc" && contentType.SortDirection != "desc" {
+			problem("sort_direction", "SortDirection must be 'asc' or 'desc'")
+		}
+	}
+
+	if len(problems) > 0 {
+		c.JSON(400, gin.H{"error": "Invalid content type", "problems": problems})
+		return fmt.Errorf("invalid content type")
+	}
+	return nil
+}
+
+// isSortableField reports whether entries can be sorted by a field
+func isSortableField(field models.ContentTypeField) bool {
+	fieldType, ok := services.LookupFieldType(field.FieldType)
+	return ok && fieldType.Describe().Sortable
+}
+
+// ListFieldTypes describes the field types content types can use, including
+// any the application registered
+func ListFieldTypes(c *gin.Context) {
+	c.JSON(200, services.DescribeFieldTypes())
 }
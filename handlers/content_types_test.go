@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vachanmn123/vachancms/models"
+	"github.com/vachanmn123/vachancms/services"
+)
+
+// newContentTypeRepo serves o/r from memory with an authors type, referenced
+// by a posts type holding one entry, and an empty pages type
+func newContentTypeRepo(t *testing.T) *services.MemoryStorage {
+	t.Helper()
+	configFile := models.ConfigFile{SiteName: "S", ContentTypes: []models.ContentType{
+		{Id: "a", Name: "Authors", Slug: "authors", ItemsPerPage: 10, AddTo: "bottom", Fields: []models.ContentTypeField{
+			{FieldName: "name", FieldType: "text"},
+		}},
+		{Id: "p", Name: "Posts", Slug: "posts", ItemsPerPage: 10, AddTo: "bottom", Fields: []models.ContentTypeField{
+			{FieldName: "title", FieldType: "text"},
+			{FieldName: "author", FieldType: "reference", Options: []string{"authors"}},
+		}},
+		{Id: "g", Name: "Pages", Slug: "pages", ItemsPerPage: 10, AddTo: "bottom", Fields: []models.ContentTypeField{
+			{FieldName: "title", FieldType: "text"},
+		}},
+	}}
+	post := models.ContentValue{Id: "1", Value: map[string]any{"title": "Hello"}}
+	files := map[string]any{
+		"config/config.json":        configFile,
+		"data/authors/config.json":  models.ContentValueConfigFile{TotalPages: 1, ItemsPerPage: 10, Items: map[string]int{}, Order: []string{}},
+		"data/authors/index-1.json": models.ContentValueIndexFile{Page: 1, Items: []models.ContentValue{}},
+		"data/posts/config.json":    models.ContentValueConfigFile{TotalPages: 1, TotalItems: 1, ItemsPerPage: 10, Items: map[string]int{"1": 1}, Order: []string{"1"}},
+		"data/posts/1.json":         post,
+		"data/posts/index-1.json":   models.ContentValueIndexFile{Page: 1, Items: []models.ContentValue{post}},
+		"data/pages/config.json":    models.ContentValueConfigFile{TotalPages: 1, ItemsPerPage: 10, Items: map[string]int{}, Order: []string{}},
+		"data/pages/index-1.json":   models.ContentValueIndexFile{Page: 1, Items: []models.ContentValue{}},
+	}
+
+	s := services.NewMemoryStorage()
+	s.CreateRepo("o", "r", "main")
+	changes := []services.FileChange{}
+	for path, v := range files {
+		content, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		changes = append(changes, services.FileChange{Path: path, Content: content})
+	}
+	if _, err := s.CommitChanges(t.Context(), "o", "r", "main", "", "initial", changes); err != nil {
+		t.Fatalf("initial commit: %v", err)
+	}
+	services.SetStorageFactory(func(string) services.Storage { return s })
+	return s
+}
+
+// serveContentType sends a request to the content type endpoints
+func serveContentType(t *testing.T, method, slug string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.PUT("/:owner/:repo/content-types/:ctSlug", UpdateContentType)
+	router.DELETE("/:owner/:repo/content-types/:ctSlug", DeleteContentType)
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	req := httptest.NewRequestWithContext(t.Context(), method, "/o/r/content-types/"+slug, strings.NewReader(string(data)))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// readConfig returns the repository config as committed
+func readConfig(t *testing.T, s *services.MemoryStorage) models.ConfigFile {
+	t.Helper()
+	content, err := s.GetFileContents(t.Context(), "o", "r", "config/config.json")
+	if err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+	var configFile models.ConfigFile
+	if err := json.Unmarshal([]byte(content), &configFile); err != nil {
+		t.Fatalf("parsing config: %v", err)
+	}
+	return configFile
+}
+
+func TestUpdateContentType(t *testing.T) {
+	tests := []struct {
+		name       string
+		slug       string
+		update     models.ContentType
+		wantStatus int
+		// wantFields are the fields of the updated type afterwards (posts for
+		// an unknown one), or the fields reported for a 409
+		wantFields []string
+	}{
+		{
+			name: "field added",
+			slug: "posts",
+			update: models.ContentType{Name: "Articles", Slug: "posts", Fields: []models.ContentTypeField{
+				{FieldName: "title", FieldType: "text"},
+				{FieldName: "author", FieldType: "reference", Options: []string{"authors"}},
+				{FieldName: "draft", FieldType: "boolean"},
+			}},
+			wantStatus: 200,
+			wantFields: []string{"title", "author", "draft"},
+		},
+		{
+			name: "field renamed with entries",
+			slug: "posts",
+			update: models.ContentType{Name: "Posts", Slug: "posts", Fields: []models.ContentTypeField{
+				{FieldName: "headline", FieldType: "text"},
+				{FieldName: "author", FieldType: "reference", Options: []string{"authors"}},
+			}},
+			wantStatus: http.StatusConflict,
+			wantFields: []string{"title"},
+		},
+		{
+			name: "field retyped with entries",
+			slug: "posts",
+			update: models.ContentType{Name: "Posts", Slug: "posts", Fields: []models.ContentTypeField{
+				{FieldName: "title", FieldType: "markdown"},
+				{FieldName: "author", FieldType: "reference", Options: []string{"authors"}},
+			}},
+			wantStatus: http.StatusConflict,
+			wantFields: []string{"title"},
+		},
+		{
+			name: "field retyped without entries",
+			slug: "pages",
+			update: models.ContentType{Name: "Pages", Slug: "pages", Fields: []models.ContentTypeField{
+				{FieldName: "title", FieldType: "markdown"},
+			}},
+			wantStatus: 200,
+			wantFields: []string{"title"},
+		},
+		{
+			name:       "slug changed",
+			slug:       "posts",
+			update:     models.ContentType{Name: "Posts", Slug: "articles", Fields: []models.ContentTypeField{}},
+			wantStatus: 400,
+			wantFields: []string{"title", "author"},
+		},
+		{
+			name:       "unknown type",
+			slug:       "events",
+			update:     models.ContentType{Name: "Events", Slug: "events", Fields: []models.ContentTypeField{}},
+			wantStatus: 404,
+			wantFields: []string{"title", "author"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newContentTypeRepo(t)
+			w := serveContentType(t, http.MethodPut, tt.slug, tt.update)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			if tt.wantStatus == http.StatusConflict {
+				var response struct {
+					Fields []string `json:"fields"`
+				}
+				json.Unmarshal(w.Body.Bytes(), &response)
+				if !slices.Equal(response.Fields, tt.wantFields) {
+					t.Errorf("fields = %v, want %v", response.Fields, tt.wantFields)
+				}
+				tt.wantFields = []string{"title", "author"}
+			}
+			configFile := readConfig(t, s)
+			contentType := services.GetContentTypeFromConfig(&configFile, tt.slug)
+			if contentType == nil {
+				contentType = services.GetContentTypeFromConfig(&configFile, "posts")
+			}
+			fields := []string{}
+			for _, field := range contentType.Fields {
+				fields = append(fields, field.FieldName)
+			}
+			if !slices.Equal(fields, tt.wantFields) {
+				t.Errorf("%s fields = %v, want %v", contentType.Slug, fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestUpdateContentTypeRepaginates(t *testing.T) {
+	s := newContentTypeRepo(t)
+	configFile := readConfig(t, s)
+	posts := configFile.ContentTypes[1]
+	posts.ItemsPerPage = 1
+
+	if w := serveContentType(t, http.MethodPut, "posts", posts); w.Code != 200 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	content, _ := s.GetFileContents(t.Context(), "o", "r", "data/posts/config.json")
+	var config models.ContentValueConfigFile
+	if err := json.Unmarshal([]byte(content), &config); err != nil || config.ItemsPerPage != 1 {
+		t.Errorf("posts config = %s, %v; want 1 item per page", content, err)
+	}
+	if id := readConfig(t, s).ContentTypes[1].Id; id != "p" {
+		t.Errorf("Id = %q, want it kept", id)
+	}
+}
+
+func TestDeleteContentType(t *testing.T) {
+	tests := []struct {
+		name       string
+		slug       string
+		wantStatus int
+		// wantTypes are the slugs left in the config
+		wantTypes []string
+		// wantData is whether data/<slug>/ is left afterwards
+		wantData bool
+	}{
+		{name: "unreferenced", slug: "posts", wantStatus: 200, wantTypes: []string{"authors", "pages"}},
+		{name: "referenced", slug: "authors", wantStatus: http.StatusConflict, wantTypes: []string{"authors", "posts", "pages"}, wantData: true},
+		{name: "unknown", slug: "events", wantStatus: 404, wantTypes: []string{"authors", "posts", "pages"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newContentTypeRepo(t)
+			w := serveContentType(t, http.MethodDelete, tt.slug, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			slugs := []string{}
+			for _, ct := range readConfig(t, s).ContentTypes {
+				slugs = append(slugs, ct.Slug)
+			}
+			if !slices.Equal(slugs, tt.wantTypes) {
+				t.Errorf("content types = %v, want %v", slugs, tt.wantTypes)
+			}
+
+			files := s.Files("o", "r")
+			hasData := slices.ContainsFunc(files, func(path string) bool { return strings.HasPrefix(path, "data/"+tt.slug+"/") })
+			if hasData != tt.wantData {
+				t.Errorf("data/%s/ left in place: %v, want %v", tt.slug, hasData, tt.wantData)
+			}
+		})
+	}
+}
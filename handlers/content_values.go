@@ -2,10 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
-	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -23,7 +24,45 @@ func validateSlug(slug string) bool {
 	return slugRegex.MatchString(slug)
 }
 
+// etagFor returns the ETag for a content value file, derived from its blob SHA
+func etagFor(content string) string {
+	return fmt.Sprintf("\"%s\"", services.BlobSHA([]byte(content)))
+}
+
+// ifMatchSatisfied reports whether the request's If-Match header (if any)
+// matches the current content of the entry.
+func ifMatchSatisfied(c *gin.Context, currentContent string) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return true
+	}
+	current := etagFor(currentContent)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+// respondVersionConflict tells the editor that the entry changed underneath
+// them, returning the current version so the frontend can offer a merge.
+func respondVersionConflict(c *gin.Context, currentContent string) {
+	var current models.ContentValue
+	if err := json.Unmarshal([]byte(currentContent), &current); err != nil {
+		respondError(c, 500, "Failed to parse content value", err)
+		return
+	}
+	c.Header("ETag", etagFor(currentContent))
+	c.JSON(409, gin.H{
+		"error":   "Content value was modified by someone else",
+		"current": current,
+	})
+}
+
 func ListValuesByType(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	ctSlug := c.Param("ctSlug")
@@ -39,16 +78,16 @@ func ListValuesByType(c *gin.Context) {
 		}
 	}
 
-	configContents, err := services.GetFileContents(access_token, owner, repo, fmt.Sprintf("data/%s/config.json", ctSlug))
+	configContents, err := services.GetFileContents(ctx, access_token, owner, repo, fmt.Sprintf("data/%s/config.json", ctSlug))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch content values config"})
+		respondError(c, 500, "Failed to fetch content values config", err)
 		return
 	}
 
 	var config models.ContentValueConfigFile
 	err = json.Unmarshal([]byte(configContents), &config)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to parse content values config"})
+		respondError(c, 500, "Failed to parse content values config", err)
 		return
 	}
 
@@ -57,16 +96,16 @@ func ListValuesByType(c *gin.Context) {
 		return
 	}
 
-	valuesIndex, err := services.GetFileContents(access_token, owner, repo, fmt.Sprintf("data/%s/index-%d.json", ctSlug, page))
+	valuesIndex, err := services.GetFileContents(ctx, access_token, owner, repo, fmt.Sprintf("data/%s/index-%d.json", ctSlug, page))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch content values index"})
+		respondError(c, 500, "Failed to fetch content values index", err)
 		return
 	}
 
 	var values models.ContentValueIndexFile
 	err = json.Unmarshal([]byte(valuesIndex), &values)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to parse content values index"})
+		respondError(c, 500, "Failed to parse content values index", err)
 		return
 	}
 
@@ -79,29 +118,32 @@ func ListValuesByType(c *gin.Context) {
 }
 
 func GetValueById(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	ctSlug := c.Param("ctSlug")
 	id := c.Param("id")
 	access_token := c.GetString("user_access_token")
 
-	valueContents, err := services.GetFileContents(access_token, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, id))
+	valueContents, err := services.GetFileContents(ctx, access_token, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, id))
 	if err != nil {
-		c.JSON(404, gin.H{"error": "Content value not found"})
+		respondError(c, 404, "Content value not found", err)
 		return
 	}
 
 	var value models.ContentValue
 	err = json.Unmarshal([]byte(valueContents), &value)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to parse content value"})
+		respondError(c, 500, "Failed to parse content value", err)
 		return
 	}
 
+	c.Header("ETag", etagFor(valueContents))
 	c.JSON(200, value)
 }
 
 func CreateValueOfType(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	ctSlug := c.Param("ctSlug")
@@ -121,9 +163,22 @@ func CreateValueOfType(c *gin.Context) {
 		}
 	}
 
-	configFile, err := services.GetRepoConfig(access_token, owner, repo)
+	unlock, err := services.LockRepo(ctx, owner, repo, ctSlug)
+	if err != nil {
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
+		return
+	}
+	defer unlock()
+
+	b, err := services.NewCommitBuilder(ctx, access_token, owner, repo)
+	if err != nil {
+		respondError(c, 500, "Failed to start commit", err)
+		return
+	}
+
+	configFile, err := services.LoadRepoConfig(ctx, b)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch or parse config"})
+		respondError(c, 500, "Failed to fetch or parse config", err)
 		return
 	}
 
@@ -134,7 +189,7 @@ func CreateValueOfType(c *gin.Context) {
 	}
 
 	// Validate newValue fields
-	if err := validateContentValueFields(c, &newValue, contentType, access_token, owner, repo); err != nil {
+	if err := validateContentValueFields(c, b, &newValue, contentType, access_token, owner, repo); err != nil {
 		return // Error response already sent by validateContentValueFields
 	}
 
@@ -142,37 +197,30 @@ func CreateValueOfType(c *gin.Context) {
 
 	newValueJson, err := json.Marshal(newValue)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to marshal new content value"})
-		return
-	}
-
-	newBranchName := uuid.New().String()
-	err = services.CreateBranch(access_token, owner, repo, newBranchName)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create new branch."})
+		respondError(c, 500, "Failed to marshal new content value", err)
 		return
 	}
 
 	// Create the main id.json file
-	err = services.CreateOrUpdateFile(access_token, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, newValue.Id), fmt.Sprintf("Add new content value to %s", ctSlug), string(newValueJson), newBranchName)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create new content value file"})
-		return
-	}
+	b.WriteFile(fmt.Sprintf("data/%s/%s.json", ctSlug, newValue.Id), string(newValueJson))
 
 	// Fetch config
-	config, err := services.GetContentValueConfig(access_token, owner, repo, ctSlug, newBranchName)
+	config, err := services.GetContentValueConfig(ctx, b, ctSlug)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch content values config"})
+		respondError(c, 500, "Failed to fetch content values config", err)
 		return
 	}
 
 	// Migrate to Order if needed (for existing content types without Order)
-	if err := services.MigrateConfigToOrder(access_token, owner, repo, ctSlug, newBranchName, config); err != nil {
-		c.JSON(500, gin.H{"error": "Failed to migrate config"})
+	if err := services.MigrateConfigToOrder(ctx, b, ctSlug, config); err != nil {
+		respondError(c, 500, "Failed to migrate config", err)
 		return
 	}
 
+	if err := checkUniqueFields(c, b, ctSlug, config, contentType, &newValue); err != nil {
+		return // Error response already sent by checkUniqueFields
+	}
+
 	// Check slug uniqueness if provided
 	if newValue.Slug != "" {
 		if _, exists := config.Slugs[newValue.Slug]; exists {
@@ -181,11 +229,7 @@ func CreateValueOfType(c *gin.Context) {
 		}
 
 		// Create slug.json file
-		err = services.CreateOrUpdateFile(access_token, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, newValue.Slug), fmt.Sprintf("Add slug file for content value %s", newValue.Id), string(newValueJson), newBranchName)
-		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to create slug file"})
-			return
-		}
+		b.WriteFile(fmt.Sprintf("data/%s/%s.json", ctSlug, newValue.Slug), string(newValueJson))
 
 		// Add slug to config
 		config.Slugs[newValue.Slug] = newValue.Id
@@ -206,19 +250,25 @@ func CreateValueOfType(c *gin.Context) {
 	}
 
 	// Regenerate indexes
-	if addTo == "top" {
+	if contentType.SortBy != "" {
+		// Sorted types can place the new entry anywhere
+		err = services.SortContentValues(ctx, b, ctSlug, config, contentType)
+		if err == nil {
+			err = services.RegenerateIndexes(ctx, b, ctSlug, config)
+		}
+	} else if addTo == "top" {
 		// If adding to top, regenerate from page 1
-		err = services.RegenerateIndexes(access_token, owner, repo, ctSlug, newBranchName, config)
+		err = services.RegenerateIndexes(ctx, b, ctSlug, config)
 	} else {
 		// If adding to bottom, only regenerate from the last page
 		lastPage := config.TotalPages
 		if lastPage < 1 {
 			lastPage = 1
 		}
-		err = services.RegenerateIndexesFromPage(access_token, owner, repo, ctSlug, newBranchName, config, lastPage)
+		err = services.RegenerateIndexesFromPage(ctx, b, ctSlug, config, lastPage)
 	}
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to regenerate indexes"})
+		respondError(c, 500, "Failed to regenerate indexes", err)
 		return
 	}
 
@@ -226,15 +276,15 @@ func CreateValueOfType(c *gin.Context) {
 	config.TotalItems = len(config.Order)
 
 	// Save config
-	err = services.SaveContentValueConfig(access_token, owner, repo, ctSlug, newBranchName, config)
+	err = services.SaveContentValueConfig(b, ctSlug, config)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to save config"})
+		respondError(c, 500, "Failed to save config", err)
 		return
 	}
 
-	err = services.MergeBranch(access_token, owner, repo, newBranchName, fmt.Sprintf("Added new content value - %s/%s", ctSlug, newValue.Id))
+	err = b.Commit(ctx, fmt.Sprintf("Added new content value - %s/%s", ctSlug, newValue.Id))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to merge branch"})
+		respondCommitError(c, err)
 		return
 	}
 
@@ -242,6 +292,7 @@ func CreateValueOfType(c *gin.Context) {
 }
 
 func UpdateValueById(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	ctSlug := c.Param("ctSlug")
@@ -264,9 +315,22 @@ func UpdateValueById(c *gin.Context) {
 		}
 	}
 
-	configFile, err := services.GetRepoConfig(access_token, owner, repo)
+	unlock, err := services.LockRepo(ctx, owner, repo, ctSlug)
+	if err != nil {
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
+		return
+	}
+	defer unlock()
+
+	b, err := services.NewCommitBuilder(ctx, access_token, owner, repo)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch or parse config"})
+		respondError(c, 500, "Failed to start commit", err)
+		return
+	}
+
+	configFile, err := services.LoadRepoConfig(ctx, b)
+	if err != nil {
+		respondError(c, 500, "Failed to fetch or parse config", err)
 		return
 	}
 
@@ -277,39 +341,48 @@ func UpdateValueById(c *gin.Context) {
 	}
 
 	// Validate fields
-	if err := validateContentValueFields(c, &updatedValue, contentType, access_token, owner, repo); err != nil {
+	if err := validateContentValueFields(c, b, &updatedValue, contentType, access_token, owner, repo); err != nil {
 		return
 	}
 
 	updatedValueJson, err := json.Marshal(updatedValue)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to marshal updated content value"})
+		respondError(c, 500, "Failed to marshal updated content value", err)
 		return
 	}
 
-	newBranchName := uuid.New().String()
-	err = services.CreateBranch(access_token, owner, repo, newBranchName)
+	valuePath := fmt.Sprintf("data/%s/%s.json", ctSlug, id)
+	currentContents, err := b.GetFileContents(ctx, valuePath)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create new branch."})
+		var notFound *services.FileNotFoundError
+		if errors.As(err, &notFound) {
+			c.JSON(404, gin.H{"error": "Content value not found"})
+			return
+		}
+		respondError(c, 500, "Failed to fetch content value", err)
+		return
+	}
+	if !ifMatchSatisfied(c, currentContents) {
+		respondVersionConflict(c, currentContents)
 		return
 	}
 
 	// Update the main id.json file
-	err = services.CreateOrUpdateFile(access_token, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, id), fmt.Sprintf("Update content value %s in %s", id, ctSlug), string(updatedValueJson), newBranchName)
+	b.WriteFile(valuePath, string(updatedValueJson))
+
+	config, err := services.GetContentValueConfig(ctx, b, ctSlug)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to update content value file"})
+		respondError(c, 500, "Failed to fetch content values config", err)
 		return
 	}
 
-	config, err := services.GetContentValueConfig(access_token, owner, repo, ctSlug, newBranchName)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch content values config"})
+	// Migrate if needed
+	if err := services.MigrateConfigToOrder(ctx, b, ctSlug, config); err != nil {
+		respondError(c, 500, "Failed to migrate config", err)
 		return
 	}
 
-	// Migrate if needed
-	if err := services.MigrateConfigToOrder(access_token, owner, repo, ctSlug, newBranchName, config); err != nil {
-		c.JSON(500, gin.H{"error": "Failed to migrate config"})
+	if err := checkUniqueFields(c, b, ctSlug, config, contentType, &updatedValue); err != nil {
 		return
 	}
 
@@ -327,9 +400,9 @@ func UpdateValueById(c *gin.Context) {
 	if oldSlug != updatedValue.Slug {
 		// Delete old slug file if it existed
 		if oldSlug != "" {
-			err = services.DeleteFile(access_token, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, oldSlug), fmt.Sprintf("Remove old slug file for content value %s", id), newBranchName)
+			err = b.DeleteFile(ctx, fmt.Sprintf("data/%s/%s.json", ctSlug, oldSlug))
 			if err != nil {
-				c.JSON(500, gin.H{"error": "Failed to delete old slug file"})
+				respondError(c, 500, "Failed to delete old slug file", err)
 				return
 			}
 			delete(config.Slugs, oldSlug)
@@ -344,21 +417,13 @@ func UpdateValueById(c *gin.Context) {
 				return
 			}
 
-			err = services.CreateOrUpdateFile(access_token, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, updatedValue.Slug), fmt.Sprintf("Add slug file for content value %s", id), string(updatedValueJson), newBranchName)
-			if err != nil {
-				c.JSON(500, gin.H{"error": "Failed to create slug file"})
-				return
-			}
+			b.WriteFile(fmt.Sprintf("data/%s/%s.json", ctSlug, updatedValue.Slug), string(updatedValueJson))
 			config.Slugs[updatedValue.Slug] = id
 			configChanged = true
 		}
 	} else if updatedValue.Slug != "" {
 		// Slug hasn't changed but we still need to update the slug file with new content
-		err = services.CreateOrUpdateFile(access_token, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, updatedValue.Slug), fmt.Sprintf("Update slug file for content value %s", id), string(updatedValueJson), newBranchName)
-		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to update slug file"})
-			return
-		}
+		b.WriteFile(fmt.Sprintf("data/%s/%s.json", ctSlug, updatedValue.Slug), string(updatedValueJson))
 	}
 
 	page, exists := config.Items[id]
@@ -367,41 +432,50 @@ func UpdateValueById(c *gin.Context) {
 		return
 	}
 
-	indexContents, err := services.GetFileContents(access_token, owner, repo, fmt.Sprintf("data/%s/index-%d.json", ctSlug, page), newBranchName)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch index file"})
-		return
-	}
+	if contentType.SortBy != "" {
+		// The new value may move the entry to another position
+		if err := services.SortContentValues(ctx, b, ctSlug, config, contentType); err != nil {
+			respondError(c, 500, "Failed to sort content values", err)
+			return
+		}
+		if err := services.RegenerateIndexes(ctx, b, ctSlug, config); err != nil {
+			respondError(c, 500, "Failed to regenerate indexes", err)
+			return
+		}
+		configChanged = true
+	} else {
+		indexContents, err := b.GetFileContents(ctx, fmt.Sprintf("data/%s/index-%d.json", ctSlug, page))
+		if err != nil {
+			respondError(c, 500, "Failed to fetch index file", err)
+			return
+		}
 
-	var indexFile models.ContentValueIndexFile
-	err = json.Unmarshal([]byte(indexContents), &indexFile)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to parse index file"})
-		return
-	}
+		var indexFile models.ContentValueIndexFile
+		err = json.Unmarshal([]byte(indexContents), &indexFile)
+		if err != nil {
+			respondError(c, 500, "Failed to parse index file", err)
+			return
+		}
 
-	found := false
-	for i, item := range indexFile.Items {
-		if item.Id == id {
-			indexFile.Items[i] = updatedValue
-			found = true
-			break
+		found := false
+		for i, item := range indexFile.Items {
+			if item.Id == id {
+				indexFile.Items[i] = updatedValue
+				found = true
+				break
+			}
+		}
+		if !found {
+			indexFile.Items = append(indexFile.Items, updatedValue)
 		}
-	}
-	if !found {
-		indexFile.Items = append(indexFile.Items, updatedValue)
-	}
 
-	updatedIndexJson, err := json.Marshal(indexFile)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to marshal updated index file"})
-		return
-	}
+		updatedIndexJson, err := json.Marshal(indexFile)
+		if err != nil {
+			respondError(c, 500, "Failed to marshal updated index file", err)
+			return
+		}
 
-	err = services.CreateOrUpdateFile(access_token, owner, repo, fmt.Sprintf("data/%s/index-%d.json", ctSlug, page), fmt.Sprintf("Update index page %d for %s", page, ctSlug), string(updatedIndexJson), newBranchName)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to update index file"})
-		return
+		b.WriteFile(fmt.Sprintf("data/%s/index-%d.json", ctSlug, page), string(updatedIndexJson))
 	}
 
 	config.TotalPages = (len(config.Order)-1)/config.ItemsPerPage + 1
@@ -409,47 +483,54 @@ func UpdateValueById(c *gin.Context) {
 
 	// Update config if slugs changed
 	if configChanged {
-		err = services.SaveContentValueConfig(access_token, owner, repo, ctSlug, newBranchName, config)
+		err = services.SaveContentValueConfig(b, ctSlug, config)
 		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to update config"})
+			respondError(c, 500, "Failed to update config", err)
 			return
 		}
 	}
 
-	err = services.MergeBranch(access_token, owner, repo, newBranchName, fmt.Sprintf("Edit content value - %s/%s", ctSlug, id))
+	err = b.Commit(ctx, fmt.Sprintf("Edit content value - %s/%s", ctSlug, id))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to merge branch"})
+		respondCommitError(c, err)
 		return
 	}
 
+	c.Header("ETag", etagFor(string(updatedValueJson)))
 	c.JSON(200, updatedValue)
 }
 
 func DeleteValueById(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	ctSlug := c.Param("ctSlug")
 	id := c.Param("id")
 	access_token := c.GetString("user_access_token")
 
-	// Create branch for changes
-	newBranchName := uuid.New().String()
-	err := services.CreateBranch(access_token, owner, repo, newBranchName)
+	unlock, err := services.LockRepo(ctx, owner, repo, ctSlug)
+	if err != nil {
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
+		return
+	}
+	defer unlock()
+
+	b, err := services.NewCommitBuilder(ctx, access_token, owner, repo)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create new branch"})
+		respondError(c, 500, "Failed to start commit", err)
 		return
 	}
 
 	// Fetch config
-	config, err := services.GetContentValueConfig(access_token, owner, repo, ctSlug, newBranchName)
+	config, err := services.GetContentValueConfig(ctx, b, ctSlug)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch content values config"})
+		respondError(c, 500, "Failed to fetch content values config", err)
 		return
 	}
 
 	// Migrate if needed
-	if err := services.MigrateConfigToOrder(access_token, owner, repo, ctSlug, newBranchName, config); err != nil {
-		c.JSON(500, gin.H{"error": "Failed to migrate config"})
+	if err := services.MigrateConfigToOrder(ctx, b, ctSlug, config); err != nil {
+		respondError(c, 500, "Failed to migrate config", err)
 		return
 	}
 
@@ -466,20 +547,56 @@ func DeleteValueById(c *gin.Context) {
 		return
 	}
 
+	if c.GetHeader("If-Match") != "" {
+		currentContents, err := b.GetFileContents(ctx, fmt.Sprintf("data/%s/%s.json", ctSlug, id))
+		if err != nil {
+			var notFound *services.FileNotFoundError
+			if errors.As(err, &notFound) {
+				c.JSON(404, gin.H{"error": "Content value not found"})
+				return
+			}
+			respondError(c, 500, "Failed to fetch content value", err)
+			return
+		}
+		if !ifMatchSatisfied(c, currentContents) {
+			respondVersionConflict(c, currentContents)
+			return
+		}
+	}
+
+	// Deleting a referenced entry would leave dangling IDs behind
+	configFile, err := services.LoadRepoConfig(ctx, b)
+	if err != nil {
+		respondError(c, 500, "Failed to fetch or parse config", err)
+		return
+	}
+	references, err := services.FindValueReferences(ctx, b, configFile, ctSlug, id)
+	if err != nil {
+		respondError(c, 500, "Failed to look up references", err)
+		return
+	}
+	if len(references) > 0 {
+		c.JSON(409, gin.H{
+			"error":         "Content value is still referenced by other entries",
+			"referenced_by": references,
+		})
+		return
+	}
+
 	// Find the page where this item is located
 	affectedPage := config.Items[id]
 
 	// Delete the main id.json file
-	err = services.DeleteFile(access_token, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, id), fmt.Sprintf("Delete content value %s from %s", id, ctSlug), newBranchName)
+	err = b.DeleteFile(ctx, fmt.Sprintf("data/%s/%s.json", ctSlug, id))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to delete content value file"})
+		respondError(c, 500, "Failed to delete content value file", err)
 		return
 	}
 
 	// Delete slug file if exists
 	for slug, valueId := range config.Slugs {
 		if valueId == id {
-			err = services.DeleteFile(access_token, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, slug), fmt.Sprintf("Delete slug file for content value %s", id), newBranchName)
+			err = b.DeleteFile(ctx, fmt.Sprintf("data/%s/%s.json", ctSlug, slug))
 			if err != nil {
 				// Log but continue - slug file may already be deleted
 				fmt.Println("[WARN] Failed to delete slug file:", err)
@@ -496,9 +613,9 @@ func DeleteValueById(c *gin.Context) {
 	delete(config.Items, id)
 
 	// Regenerate indexes from affected page onward
-	err = services.RegenerateIndexesFromPage(access_token, owner, repo, ctSlug, newBranchName, config, affectedPage)
+	err = services.RegenerateIndexesFromPage(ctx, b, ctSlug, config, affectedPage)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to regenerate indexes"})
+		respondError(c, 500, "Failed to regenerate indexes", err)
 		return
 	}
 
@@ -506,15 +623,15 @@ func DeleteValueById(c *gin.Context) {
 	config.TotalItems = len(config.Order)
 
 	// Save config
-	err = services.SaveContentValueConfig(access_token, owner, repo, ctSlug, newBranchName, config)
+	err = services.SaveContentValueConfig(b, ctSlug, config)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to save config"})
+		respondError(c, 500, "Failed to save config", err)
 		return
 	}
 
-	err = services.MergeBranch(access_token, owner, repo, newBranchName, fmt.Sprintf("Deleted content value - %s/%s", ctSlug, id))
+	err = b.Commit(ctx, fmt.Sprintf("Deleted content value - %s/%s", ctSlug, id))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to merge branch"})
+		respondCommitError(c, err)
 		return
 	}
 
@@ -527,6 +644,7 @@ type ReorderValueRequest struct {
 }
 
 func ReorderValueById(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	ctSlug := c.Param("ctSlug")
@@ -539,24 +657,41 @@ func ReorderValueById(c *gin.Context) {
 		return
 	}
 
-	// Create branch for changes
-	newBranchName := uuid.New().String()
-	err := services.CreateBranch(access_token, owner, repo, newBranchName)
+	unlock, err := services.LockRepo(ctx, owner, repo, ctSlug)
+	if err != nil {
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
+		return
+	}
+	defer unlock()
+
+	b, err := services.NewCommitBuilder(ctx, access_token, owner, repo)
+	if err != nil {
+		respondError(c, 500, "Failed to start commit", err)
+		return
+	}
+
+	// Read through the builder, so the commit is refused if the content type
+	// is switched to sorted entries in the meantime
+	configFile, err := services.LoadRepoConfig(ctx, b)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create new branch"})
+		respondError(c, 500, "Failed to fetch or parse config", err)
+		return
+	}
+	if contentType := services.GetContentTypeFromConfig(configFile, ctSlug); contentType != nil && contentType.SortBy != "" {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Entries of this content type are sorted by %s and cannot be moved", contentType.SortBy)})
 		return
 	}
 
 	// Fetch config
-	config, err := services.GetContentValueConfig(access_token, owner, repo, ctSlug, newBranchName)
+	config, err := services.GetContentValueConfig(ctx, b, ctSlug)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch content values config"})
+		respondError(c, 500, "Failed to fetch content values config", err)
 		return
 	}
 
 	// Migrate if needed
-	if err := services.MigrateConfigToOrder(access_token, owner, repo, ctSlug, newBranchName, config); err != nil {
-		c.JSON(500, gin.H{"error": "Failed to migrate config"})
+	if err := services.MigrateConfigToOrder(ctx, b, ctSlug, config); err != nil {
+		respondError(c, 500, "Failed to migrate config", err)
 		return
 	}
 
@@ -613,9 +748,9 @@ func ReorderValueById(c *gin.Context) {
 	}
 
 	// Regenerate indexes from the earliest affected page
-	err = services.RegenerateIndexesFromPage(access_token, owner, repo, ctSlug, newBranchName, config, affectedFromPage)
+	err = services.RegenerateIndexesFromPage(ctx, b, ctSlug, config, affectedFromPage)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to regenerate indexes"})
+		respondError(c, 500, "Failed to regenerate indexes", err)
 		return
 	}
 
@@ -623,107 +758,73 @@ func ReorderValueById(c *gin.Context) {
 	config.TotalItems = len(config.Order)
 
 	// Save config
-	err = services.SaveContentValueConfig(access_token, owner, repo, ctSlug, newBranchName, config)
+	err = services.SaveContentValueConfig(b, ctSlug, config)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to save config"})
+		respondError(c, 500, "Failed to save config", err)
 		return
 	}
 
-	err = services.MergeBranch(access_token, owner, repo, newBranchName, fmt.Sprintf("Reordered content value %s to position %d in %s", id, req.Position, ctSlug))
+	err = b.Commit(ctx, fmt.Sprintf("Reordered content value %s to position %d in %s", id, req.Position, ctSlug))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to merge branch"})
+		respondCommitError(c, err)
 		return
 	}
 
 	c.JSON(200, gin.H{"message": "Content value reordered successfully", "position": req.Position})
 }
 
-// validateContentValueFields validates the fields of a content value against its content type definition
-func validateContentValueFields(c *gin.Context, value *models.ContentValue, contentType *models.ContentType, accessToken, owner, repo string) error {
-	for key, fieldValue := range value.Value {
-		fieldIndex := slices.IndexFunc(contentType.Fields, func(f models.ContentTypeField) bool {
-			return f.FieldName == key
-		})
-		if fieldIndex == -1 {
-			c.JSON(400, gin.H{"error": fmt.Sprintf("Field %s is not defined in content type", key)})
-			return fmt.Errorf("field not defined")
-		}
-		fieldDef := &contentType.Fields[fieldIndex]
-
-		switch fieldDef.FieldType {
-		case "text", "textarea":
-			_, ok := fieldValue.(string)
-			if !ok {
-				c.JSON(400, gin.H{"error": fmt.Sprintf("Field %s should be a string", key)})
-				return fmt.Errorf("invalid field type")
-			}
-		case "number":
-			_, ok := fieldValue.(float64)
-			if !ok {
-				c.JSON(400, gin.H{"error": fmt.Sprintf("Field %s should be a number", key)})
-				return fmt.Errorf("invalid field type")
-			}
-		case "boolean":
-			_, ok := fieldValue.(bool)
-			if !ok {
-				c.JSON(400, gin.H{"error": fmt.Sprintf("Field %s should be a boolean", key)})
-				return fmt.Errorf("invalid field type")
-			}
-		case "select":
-			strVal, ok := fieldValue.(string)
-			if !ok {
-				c.JSON(400, gin.H{"error": fmt.Sprintf("Field %s should be a string", key)})
-				return fmt.Errorf("invalid field type")
-			}
-			validOption := slices.Contains(fieldDef.Options, strVal)
-			if !validOption {
-				c.JSON(400, gin.H{"error": fmt.Sprintf("Field %s has invalid option %s", key, strVal)})
-				return fmt.Errorf("invalid option")
-			}
-		case "media":
-			isMultiple := slices.Contains(fieldDef.Options, "multiple")
-			var mediaIds []string
-
-			if isMultiple {
-				arr, ok := fieldValue.([]interface{})
-				if !ok {
-					c.JSON(400, gin.H{"error": fmt.Sprintf("Field %s should be an array of media IDs", key)})
-					return fmt.Errorf("invalid field type")
-				}
-				for _, item := range arr {
-					strVal, ok := item.(string)
-					if !ok {
-						c.JSON(400, gin.H{"error": fmt.Sprintf("Field %s should contain string media IDs", key)})
-						return fmt.Errorf("invalid field type")
-					}
-					mediaIds = append(mediaIds, strVal)
-				}
-			} else {
-				strVal, ok := fieldValue.(string)
-				if !ok {
-					c.JSON(400, gin.H{"error": fmt.Sprintf("Field %s should be a string media ID", key)})
-					return fmt.Errorf("invalid field type")
-				}
-				if strVal != "" {
-					mediaIds = []string{strVal}
-				}
-			}
+// validateContentValueFields validates the fields of a content value against
+// its content type definition, using the registered field types. Missing
+// optional fields get their default first. Every problem is collected and
+// sent back at once, so the editor can mark all offending fields in one go.
+func validateContentValueFields(c *gin.Context, b *services.CommitBuilder, value *models.ContentValue, contentType *models.ContentType, accessToken, owner, repo string) error {
+	ctx := c.Request.Context()
+	if value.Value == nil {
+		value.Value = map[string]any{}
+	}
 
-			if len(mediaIds) > 0 {
-				invalidIds, err := services.ValidateMediaIds(accessToken, owner, repo, mediaIds)
-				if err != nil {
-					c.JSON(500, gin.H{"error": "Failed to validate media references"})
-					return fmt.Errorf("validation error")
-				}
-				if len(invalidIds) > 0 {
-					c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid media ID(s) for field %s: %v", key, invalidIds)})
-					return fmt.Errorf("invalid media ids")
-				}
-			}
-		default:
-			c.JSON(400, gin.H{"error": fmt.Sprintf("Unsupported field type %s for field %s", fieldDef.FieldType, key)})
-			return fmt.Errorf("unsupported field type")
-		}
+	fc := services.FieldContext{Token: accessToken, Owner: owner, Repo: repo, Builder: b}
+	fieldErrors, err := services.ValidateFieldValues(ctx, fc, value.Value, contentType.Fields, "")
+	if err != nil {
+		respondError(c, 500, "Failed to validate fields", err)
+		return fmt.Errorf("validation error")
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": fieldErrors})
+		return fmt.Errorf("invalid fields")
+	}
+
+	// Whatever the client sent, the HTML always matches the saved source
+	rendered, err := services.RenderFieldValues(contentType, value.Value)
+	if err != nil {
+		respondError(c, 500, "Failed to render markdown", err)
+		return fmt.Errorf("render error")
 	}
+	value.Rendered = rendered
+
 	return nil
 }
+
+// checkUniqueFields rejects a value whose unique fields repeat those of
+// another entry. It runs with the content type locked, after the entry's
+// other fields passed validateContentValueFields.
+func checkUniqueFields(c *gin.Context, b *services.CommitBuilder, ctSlug string, config *models.ContentValueConfigFile, contentType *models.ContentType, value *models.ContentValue) error {
+	taken, err := services.FindUniqueConflicts(c.Request.Context(), b, ctSlug, config, contentType, value)
+	if err != nil {
+		respondError(c, 500, "Failed to check unique fields", err)
+		return err
+	}
+	if len(taken) == 0 {
+		return nil
+	}
+
+	fieldErrors := make([]models.FieldError, len(taken))
+	for i, field := range taken {
+		fieldErrors[i] = models.FieldError{
+			Field:   field,
+			Message: fmt.Sprintf("Field %s must be unique, another entry already has this value", field),
+		}
+	}
+	c.JSON(400, gin.H{"error": "Validation failed", "fields": fieldErrors})
+	return fmt.Errorf("duplicate values")
+}
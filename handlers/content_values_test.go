@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vachanmn123/vachancms/services"
+)
+
+func TestDeleteValueByIdIfMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifMatch string
+		// missing removes the entry file while leaving it in the order
+		missing    bool
+		wantStatus int
+	}{
+		{name: "any version", ifMatch: "*", wantStatus: 200},
+		{name: "stale version", ifMatch: `"0000"`, wantStatus: http.StatusConflict},
+		{name: "missing entry", ifMatch: "*", missing: true, wantStatus: 404},
+		{name: "missing entry without If-Match", missing: true, wantStatus: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newContentTypeRepo(t)
+			if tt.missing {
+				head, _ := s.GetHead(t.Context(), "o", "r", "")
+				changes := []services.FileChange{{Path: "data/posts/1.json", Delete: true}}
+				if _, err := s.CommitChanges(t.Context(), "o", "r", "main", head, "remove", changes); err != nil {
+					t.Fatalf("CommitChanges: %v", err)
+				}
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.DELETE("/:owner/:repo/:ctSlug/:id", DeleteValueById)
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodDelete, "/o/r/posts/1", nil)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
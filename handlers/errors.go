@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vachanmn123/vachancms/services"
+)
+
+// statusClientClosedRequest is the non-standard status logged for requests
+// the client abandoned before a response could be sent
+const statusClientClosedRequest = 499
+
+// respondError sends the response for a failed service call. Rate limited
+// calls become a 429 carrying the reset time so the frontend can tell the user
+// when to try again; anything else gets the given status and message.
+func respondError(c *gin.Context, status int, message string, err error) {
+	if errors.Is(err, context.Canceled) {
+		// Nobody is waiting for the response any more
+		c.AbortWithStatus(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.JSON(504, gin.H{"error": "The request timed out"})
+		return
+	}
+	if limited, ok := services.AsRateLimitError(err); ok {
+		retryAfter := max(int(time.Until(limited.Reset).Seconds()), 1)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(429, gin.H{
+			"error":    fmt.Sprintf("Rate limit exceeded, try again after %s", limited.Reset.UTC().Format("15:04:05 MST")),
+			"reset_at": limited.Reset.UTC(),
+		})
+		return
+	}
+	c.JSON(status, gin.H{"error": message})
+}
+
+// respondCommitError reports a failed commit. When another writer changed the
+// same files in the meantime the client gets a 409 and can simply retry.
+func respondCommitError(c *gin.Context, err error) {
+	var moved *services.BranchMovedError
+	if errors.As(err, &moved) {
+		c.JSON(409, gin.H{"error": "The repository was changed by someone else, please retry"})
+		return
+	}
+	respondError(c, 500, "Failed to commit changes", err)
+}
@@ -2,8 +2,10 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -13,7 +15,10 @@ import (
 	"github.com/vachanmn123/vachancms/services"
 )
 
+var mediaExtensionRegex = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
 func ListMedia(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	access_token := c.GetString("user_access_token")
@@ -28,16 +33,16 @@ func ListMedia(c *gin.Context) {
 		}
 	}
 
-	configContents, err := services.GetFileContents(access_token, owner, repo, "media/config.json")
+	configContents, err := services.GetFileContents(ctx, access_token, owner, repo, "media/config.json")
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch media config"})
+		respondError(c, 500, "Failed to fetch media config", err)
 		return
 	}
 
 	var config models.MediaConfigFile
 	err = json.Unmarshal([]byte(configContents), &config)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to parse media config"})
+		respondError(c, 500, "Failed to parse media config", err)
 		return
 	}
 
@@ -46,9 +51,9 @@ func ListMedia(c *gin.Context) {
 		return
 	}
 
-	indexContents, err := services.GetFileContents(access_token, owner, repo, fmt.Sprintf("media/index-%d.json", page))
+	indexContents, err := services.GetFileContents(ctx, access_token, owner, repo, fmt.Sprintf("media/index-%d.json", page))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch media index"})
+		respondError(c, 500, "Failed to fetch media index", err)
 		return
 	}
 
@@ -60,7 +65,7 @@ func ListMedia(c *gin.Context) {
 	var index MediaIndexWithTotalPages
 	err = json.Unmarshal([]byte(indexContents), &index)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to parse media index"})
+		respondError(c, 500, "Failed to parse media index", err)
 		return
 	}
 
@@ -69,7 +74,11 @@ func ListMedia(c *gin.Context) {
 	c.JSON(200, index)
 }
 
+// maxMediaSize is the largest file GitHub accepts as a single blob
+const maxMediaSize = 100 << 20
+
 func UploadMedia(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	access_token := c.GetString("user_access_token")
@@ -81,35 +90,69 @@ func UploadMedia(c *gin.Context) {
 	}
 	defer file.Close()
 
-	content, err := io.ReadAll(file)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to read file content"})
+	if header.Size > maxMediaSize {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("File exceeds the maximum size of %d MB", maxMediaSize>>20)})
+		return
+	}
+
+	// The extension becomes part of the stored file's path
+	extension := strings.TrimPrefix(filepath.Ext(header.Filename), ".")
+	if !mediaExtensionRegex.MatchString(extension) {
+		c.JSON(400, gin.H{"error": "File name must end in an extension of letters and digits"})
 		return
 	}
 
-	id := uuid.New().String()
+	id := fmt.Sprintf("%s.%s", uuid.New().String(), extension)
 	fileName := header.Filename
 	fileType := header.Header.Get("Content-Type")
 	if fileType == "" {
 		fileType = "application/octet-stream"
 	}
 
-	newBranchName := uuid.New().String()
-	err = services.CreateBranch(access_token, owner, repo, newBranchName)
+	unlock, err := services.LockRepo(ctx, owner, repo, "media")
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create new branch."})
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
 		return
 	}
+	defer unlock()
 
-	suffixFileType := strings.Split(fileName, ".")[len(strings.Split(fileName, "."))-1]
-	id = fmt.Sprintf("%s.%s", id, suffixFileType)
+	b, err := services.NewCommitBuilder(ctx, access_token, owner, repo)
+	if err != nil {
+		respondError(c, 500, "Failed to start commit", err)
+		return
+	}
 
-	// Upload the file
-	err = services.UploadFile(access_token, owner, repo, fmt.Sprintf("media/%s", id), fmt.Sprintf("Upload media file: %s", fileName), content, newBranchName)
+	repoConfigContents, err := b.GetFileContents(ctx, "config/config.json")
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to upload file"})
+		respondError(c, 500, "Failed to fetch config", err)
 		return
 	}
+	var repoConfig models.ConfigFile
+	if err := json.Unmarshal([]byte(repoConfigContents), &repoConfig); err != nil {
+		respondError(c, 500, "Failed to parse config", err)
+		return
+	}
+
+	// Upload the file, streamed from the request so it is never held in memory
+	if repoConfig.Media != nil && repoConfig.Media.UseLFS {
+		pointer, err := services.UploadLFSObject(ctx, access_token, owner, repo, file)
+		if errors.Is(err, services.ErrNoLFSServer) {
+			c.JSON(400, gin.H{"error": "No LFS server is configured for this storage backend"})
+			return
+		}
+		if err != nil {
+			respondError(c, 502, "Failed to upload file to LFS", err)
+			return
+		}
+		b.WriteFile(fmt.Sprintf("media/%s", id), pointer.String())
+
+		if err := services.TrackMediaWithLFS(ctx, b); err != nil {
+			respondError(c, 500, "Failed to update .gitattributes", err)
+			return
+		}
+	} else {
+		b.UploadStream(fmt.Sprintf("media/%s", id), file)
+	}
 
 	mediaFile := models.MediaFile{
 		Id:       id,
@@ -118,9 +161,10 @@ func UploadMedia(c *gin.Context) {
 	}
 
 	// Handle config and index
-	configContents, err := services.GetFileContents(access_token, owner, repo, "media/config.json", newBranchName)
+	configContents, err := b.GetFileContents(ctx, "media/config.json")
 	var config models.MediaConfigFile
-	if err != nil {
+	var notFound *services.FileNotFoundError
+	if errors.As(err, &notFound) {
 		// Create initial config
 		config = models.MediaConfigFile{
 			TotalPages:   1,
@@ -129,7 +173,7 @@ func UploadMedia(c *gin.Context) {
 			Items:        map[string]int{},
 		}
 		configJson, _ := json.Marshal(config)
-		services.CreateOrUpdateFile(access_token, owner, repo, "media/config.json", "Initialize media config", string(configJson), newBranchName)
+		b.WriteFile("media/config.json", string(configJson))
 
 		// Create initial index
 		indexFile := models.MediaIndexFile{
@@ -137,9 +181,14 @@ func UploadMedia(c *gin.Context) {
 			Media: []models.MediaFile{},
 		}
 		indexJson, _ := json.Marshal(indexFile)
-		services.CreateOrUpdateFile(access_token, owner, repo, "media/index-1.json", "Initialize media index", string(indexJson), newBranchName)
-	} else {
-		json.Unmarshal([]byte(configContents), &config)
+		b.WriteFile("media/index-1.json", string(indexJson))
+	} else if err != nil {
+		// Anything but a missing file, such as a rate limit, must not reset the index
+		respondError(c, 500, "Failed to fetch media config", err)
+		return
+	} else if err := json.Unmarshal([]byte(configContents), &config); err != nil {
+		respondError(c, 500, "Failed to parse media config", err)
+		return
 	}
 
 	targetPage := (config.TotalItems + config.ItemsPerPage) / config.ItemsPerPage
@@ -150,33 +199,36 @@ func UploadMedia(c *gin.Context) {
 			Media: []models.MediaFile{},
 		}
 		newIndexJson, _ := json.Marshal(newIndexFile)
-		services.CreateOrUpdateFile(access_token, owner, repo, fmt.Sprintf("media/index-%d.json", targetPage), fmt.Sprintf("Create media index page %d", targetPage), string(newIndexJson), newBranchName)
+		b.WriteFile(fmt.Sprintf("media/index-%d.json", targetPage), string(newIndexJson))
 		config.TotalPages = targetPage
 	}
 
 	// Read and update the target page's index
-	indexContents, err := services.GetFileContents(access_token, owner, repo, fmt.Sprintf("media/index-%d.json", targetPage), newBranchName)
+	indexContents, err := b.GetFileContents(ctx, fmt.Sprintf("media/index-%d.json", targetPage))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch target index"})
+		respondError(c, 500, "Failed to fetch target index", err)
 		return
 	}
 
 	var indexFile models.MediaIndexFile
-	json.Unmarshal([]byte(indexContents), &indexFile)
+	if err := json.Unmarshal([]byte(indexContents), &indexFile); err != nil {
+		respondError(c, 500, "Failed to parse target index", err)
+		return
+	}
 
 	indexFile.Media = append(indexFile.Media, mediaFile)
 	updatedIndexJson, _ := json.Marshal(indexFile)
-	services.CreateOrUpdateFile(access_token, owner, repo, fmt.Sprintf("media/index-%d.json", targetPage), fmt.Sprintf("Update media index page %d", targetPage), string(updatedIndexJson), newBranchName)
+	b.WriteFile(fmt.Sprintf("media/index-%d.json", targetPage), string(updatedIndexJson))
 
 	// Update config
 	config.TotalItems++
 	config.Items[mediaFile.Id] = targetPage
 	updatedConfigJson, _ := json.Marshal(config)
-	services.CreateOrUpdateFile(access_token, owner, repo, "media/config.json", "Update media config", string(updatedConfigJson), newBranchName)
+	b.WriteFile("media/config.json", string(updatedConfigJson))
 
-	err = services.MergeBranch(access_token, owner, repo, newBranchName, fmt.Sprintf("Added new media - %s", mediaFile.Id))
+	err = b.Commit(ctx, fmt.Sprintf("Added new media - %s", mediaFile.Id))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to merge branch"})
+		respondCommitError(c, err)
 		return
 	}
 
@@ -184,22 +236,16 @@ func UploadMedia(c *gin.Context) {
 }
 
 func GetMediaById(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	id := c.Param("id")
 	access_token := c.GetString("user_access_token")
 
-	// Get file content
-	content, err := services.GetFileContents(access_token, owner, repo, fmt.Sprintf("media/%s", id))
-	if err != nil {
-		c.JSON(404, gin.H{"error": "Media file not found"})
-		return
-	}
-
 	// Get metadata from config
-	configContents, err := services.GetFileContents(access_token, owner, repo, "media/config.json")
+	configContents, err := services.GetFileContents(ctx, access_token, owner, repo, "media/config.json")
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch media config"})
+		respondError(c, 500, "Failed to fetch media config", err)
 		return
 	}
 
@@ -212,9 +258,9 @@ func GetMediaById(c *gin.Context) {
 		return
 	}
 
-	indexContents, err := services.GetFileContents(access_token, owner, repo, fmt.Sprintf("media/index-%d.json", page))
+	indexContents, err := services.GetFileContents(ctx, access_token, owner, repo, fmt.Sprintf("media/index-%d.json", page))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch media index"})
+		respondError(c, 500, "Failed to fetch media index", err)
 		return
 	}
 
@@ -235,8 +281,20 @@ func GetMediaById(c *gin.Context) {
 		return
 	}
 
-	// Return file content with appropriate headers
-	c.Header("Content-Type", mediaFile.FileType)
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", mediaFile.FileName))
-	c.Data(200, mediaFile.FileType, []byte(content))
+	// Stream file content with appropriate headers
+	content, size, err := services.OpenMediaFile(ctx, access_token, owner, repo, fmt.Sprintf("media/%s", id))
+	if err != nil {
+		var notFound *services.FileNotFoundError
+		if errors.As(err, &notFound) {
+			c.JSON(404, gin.H{"error": "Media file not found"})
+			return
+		}
+		respondError(c, 500, "Failed to fetch media file", err)
+		return
+	}
+	defer content.Close()
+
+	c.DataFromReader(200, size, mediaFile.FileType, content, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=\"%s\"", mediaFile.FileName),
+	})
 }
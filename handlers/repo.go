@@ -2,22 +2,22 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/vachanmn123/vachancms/models"
 	"github.com/vachanmn123/vachancms/services"
 )
 
 func ListRepositoriesHandler(c *gin.Context) {
+	ctx := c.Request.Context()
 	access_token := c.GetString("user_access_token")
 
-	repos, err := services.ListRepos(access_token)
+	repos, err := services.ListRepos(ctx, access_token)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to fetch repositories"})
+		respondError(c, 500, "Failed to fetch repositories", err)
 		return
 	}
 
@@ -25,19 +25,20 @@ func ListRepositoriesHandler(c *gin.Context) {
 }
 
 func GetRepoConfig(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	access_token := c.GetString("user_access_token")
 
-	configFile, err := services.GetRepoConfig(access_token, owner, repo)
+	configFile, err := services.GetRepoConfig(ctx, access_token, owner, repo)
 	if err != nil {
-
-		if _, ok := err.(*services.FileNotFoundError); ok {
+		var notFound *services.FileNotFoundError
+		if errors.As(err, &notFound) {
 			c.JSON(404, gin.H{"error": "Config file not found"})
 			return
 		}
 
-		c.JSON(500, gin.H{"error": "Failed to fetch or parse config"})
+		respondError(c, 500, "Failed to fetch or parse config", err)
 		return
 	}
 
@@ -45,12 +46,18 @@ func GetRepoConfig(c *gin.Context) {
 }
 
 func InitializeRepo(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	access_token := c.GetString("user_access_token")
 
 	type InitRequest struct {
 		SiteName string `json:"site_name"`
+		UseLFS   bool   `json:"use_lfs"`
+		// ContentBranch keeps the CMS content off the default branch
+		ContentBranch string `json:"content_branch"`
+		// BasePath roots the CMS in a subdirectory, such as "site/cms"
+		BasePath string `json:"base_path"`
 	}
 	var initReq InitRequest
 
@@ -59,6 +66,19 @@ func InitializeRepo(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Invalid request body"})
 		return
 	}
+	if initReq.ContentBranch != "" && !services.ValidBranchName(initReq.ContentBranch) {
+		c.JSON(400, gin.H{"error": "Invalid content branch name"})
+		return
+	}
+	if initReq.UseLFS && !services.LFSAvailable() {
+		c.JSON(400, gin.H{"error": "No LFS server is configured for this storage backend"})
+		return
+	}
+	basePath, ok := services.CleanBasePath(initReq.BasePath)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid base path"})
+		return
+	}
 
 	// Create config content
 	cfg := models.ConfigFile{
@@ -66,61 +86,124 @@ func InitializeRepo(c *gin.Context) {
 		ContentTypes:       []models.ContentType{},
 		InitializationDate: time.Now().String(),
 	}
+	if initReq.UseLFS {
+		cfg.Media = &models.MediaSettings{UseLFS: true}
+	}
 
 	fileContent, err := json.Marshal(cfg)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to marshal config content"})
+		respondError(c, 500, "Failed to marshal config content", err)
 		return
 	}
 
 	commitMsg := "Initialize VachanCMS Repository"
 
+	unlock, err := services.LockRepo(ctx, owner, repo, "config")
+	if err != nil {
+		respondError(c, 503, "Timed out waiting for other changes to the repository", err)
+		return
+	}
+	defer unlock()
+
 	// Check if repo is empty
-	isEmpty, defaultBranch, err := services.IsRepoEmpty(access_token, owner, repo)
+	isEmpty, defaultBranch, err := services.IsRepoEmpty(ctx, access_token, owner, repo)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to check repository status"})
+		respondError(c, 500, "Failed to check repository status", err)
 		return
 	}
 
-	var targetBranch string
-	if isEmpty {
-		// For empty repos, create files on default branch
-		targetBranch = defaultBranch
-	} else {
-		// For non-empty repos, use branch workflow
-		targetBranch = uuid.New().String()
-		err = services.CreateBranch(access_token, owner, repo, targetBranch)
+	contentBranch := defaultBranch
+	if initReq.ContentBranch != "" {
+		contentBranch = initReq.ContentBranch
+	}
+
+	settings := &models.RepoSettingsFile{}
+	if !isEmpty {
+		settings, err = services.GetRepoSettings(ctx, access_token, owner, repo)
 		if err != nil {
-			fmt.Println(err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create a new branch"})
+			respondError(c, 500, "Failed to fetch repository settings", err)
 			return
 		}
 	}
-
-	// Create files
-	err = services.CreateOrUpdateFile(access_token, owner, repo, "config/config.json", commitMsg, string(fileContent), targetBranch)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create config file"})
-		return
+	wanted := models.RepoSettingsFile{BasePath: basePath}
+	if contentBranch != defaultBranch {
+		wanted.ContentBranch = contentBranch
 	}
 
-	err = services.CreateOrUpdateFile(access_token, owner, repo, "content/.gitkeep", commitMsg, "", targetBranch)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create data directory"})
-		return
+	// Everything below resolves the content branch and base path from the
+	// settings, so they go in first. Should the rest fail, the repository
+	// simply shows up as not initialized and can be initialized again.
+	if *settings != wanted {
+		err = services.SaveRepoSettings(ctx, access_token, owner, repo, &wanted, commitMsg)
+		if err != nil {
+			respondError(c, 500, "Failed to save repository settings", err)
+			return
+		}
+		isEmpty = false
 	}
 
-	err = services.CreateOrUpdateFile(access_token, owner, repo, "media/.gitkeep", commitMsg, "", targetBranch)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create media directory"})
-		return
+	if contentBranch != defaultBranch {
+		branches, err := services.ListBranches(ctx, access_token, owner, repo)
+		if err != nil {
+			respondError(c, 500, "Failed to list branches", err)
+			return
+		}
+		exists := false
+		for _, branch := range branches {
+			if branch.Name == contentBranch {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			err = services.CreateBranch(ctx, access_token, owner, repo, contentBranch, defaultBranch)
+			if err != nil {
+				respondError(c, 500, "Failed to create content branch", err)
+				return
+			}
+		}
 	}
 
-	// Only merge if we created a separate branch
-	if !isEmpty {
-		err = services.MergeBranch(access_token, owner, repo, targetBranch, "Initialize repository for VachanCMS")
+	if isEmpty {
+		// The Git Data API cannot commit to a repository without any commits,
+		// so the first files of an empty repo go through the Contents API.
+		err = services.CreateOrUpdateFile(ctx, access_token, owner, repo, "config/config.json", commitMsg, string(fileContent), defaultBranch)
+		if err != nil {
+			respondError(c, 500, "Failed to create config file", err)
+			return
+		}
+
+		err = services.CreateOrUpdateFile(ctx, access_token, owner, repo, "content/.gitkeep", commitMsg, "", defaultBranch)
+		if err != nil {
+			respondError(c, 500, "Failed to create data directory", err)
+			return
+		}
+
+		err = services.CreateOrUpdateFile(ctx, access_token, owner, repo, "media/.gitkeep", commitMsg, "", defaultBranch)
+		if err != nil {
+			respondError(c, 500, "Failed to create media directory", err)
+			return
+		}
+	} else {
+		b, err := services.NewCommitBuilder(ctx, access_token, owner, repo)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, "Failed to start commit", err)
+			return
+		}
+
+		b.WriteFile("config/config.json", string(fileContent))
+		b.WriteFile("content/.gitkeep", "")
+		b.WriteFile("media/.gitkeep", "")
+		if initReq.UseLFS {
+			if err := services.TrackMediaWithLFS(ctx, b); err != nil {
+				respondError(c, http.StatusInternalServerError, "Failed to update .gitattributes", err)
+				return
+			}
+		}
+
+		err = b.Commit(ctx, commitMsg)
 		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to merge branch"})
+			respondCommitError(c, err)
 			return
 		}
 	}
@@ -14,14 +14,16 @@ type PagesConfigResponse struct {
 }
 
 func GetPagesConfig(c *gin.Context) {
+	ctx := c.Request.Context()
 	owner := c.Param("owner")
 	repo := c.Param("repo")
 	access_token := c.GetString("user_access_token")
 
-	pagesConfig, err := services.GetPagesConfig(access_token, owner, repo)
+	pagesConfig, err := services.GetPagesConfig(ctx, access_token, owner, repo)
 	if err != nil {
 		fmt.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "An error occured"})
+		respondError(c, http.StatusInternalServerError, "An error occured", err)
+		return
 	}
 
 	if pagesConfig.Initialized {
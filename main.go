@@ -1,18 +1,38 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/vachanmn123/vachancms/config"
 	"github.com/vachanmn123/vachancms/routes"
+	"github.com/vachanmn123/vachancms/services"
 )
 
 func main() {
 	cfg := config.Load()
+	if err := services.SetupStorage(cfg); err != nil {
+		log.Fatalf("Failed to set up storage: %v", err)
+	}
+
+	// Every request context derives from ctx, so on shutdown in-flight work
+	// against the storage backend is cancelled instead of running to the end
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.JanitorInterval > 0 {
+		services.StartJanitor(ctx, cfg.JanitorInterval, cfg.JanitorBranchAge)
+	}
 
 	router := gin.Default()
 	routes.SetupRoutes(router.Group("/api"))
@@ -33,6 +53,24 @@ func main() {
 		}
 	})
 
-	log.Printf("Server starting on port %s", cfg.Port)
-	router.Run(":" + cfg.Port)
+	server := &http.Server{
+		Addr:        ":" + cfg.Port,
+		Handler:     router,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		log.Printf("Server starting on port %s", cfg.Port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown: %v", err)
+	}
 }
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vachanmn123/vachancms/services"
+)
+
+// TrackRepo registers the repository a request works on with the branch
+// janitor, so its stale temporary branches get swept in the background.
+// Failed requests, such as those to repositories without a CMS config, do
+// not register it.
+func TrackRepo(c *gin.Context) {
+	c.Next()
+	if c.Writer.Status() < http.StatusBadRequest {
+		services.TrackRepo(c.GetString("user_access_token"), c.Param("owner"), c.Param("repo"))
+	}
+}
+
+// CacheRepoSettings lets the request read the repository's settings once
+// instead of on every storage call, see services.WithRepoSettingsCache.
+func CacheRepoSettings(c *gin.Context) {
+	c.Request = c.Request.WithContext(services.WithRepoSettingsCache(c.Request.Context()))
+	c.Next()
+}
+
+// PinBranchHeads makes the request read each branch at the commit it first
+// found it at, see services.WithPinnedHeads.
+func PinBranchHeads(c *gin.Context) {
+	c.Request = c.Request.WithContext(services.WithPinnedHeads(c.Request.Context()))
+	c.Next()
+}
@@ -1,7 +1,26 @@
 package models
 
 type ConfigFile struct {
-	SiteName           string        `json:"site_name" binding:"required"`
-	ContentTypes       []ContentType `json:"content_types" binding:"required"`
-	InitializationDate string        `json:"initialization_date" binding:"required"`
+	SiteName           string         `json:"site_name" binding:"required"`
+	ContentTypes       []ContentType  `json:"content_types" binding:"required"`
+	InitializationDate string         `json:"initialization_date" binding:"required"`
+	Media              *MediaSettings `json:"media,omitempty"`
+}
+
+type MediaSettings struct {
+	// UseLFS stores uploaded media as Git LFS objects, committing only a
+	// pointer file under media/<id>
+	UseLFS bool `json:"use_lfs"`
+}
+
+// RepoSettingsFile is .vachancms.json at the root of the repository's default
+// branch. It tells the CMS where its content lives when that is not the root
+// of the default branch, so the site's own code can stay separate from it.
+type RepoSettingsFile struct {
+	// ContentBranch holds config/, data/ and media/; empty means the default
+	// branch
+	ContentBranch string `json:"content_branch,omitempty"`
+	// BasePath is the directory holding config/, data/, media/ and content/,
+	// relative to the repository root; empty means the root itself
+	BasePath string `json:"base_path,omitempty"`
 }
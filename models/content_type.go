@@ -11,9 +11,50 @@ type ContentTypeField struct {
 	// - media: reference to media file(s) by ID
 	//   - If Options contains "multiple", stores array of media IDs
 	//   - Otherwise, stores a single media ID string
+	// - date: ISO 8601 calendar date, stored as YYYY-MM-DD
+	// - datetime: ISO 8601 date and time, stored in UTC as YYYY-MM-DDTHH:MM:SSZ;
+	//   values without an offset are taken to be UTC
+	// - reference: entry ID(s) of another content type, named in Options
+	//   - If Options contains "multiple", stores array of entry IDs
+	//   - Otherwise, stores a single entry ID string
+	// - markdown: Markdown source; its sanitized HTML is stored in the entry's
+	//   rendered map
+	// - group: object whose values are described by Fields
+	// - repeater: array of such objects, between MinItems and MaxItems long
+	// - json: any JSON value, checked against Schema when one is given
 	FieldType  string   `json:"field_type" binding:"required"`
 	IsRequired bool     `json:"is_required"`
 	Options    []string `json:"options,omitempty"`
+	// Default is stored for the field when an entry is saved without it
+	Default any `json:"default,omitempty"`
+	// Fields are the sub-fields of a group or repeater field
+	Fields   []ContentTypeField `json:"fields,omitempty"`
+	MinItems int                `json:"min_items,omitempty"`
+	MaxItems int                `json:"max_items,omitempty"` // 0 means no limit
+	// Schema is the JSON Schema (a draft 2020-12 subset) values of a json
+	// field must satisfy
+	Schema map[string]any `json:"schema,omitempty"`
+
+	// Validation rules. Lengths (in characters) and Pattern apply to text,
+	// textarea and markdown fields; Min, Max, Step and Integer to number
+	// fields. Pattern matches anywhere in the value unless anchored.
+	MinLength *int     `json:"min_length,omitempty"`
+	MaxLength *int     `json:"max_length,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+	Step      *float64 `json:"step,omitempty"` // counted from Min, or from 0 without one
+	Integer   bool     `json:"integer,omitempty"`
+	// Unique rejects a value another entry of the content type already has
+	Unique bool `json:"unique,omitempty"`
+}
+
+// FieldError is a problem with one field of a submitted content value
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	// Pointer locates the problem inside the value of a json field
+	Pointer string `json:"pointer,omitempty"`
 }
 
 type ContentType struct {
@@ -23,4 +64,8 @@ type ContentType struct {
 	Fields       []ContentTypeField `json:"fields" binding:"required"`
 	ItemsPerPage int                `json:"items_per_page,omitempty"` // Number of items per page (default: 10, min: 1, max: 100)
 	AddTo        string             `json:"add_to,omitempty"`         // Where to add new items: "top" or "bottom" (default: "bottom")
+	// SortBy keeps entries ordered by the value of a date, datetime, number or
+	// text field instead of the order they were added and moved in
+	SortBy        string `json:"sort_by,omitempty"`
+	SortDirection string `json:"sort_direction,omitempty"` // "asc" or "desc" (default: "asc")
 }
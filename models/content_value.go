@@ -20,4 +20,8 @@ type ContentValue struct {
 	Id    string         `json:"id,omitempty"`
 	Slug  string         `json:"slug,omitempty"`
 	Value map[string]any `json:"values" binding:"required"`
+	// Rendered holds the sanitized HTML of each markdown field by path (e.g.
+	// body or faq[1].answer), so static consumers can show it without a
+	// Markdown parser. It is generated on save.
+	Rendered map[string]string `json:"rendered,omitempty"`
 }
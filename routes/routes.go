@@ -15,15 +15,19 @@ func SetupRoutes(router gin.IRouter) {
 
 	protected := router.Group("", middleware.AuthMiddleware)
 	protected.GET("/me", handlers.GetMeHandler)
+	protected.GET("/rate-limit", handlers.GetRateLimitHandler)
 	protected.GET("/repos", handlers.ListRepositoriesHandler)
+	protected.GET("/field-types", handlers.ListFieldTypes)
 
-	repoGroup := protected.Group("/:owner/:repo")
+	repoGroup := protected.Group("/:owner/:repo", middleware.TrackRepo, middleware.CacheRepoSettings, middleware.PinBranchHeads)
 	repoGroup.GET("/config", handlers.GetRepoConfig)
 	repoGroup.POST("/init", handlers.InitializeRepo)
 
 	repoGroup.GET("/content-types", handlers.ListContentTypes)
 	repoGroup.POST("/content-types", handlers.CreateContentType)
-	// Delete and Update will come later, not needed for MVP.
+	repoGroup.PUT("/content-types/:ctSlug", handlers.UpdateContentType)
+	repoGroup.DELETE("/content-types/:ctSlug", handlers.DeleteContentType)
+	repoGroup.POST("/content-types/:ctSlug/migrate", handlers.MigrateContentType)
 
 	repoGroup.GET("/:ctSlug", handlers.ListValuesByType)
 	repoGroup.POST("/:ctSlug", handlers.CreateValueOfType)
@@ -37,4 +41,7 @@ func SetupRoutes(router gin.IRouter) {
 	repoGroup.GET("/media/:id", handlers.GetMediaById)
 
 	repoGroup.GET("/pages", handlers.GetPagesConfig)
+
+	repoGroup.GET("/admin/stale-branches", handlers.ListStaleBranches)
+	repoGroup.DELETE("/admin/stale-branches", handlers.CleanupStaleBranches)
 }
@@ -0,0 +1,545 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vachanmn123/vachancms/models"
+)
+
+func init() {
+	RegisterFieldType(textFieldType{name: "text", description: "Single line of text"})
+	RegisterFieldType(textFieldType{name: "textarea", description: "Multiple lines of text"})
+	RegisterFieldType(markdownFieldType{textFieldType{name: "markdown", description: "Markdown, stored along with its sanitized HTML"}})
+	RegisterFieldType(numberFieldType{})
+	RegisterFieldType(booleanFieldType{})
+	RegisterFieldType(selectFieldType{})
+	RegisterFieldType(idsFieldType{name: "media"})
+	RegisterFieldType(idsFieldType{name: "reference"})
+	RegisterFieldType(dateFieldType{name: "date"})
+	RegisterFieldType(dateFieldType{name: "datetime"})
+	RegisterFieldType(groupFieldType{name: "group"})
+	RegisterFieldType(groupFieldType{name: "repeater"})
+	RegisterFieldType(jsonFieldType{})
+}
+
+// textFieldType stores strings: text, textarea and markdown
+type textFieldType struct {
+	BaseFieldType
+	name        string
+	description string
+}
+
+func (t textFieldType) Validate(ctx context.Context, fc FieldContext, field *models.ContentTypeField, path string, value any) ([]models.FieldError, error) {
+	if _, ok := value.(string); !ok {
+		return invalidField(path, "Field %s should be a string", path), nil
+	}
+	return nil, nil
+}
+
+func (t textFieldType) Convert(ctx context.Context, fc FieldContext, field *models.ContentTypeField, value any) (any, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to %s", value, t.name)
+}
+
+func (textFieldType) SupportedRules() FieldRules {
+	return FieldRules{Length: true}
+}
+
+func (t textFieldType) Describe() FieldTypeDescription {
+	// Markdown is compared by its source, which is rarely what a reader sees
+	return FieldTypeDescription{Name: t.name, Description: t.description, Sortable: t.name == "text", Unique: t.name != "markdown"}
+}
+
+// markdownFieldType is text served along with its sanitized HTML
+type markdownFieldType struct {
+	textFieldType
+}
+
+func (markdownFieldType) Render(field *models.ContentTypeField, value any) (string, error) {
+	source, ok := value.(string)
+	if !ok || source == "" {
+		return "", nil
+	}
+	return RenderMarkdown(source)
+}
+
+type numberFieldType struct {
+	BaseFieldType
+}
+
+func (numberFieldType) Validate(ctx context.Context, fc FieldContext, field *models.ContentTypeField, path string, value any) ([]models.FieldError, error) {
+	if _, ok := value.(float64); !ok {
+		return invalidField(path, "Field %s should be a number", path), nil
+	}
+	return nil, nil
+}
+
+func (numberFieldType) Convert(ctx context.Context, fc FieldContext, field *models.ContentTypeField, value any) (any, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		return number, nil
+	case bool:
+		if v {
+			return float64(1), nil
+		}
+		return float64(0), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to number", value)
+}
+
+func (numberFieldType) SupportedRules() FieldRules {
+	return FieldRules{Range: true}
+}
+
+func (numberFieldType) Describe() FieldTypeDescription {
+	return FieldTypeDescription{Name: "number", Description: "Number", Sortable: true, Unique: true}
+}
+
+type booleanFieldType struct {
+	BaseFieldType
+}
+
+func (booleanFieldType) Validate(ctx context.Context, fc FieldContext, field *models.ContentTypeField, path string, value any) ([]models.FieldError, error) {
+	if _, ok := value.(bool); !ok {
+		return invalidField(path, "Field %s should be a boolean", path), nil
+	}
+	return nil, nil
+}
+
+func (booleanFieldType) Convert(ctx context.Context, fc FieldContext, field *models.ContentTypeField, value any) (any, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", v)
+		}
+		return b, nil
+	case float64:
+		if v == 0 || v == 1 {
+			return v == 1, nil
+		}
+		return nil, fmt.Errorf("%v is not a boolean", v)
+	}
+	return nil, fmt.Errorf("cannot convert %T to boolean", value)
+}
+
+func (booleanFieldType) Describe() FieldTypeDescription {
+	return FieldTypeDescription{Name: "boolean", Description: "True or false"}
+}
+
+type selectFieldType struct {
+	BaseFieldType
+}
+
+func (selectFieldType) Validate(ctx context.Context, fc FieldContext, field *models.ContentTypeField, path string, value any) ([]models.FieldError, error) {
+	strVal, ok := value.(string)
+	if !ok {
+		return invalidField(path, "Field %s should be a string", path), nil
+	}
+	if !slices.Contains(field.Options, strVal) {
+		return invalidField(path, "Field %s has invalid option %s", path, strVal), nil
+	}
+	return nil, nil
+}
+
+func (selectFieldType) ValidateDefinition(field *models.ContentTypeField, path string) []models.FieldError {
+	if len(field.Options) == 0 {
+		return invalidField(path, "Select field %s needs at least one option", field.FieldName)
+	}
+	for _, option := range field.Options {
+		if option == "" {
+			return invalidField(path, "Options of select field %s cannot be empty", field.FieldName)
+		}
+	}
+	return nil
+}
+
+func (selectFieldType) Convert(ctx context.Context, fc FieldContext, field *models.ContentTypeField, value any) (any, error) {
+	text, err := textFieldType{name: "select"}.Convert(ctx, fc, field, value)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(field.Options, text.(string)) {
+		return nil, fmt.Errorf("%q is not one of the options", text)
+	}
+	return text, nil
+}
+
+func (selectFieldType) Describe() FieldTypeDescription {
+	return FieldTypeDescription{Name: "select", Description: "One of the field's options", Unique: true}
+}
+
+// idsFieldType stores the IDs of media files or, for reference fields, of
+// entries of the content type named in Options. With the "multiple" option
+// it stores an array of them.
+type idsFieldType struct {
+	BaseFieldType
+	name string
+}
+
+func (t idsFieldType) Validate(ctx context.Context, fc FieldContext, field *models.ContentTypeField, path string, value any) ([]models.FieldError, error) {
+	kind := "media"
+	target := ""
+	if t.name == "reference" {
+		kind = "entry"
+		target = referenceOption(field)
+		if target == "" {
+			return invalidField(path, "Field %s does not name a content type to reference", path), nil
+		}
+	}
+
+	var ids []string
+	if slices.Contains(field.Options, "multiple") {
+		arr, ok := value.([]any)
+		if !ok {
+			return invalidField(path, "Field %s should be an array of %s IDs", path, kind), nil
+		}
+		for _, item := range arr {
+			strVal, ok := item.(string)
+			if !ok {
+				return invalidField(path, "Field %s should contain string %s IDs", path, kind), nil
+			}
+			ids = append(ids, strVal)
+		}
+	} else {
+		strVal, ok := value.(string)
+		if !ok {
+			return invalidField(path, "Field %s should be a string %s ID", path, kind), nil
+		}
+		if strVal != "" {
+			ids = []string{strVal}
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	if t.name == "media" {
+		invalidIds, err := ValidateMediaIds(ctx, fc.Builder, ids)
+		if err != nil {
+			return nil, err
+		}
+		if len(invalidIds) > 0 {
+			return invalidField(path, "Invalid media ID(s) for field %s: %v", path, invalidIds), nil
+		}
+		return nil, nil
+	}
+
+	invalidIds, err := ValidateReferenceIds(ctx, fc.Builder, target, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(invalidIds) > 0 {
+		return invalidField(path, "Invalid %s entry ID(s) for field %s: %v", target, path, invalidIds), nil
+	}
+	return nil, nil
+}
+
+func (t idsFieldType) ValidateDefinition(field *models.ContentTypeField, path string) []models.FieldError {
+	// Whether the content type exists is up to the caller, which knows them all
+	if t.name == "reference" && referenceOption(field) == "" {
+		return invalidField(path, "Reference field %s needs the slug of a content type in its options", field.FieldName)
+	}
+	return nil
+}
+
+func (t idsFieldType) Convert(ctx context.Context, fc FieldContext, field *models.ContentTypeField, value any) (any, error) {
+	var ids []string
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			ids = []string{v}
+		}
+	case []any:
+		for _, item := range v {
+			id, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s IDs must be strings", t.name)
+			}
+			ids = append(ids, id)
+		}
+	default:
+		return nil, fmt.Errorf("cannot convert %T to %s", value, t.name)
+	}
+
+	if t.name == "media" {
+		invalidIds, err := ValidateMediaIds(ctx, fc.Builder, ids)
+		if err != nil {
+			return nil, err
+		}
+		if len(invalidIds) > 0 {
+			return nil, fmt.Errorf("unknown media IDs %v", invalidIds)
+		}
+	} else {
+		target := referenceOption(field)
+		if target == "" {
+			return nil, fmt.Errorf("reference field names no content type")
+		}
+		invalidIds, err := ValidateReferenceIds(ctx, fc.Builder, target, ids)
+		if err != nil {
+			return nil, err
+		}
+		if len(invalidIds) > 0 {
+			return nil, fmt.Errorf("unknown %s entry IDs %v", target, invalidIds)
+		}
+	}
+
+	if slices.Contains(field.Options, "multiple") {
+		multiple := make([]any, len(ids))
+		for i, id := range ids {
+			multiple[i] = id
+		}
+		return multiple, nil
+	}
+	switch len(ids) {
+	case 0:
+		return "", nil
+	case 1:
+		return ids[0], nil
+	}
+	return nil, fmt.Errorf("%d IDs do not fit a single %s field", len(ids), t.name)
+}
+
+func (t idsFieldType) ReferenceTarget(field *models.ContentTypeField) string {
+	if t.name != "reference" {
+		return ""
+	}
+	return referenceOption(field)
+}
+
+// referenceOption returns the slug a reference field names in its options,
+// which is the first of them other than "multiple"
+func referenceOption(field *models.ContentTypeField) string {
+	for _, option := range field.Options {
+		if option != "multiple" {
+			return option
+		}
+	}
+	return ""
+}
+
+func (t idsFieldType) Describe() FieldTypeDescription {
+	if t.name == "media" {
+		return FieldTypeDescription{Name: "media", Description: "Media file, or several with the multiple option"}
+	}
+	return FieldTypeDescription{Name: "reference", Description: "Entry of another content type, or several with the multiple option"}
+}
+
+// dateFieldType stores ISO 8601 dates and UTC date-times
+type dateFieldType struct {
+	BaseFieldType
+	name string
+}
+
+func (t dateFieldType) normalize(value string) (string, error) {
+	if t.name == "date" {
+		return NormalizeDate(value)
+	}
+	return NormalizeDateTime(value)
+}
+
+func (t dateFieldType) Validate(ctx context.Context, fc FieldContext, field *models.ContentTypeField, path string, value any) ([]models.FieldError, error) {
+	strVal, ok := value.(string)
+	if !ok {
+		return invalidField(path, "Field %s should be a string", path), nil
+	}
+	// A blank input is an optional date left unset
+	if strVal == "" {
+		return nil, nil
+	}
+	if _, err := t.normalize(strVal); err != nil {
+		return invalidField(path, "Field %s: %v", path, err), nil
+	}
+	return nil, nil
+}
+
+func (t dateFieldType) Normalize(field *models.ContentTypeField, value any) any {
+	if value == "" {
+		return nil
+	}
+	if normalized, err := t.normalize(value.(string)); err == nil {
+		return normalized
+	}
+	return value
+}
+
+func (t dateFieldType) Convert(ctx context.Context, fc FieldContext, field *models.ContentTypeField, value any) (any, error) {
+	text, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("cannot convert %T to %s", value, t.name)
+	}
+	return t.normalize(strings.TrimSpace(text))
+}
+
+func (t dateFieldType) Describe() FieldTypeDescription {
+	if t.name == "date" {
+		return FieldTypeDescription{Name: "date", Description: "Calendar date, stored as YYYY-MM-DD", Sortable: true, Unique: true}
+	}
+	return FieldTypeDescription{Name: "datetime", Description: "Date and time with its offset, stored in UTC as YYYY-MM-DDTHH:MM:SSZ; without an offset it is taken to be UTC", Sortable: true, Unique: true}
+}
+
+// groupFieldType stores an object described by the field's sub-fields or,
+// for repeater fields, an array of them
+type groupFieldType struct {
+	BaseFieldType
+	name string
+}
+
+func (t groupFieldType) Validate(ctx context.Context, fc FieldContext, field *models.ContentTypeField, path string, value any) ([]models.FieldError, error) {
+	// Older editors sent a blank string for groups left unset
+	if value == "" {
+		return nil, nil
+	}
+	if t.name == "group" {
+		group, ok := value.(map[string]any)
+		if !ok {
+			return invalidField(path, "Field %s should be an object", path), nil
+		}
+		return ValidateFieldValues(ctx, fc, group, field.Fields, path+".")
+	}
+
+	items, ok := value.([]any)
+	if !ok {
+		return invalidField(path, "Field %s should be an array of objects", path), nil
+	}
+	if len(items) < field.MinItems {
+		return invalidField(path, "Field %s has too few items (minimum %d)", path, field.MinItems), nil
+	}
+	if field.MaxItems > 0 && len(items) > field.MaxItems {
+		return invalidField(path, "Field %s has too many items (maximum %d)", path, field.MaxItems), nil
+	}
+
+	fieldErrors := []models.FieldError{}
+	for i, item := range items {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		group, ok := item.(map[string]any)
+		if !ok {
+			fieldErrors = append(fieldErrors, invalidField(itemPath, "Field %s should be an object", itemPath)...)
+			continue
+		}
+		itemErrors, err := ValidateFieldValues(ctx, fc, group, field.Fields, itemPath+".")
+		if err != nil {
+			return nil, err
+		}
+		fieldErrors = append(fieldErrors, itemErrors...)
+	}
+	return fieldErrors, nil
+}
+
+func (t groupFieldType) Normalize(field *models.ContentTypeField, value any) any {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+func (t groupFieldType) ValidateDefinition(field *models.ContentTypeField, path string) []models.FieldError {
+	problems := []models.FieldError{}
+	problem := func(format string, args ...any) {
+		problems = append(problems, invalidField(path, format, args...)...)
+	}
+
+	if len(field.Fields) == 0 {
+		problem("Field %s needs at least one sub-field", field.FieldName)
+	}
+	if field.MinItems < 0 || field.MaxItems < 0 {
+		problem("Item counts of field %s cannot be negative", field.FieldName)
+	}
+	if field.MaxItems > 0 && field.MinItems > field.MaxItems {
+		problem("MinItems of field %s is larger than its MaxItems", field.FieldName)
+	}
+	// Uniqueness is only tracked across entries, not inside them
+	for _, sub := range field.Fields {
+		if sub.Unique {
+			problem("Field %s inside %s cannot be unique", sub.FieldName, field.FieldName)
+		}
+	}
+	return append(problems, ValidateFieldDefinitions(field.Fields, path+".")...)
+}
+
+func (t groupFieldType) SubValues(value any) []SubFieldValues {
+	if t.name == "group" {
+		if group, ok := value.(map[string]any); ok {
+			return []SubFieldValues{{Values: group}}
+		}
+		return nil
+	}
+
+	var subValues []SubFieldValues
+	items, _ := value.([]any)
+	for i, item := range items {
+		if group, ok := item.(map[string]any); ok {
+			subValues = append(subValues, SubFieldValues{Suffix: fmt.Sprintf("[%d]", i), Values: group})
+		}
+	}
+	return subValues
+}
+
+func (t groupFieldType) SupportedRules() FieldRules {
+	return FieldRules{Items: t.name == "repeater"}
+}
+
+func (t groupFieldType) Describe() FieldTypeDescription {
+	if t.name == "group" {
+		return FieldTypeDescription{Name: "group", Description: "Object made of the field's sub-fields"}
+	}
+	return FieldTypeDescription{Name: "repeater", Description: "List of objects made of the field's sub-fields"}
+}
+
+// jsonFieldType stores any JSON value, checked against the field's schema
+type jsonFieldType struct {
+	BaseFieldType
+}
+
+func (jsonFieldType) Validate(ctx context.Context, fc FieldContext, field *models.ContentTypeField, path string, value any) ([]models.FieldError, error) {
+	if field.Schema == nil {
+		return nil, nil
+	}
+	schema, err := CompileJSONSchema(field.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema of field %s: %w", path, err)
+	}
+
+	fieldErrors := []models.FieldError{}
+	for _, schemaErr := range schema.Validate(value) {
+		fieldErrors = append(fieldErrors, models.FieldError{
+			Field:   path,
+			Pointer: schemaErr.Pointer,
+			Message: fmt.Sprintf("Field %s%s %s", path, schemaErr.Pointer, schemaErr.Message),
+		})
+	}
+	return fieldErrors, nil
+}
+
+func (jsonFieldType) ValidateDefinition(field *models.ContentTypeField, path string) []models.FieldError {
+	if field.Schema == nil {
+		return nil
+	}
+	if _, err := CompileJSONSchema(field.Schema); err != nil {
+		return invalidField(path, "Field %s has an invalid schema: %v", field.FieldName, err)
+	}
+	return nil
+}
+
+func (jsonFieldType) Describe() FieldTypeDescription {
+	return FieldTypeDescription{Name: "json", Description: "Any JSON value, checked against the field's JSON Schema"}
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache is a size-bounded least-recently-used cache. Every entry carries a
+// size (in bytes, or 1 for small values) and the least recently used entries
+// are evicted once the total exceeds maxSize.
+type lruCache struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	order   *list.List
+	items   map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value any
+	size  int
+}
+
+func newLRUCache(maxSize int) *lruCache {
+	return &lruCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		items:   map[string]*list.Element{},
+	}
+}
+
+func (c *lruCache) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+func (c *lruCache) Add(key string, value any, size int) {
+	if size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		c.size += size - entry.size
+		entry.value, entry.size = value, size
+		c.order.MoveToFront(elem)
+	} else {
+		c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value, size: size})
+		c.size += size
+	}
+
+	for c.size > c.maxSize {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		c.order.Remove(oldest)
+		delete(c.items, entry.key)
+		c.size -= entry.size
+	}
+}
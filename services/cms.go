@@ -1,14 +1,20 @@
 package services
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"slices"
+	"strings"
 
 	"github.com/vachanmn123/vachancms/models"
 )
 
-func GetRepoConfig(access_token, owner, repo string) (*models.ConfigFile, error) {
-	configContent, err := GetFileContents(access_token, owner, repo, "config/config.json")
+func GetRepoConfig(ctx context.Context, access_token, owner, repo string) (*models.ConfigFile, error) {
+	configContent, err := GetFileContents(ctx, access_token, owner, repo, "config/config.json")
 	if err != nil {
 		return nil, err
 	}
@@ -22,14 +28,42 @@ func GetRepoConfig(access_token, owner, repo string) (*models.ConfigFile, error)
 	return &configFile, nil
 }
 
-// ValidateMediaIds checks if the given media IDs exist in the repo's media config.
+// LoadRepoConfig reads config/config.json through a commit builder, so a
+// change to it made concurrently stops the commit from landing
+func LoadRepoConfig(ctx context.Context, b *CommitBuilder) (*models.ConfigFile, error) {
+	configContent, err := b.GetFileContents(ctx, "config/config.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var configFile models.ConfigFile
+	if err := json.Unmarshal([]byte(configContent), &configFile); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	return &configFile, nil
+}
+
+// SaveRepoConfig stages config/config.json for the commit
+func SaveRepoConfig(b *CommitBuilder, configFile *models.ConfigFile) error {
+	configJson, err := json.Marshal(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	b.WriteFile("config/config.json", string(configJson))
+	return nil
+}
+
+// ValidateMediaIds checks if the given media IDs exist in the repo's media
+// config, read through the commit the IDs are saved in.
 // Returns a list of invalid IDs (empty slice if all valid).
-func ValidateMediaIds(access_token, owner, repo string, mediaIds []string) ([]string, error) {
+func ValidateMediaIds(ctx context.Context, b *CommitBuilder, mediaIds []string) ([]string, error) {
 	if len(mediaIds) == 0 {
 		return []string{}, nil
 	}
 
-	configContent, err := GetFileContents(access_token, owner, repo, "media/config.json")
+	configContent, err := b.GetFileContents(ctx, "media/config.json")
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch media config: %w", err)
 	}
@@ -50,16 +84,8 @@ func ValidateMediaIds(access_token, owner, repo string, mediaIds []string) ([]st
 }
 
 // GetContentValueConfig fetches and parses the content value config for a content type
-func GetContentValueConfig(accessToken, owner, repo, ctSlug string, branch ...string) (*models.ContentValueConfigFile, error) {
-	var configContent string
-	var err error
-
-	if len(branch) > 0 && branch[0] != "" {
-		configContent, err = GetFileContents(accessToken, owner, repo, fmt.Sprintf("data/%s/config.json", ctSlug), branch[0])
-	} else {
-		configContent, err = GetFileContents(accessToken, owner, repo, fmt.Sprintf("data/%s/config.json", ctSlug))
-	}
-
+func GetContentValueConfig(ctx context.Context, b *CommitBuilder, ctSlug string) (*models.ContentValueConfigFile, error) {
+	configContent, err := b.GetFileContents(ctx, fmt.Sprintf("data/%s/config.json", ctSlug))
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch content value config: %w", err)
 	}
@@ -84,16 +110,8 @@ func GetContentValueConfig(accessToken, owner, repo, ctSlug string, branch ...st
 }
 
 // GetContentValue fetches a single content value by ID
-func GetContentValue(accessToken, owner, repo, ctSlug, id string, branch ...string) (*models.ContentValue, error) {
-	var content string
-	var err error
-
-	if len(branch) > 0 && branch[0] != "" {
-		content, err = GetFileContents(accessToken, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, id), branch[0])
-	} else {
-		content, err = GetFileContents(accessToken, owner, repo, fmt.Sprintf("data/%s/%s.json", ctSlug, id))
-	}
-
+func GetContentValue(ctx context.Context, b *CommitBuilder, ctSlug, id string) (*models.ContentValue, error) {
+	content, err := b.GetFileContents(ctx, fmt.Sprintf("data/%s/%s.json", ctSlug, id))
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch content value: %w", err)
 	}
@@ -110,7 +128,7 @@ func GetContentValue(accessToken, owner, repo, ctSlug, id string, branch ...stri
 // This is the source of truth for content ordering.
 // It updates the Items map, TotalItems, TotalPages, and regenerates all index-*.json files.
 // It also deletes any extra index files that are no longer needed.
-func RegenerateIndexes(accessToken, owner, repo, ctSlug, branch string, config *models.ContentValueConfigFile) error {
+func RegenerateIndexes(ctx context.Context, b *CommitBuilder, ctSlug string, config *models.ContentValueConfigFile) error {
 	if config.ItemsPerPage <= 0 {
 		config.ItemsPerPage = 10 // Default
 	}
@@ -129,6 +147,11 @@ func RegenerateIndexes(accessToken, owner, repo, ctSlug, branch string, config *
 
 	// Generate index files page by page
 	for page := 1; page <= totalPages; page++ {
+		// Each page reads every item on it, so stop as soon as the caller is gone
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		startIdx := (page - 1) * config.ItemsPerPage
 		endIdx := startIdx + config.ItemsPerPage
 		if endIdx > totalItems {
@@ -142,7 +165,7 @@ func RegenerateIndexes(accessToken, owner, repo, ctSlug, branch string, config *
 			config.Items[id] = page
 
 			// Fetch the content value
-			value, err := GetContentValue(accessToken, owner, repo, ctSlug, id, branch)
+			value, err := GetContentValue(ctx, b, ctSlug, id)
 			if err != nil {
 				// If item doesn't exist, skip it (it may have been deleted)
 				continue
@@ -160,24 +183,13 @@ func RegenerateIndexes(accessToken, owner, repo, ctSlug, branch string, config *
 			return fmt.Errorf("failed to marshal index file for page %d: %w", page, err)
 		}
 
-		err = CreateOrUpdateFile(accessToken, owner, repo,
-			fmt.Sprintf("data/%s/index-%d.json", ctSlug, page),
-			fmt.Sprintf("Regenerate index page %d for %s", page, ctSlug),
-			string(indexJson), branch)
-		if err != nil {
-			return fmt.Errorf("failed to update index file for page %d: %w", page, err)
-		}
+		b.WriteFile(fmt.Sprintf("data/%s/index-%d.json", ctSlug, page), string(indexJson))
 	}
 
 	// Delete extra index files if pages decreased
 	for page := totalPages + 1; page <= oldTotalPages; page++ {
-		err := DeleteFile(accessToken, owner, repo,
-			fmt.Sprintf("data/%s/index-%d.json", ctSlug, page),
-			fmt.Sprintf("Remove extra index page %d for %s", page, ctSlug),
-			branch)
-		if err != nil {
-			// Log but don't fail - file might not exist
-			continue
+		if err := b.DeleteFile(ctx, fmt.Sprintf("data/%s/index-%d.json", ctSlug, page)); err != nil {
+			return fmt.Errorf("failed to remove index file for page %d: %w", page, err)
 		}
 	}
 
@@ -191,7 +203,7 @@ func RegenerateIndexes(accessToken, owner, repo, ctSlug, branch string, config *
 // RegenerateIndexesFromPage regenerates index files starting from a specific page.
 // This is more efficient when you know which page was affected.
 // Use this when an item is added/removed/moved and you know the affected page.
-func RegenerateIndexesFromPage(accessToken, owner, repo, ctSlug, branch string, config *models.ContentValueConfigFile, fromPage int) error {
+func RegenerateIndexesFromPage(ctx context.Context, b *CommitBuilder, ctSlug string, config *models.ContentValueConfigFile, fromPage int) error {
 	if config.ItemsPerPage <= 0 {
 		config.ItemsPerPage = 10
 	}
@@ -206,6 +218,11 @@ func RegenerateIndexesFromPage(accessToken, owner, repo, ctSlug, branch string,
 
 	// Regenerate from fromPage to totalPages
 	for page := fromPage; page <= totalPages; page++ {
+		// Each page reads every item on it, so stop as soon as the caller is gone
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		startIdx := (page - 1) * config.ItemsPerPage
 		endIdx := startIdx + config.ItemsPerPage
 		if endIdx > totalItems {
@@ -218,7 +235,7 @@ func RegenerateIndexesFromPage(accessToken, owner, repo, ctSlug, branch string,
 			id := config.Order[i]
 			config.Items[id] = page
 
-			value, err := GetContentValue(accessToken, owner, repo, ctSlug, id, branch)
+			value, err := GetContentValue(ctx, b, ctSlug, id)
 			if err != nil {
 				continue
 			}
@@ -235,23 +252,13 @@ func RegenerateIndexesFromPage(accessToken, owner, repo, ctSlug, branch string,
 			return fmt.Errorf("failed to marshal index file for page %d: %w", page, err)
 		}
 
-		err = CreateOrUpdateFile(accessToken, owner, repo,
-			fmt.Sprintf("data/%s/index-%d.json", ctSlug, page),
-			fmt.Sprintf("Regenerate index page %d for %s", page, ctSlug),
-			string(indexJson), branch)
-		if err != nil {
-			return fmt.Errorf("failed to update index file for page %d: %w", page, err)
-		}
+		b.WriteFile(fmt.Sprintf("data/%s/index-%d.json", ctSlug, page), string(indexJson))
 	}
 
 	// Delete extra index files
 	for page := totalPages + 1; page <= oldTotalPages; page++ {
-		err := DeleteFile(accessToken, owner, repo,
-			fmt.Sprintf("data/%s/index-%d.json", ctSlug, page),
-			fmt.Sprintf("Remove extra index page %d for %s", page, ctSlug),
-			branch)
-		if err != nil {
-			continue
+		if err := b.DeleteFile(ctx, fmt.Sprintf("data/%s/index-%d.json", ctSlug, page)); err != nil {
+			return fmt.Errorf("failed to remove index file for page %d: %w", page, err)
 		}
 	}
 
@@ -273,27 +280,20 @@ func RegenerateIndexesFromPage(accessToken, owner, repo, ctSlug, branch string,
 	return nil
 }
 
-// SaveContentValueConfig saves the content value config to the repo
-func SaveContentValueConfig(accessToken, owner, repo, ctSlug, branch string, config *models.ContentValueConfigFile) error {
+// SaveContentValueConfig stages the content value config for the commit
+func SaveContentValueConfig(b *CommitBuilder, ctSlug string, config *models.ContentValueConfigFile) error {
 	configJson, err := json.Marshal(config)
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
 
-	err = CreateOrUpdateFile(accessToken, owner, repo,
-		fmt.Sprintf("data/%s/config.json", ctSlug),
-		fmt.Sprintf("Update config for %s", ctSlug),
-		string(configJson), branch)
-	if err != nil {
-		return fmt.Errorf("failed to save config: %w", err)
-	}
-
+	b.WriteFile(fmt.Sprintf("data/%s/config.json", ctSlug), string(configJson))
 	return nil
 }
 
 // MigrateConfigToOrder migrates an existing config that doesn't have Order
 // by building the Order array from existing index files
-func MigrateConfigToOrder(accessToken, owner, repo, ctSlug, branch string, config *models.ContentValueConfigFile) error {
+func MigrateConfigToOrder(ctx context.Context, b *CommitBuilder, ctSlug string, config *models.ContentValueConfigFile) error {
 	if len(config.Order) > 0 {
 		// Already has order, no migration needed
 		return nil
@@ -303,8 +303,7 @@ func MigrateConfigToOrder(accessToken, owner, repo, ctSlug, branch string, confi
 	order := []string{}
 
 	for page := 1; page <= config.TotalPages; page++ {
-		indexContent, err := GetFileContents(accessToken, owner, repo,
-			fmt.Sprintf("data/%s/index-%d.json", ctSlug, page), branch)
+		indexContent, err := b.GetFileContents(ctx, fmt.Sprintf("data/%s/index-%d.json", ctSlug, page))
 		if err != nil {
 			continue
 		}
@@ -323,6 +322,17 @@ func MigrateConfigToOrder(accessToken, owner, repo, ctSlug, branch string, confi
 	return nil
 }
 
+// reservedSlugs are the paths routes.SetupRoutes serves next to the content
+// types under /:owner/:repo, which a content type of the same slug would be
+// shadowed by
+var reservedSlugs = []string{"admin", "config", "content-types", "init", "media", "pages"}
+
+// IsReservedSlug reports whether slug is taken by a route of the API and so
+// cannot be used by a content type
+func IsReservedSlug(slug string) bool {
+	return slices.Contains(reservedSlugs, slug)
+}
+
 // GetContentTypeFromConfig finds a content type by slug from the repo config
 func GetContentTypeFromConfig(configFile *models.ConfigFile, ctSlug string) *models.ContentType {
 	for _, ct := range configFile.ContentTypes {
@@ -332,3 +342,280 @@ func GetContentTypeFromConfig(configFile *models.ConfigFile, ctSlug string) *mod
 	}
 	return nil
 }
+
+// ReferenceTarget returns the slug of the content type a field's values
+// point at, or "" if its type does not reference entries
+func ReferenceTarget(field models.ContentTypeField) string {
+	fieldType, _ := LookupFieldType(field.FieldType)
+	if referrer, ok := fieldType.(EntryReferrer); ok {
+		return referrer.ReferenceTarget(&field)
+	}
+	return ""
+}
+
+// ContentTypeReferrers returns the names of the other content types with a
+// reference field pointing at ctSlug.
+func ContentTypeReferrers(configFile *models.ConfigFile, ctSlug string) []string {
+	referrers := []string{}
+	for _, ct := range configFile.ContentTypes {
+		if ct.Slug == ctSlug {
+			continue
+		}
+		if referencesContentType(ct.Fields, ctSlug) {
+			referrers = append(referrers, ct.Name)
+		}
+	}
+	return referrers
+}
+
+// referencesContentType reports whether any of fields, including the
+// sub-fields of group and repeater fields, is a reference to ctSlug
+func referencesContentType(fields []models.ContentTypeField, ctSlug string) bool {
+	for _, field := range fields {
+		if ReferenceTarget(field) == ctSlug {
+			return true
+		}
+		if referencesContentType(field.Fields, ctSlug) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateReferenceTargets checks that reference fields, at any depth, point
+// at an existing content type or at ctSlug, the one being defined. Problems
+// are located like those of ValidateFieldDefinitions.
+func ValidateReferenceTargets(fields []models.ContentTypeField, prefix, ctSlug string, configFile *models.ConfigFile) []models.FieldError {
+	problems := []models.FieldError{}
+	for i, field := range fields {
+		path := fmt.Sprintf("%sfields[%d]", prefix, i)
+		if target := ReferenceTarget(field); target != "" {
+			if target != ctSlug && GetContentTypeFromConfig(configFile, target) == nil {
+				problems = append(problems, models.FieldError{
+					Field:   path,
+					Message: fmt.Sprintf("Field %s references unknown content type %s", field.FieldName, target),
+				})
+			}
+		}
+		problems = append(problems, ValidateReferenceTargets(field.Fields, path+".", ctSlug, configFile)...)
+	}
+	return problems
+}
+
+// ValidateReferenceIds checks if the given IDs are entries of the ctSlug
+// content type. Returns a list of invalid IDs (empty slice if all valid). A
+// content type that does not exist has no entries, so every ID is invalid.
+// The entries are looked up through the commit the references are saved in,
+// so deleting one of them meanwhile stops that commit from landing.
+func ValidateReferenceIds(ctx context.Context, b *CommitBuilder, ctSlug string, ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return []string{}, nil
+	}
+
+	configContent, err := b.GetFileContents(ctx, fmt.Sprintf("data/%s/config.json", ctSlug))
+	if err != nil {
+		var notFound *FileNotFoundError
+		if errors.As(err, &notFound) {
+			return ids, nil
+		}
+		return nil, fmt.Errorf("failed to fetch content value config: %w", err)
+	}
+
+	var config models.ContentValueConfigFile
+	if err := json.Unmarshal([]byte(configContent), &config); err != nil {
+		return nil, fmt.Errorf("failed to parse content value config: %w", err)
+	}
+
+	var invalidIds []string
+	for _, id := range ids {
+		if _, exists := config.Items[id]; !exists {
+			invalidIds = append(invalidIds, id)
+		}
+	}
+
+	return invalidIds, nil
+}
+
+// ValueReference is an entry whose reference field points at another entry.
+// Field is the path of the reference field, e.g. faq[1].related inside a
+// repeater.
+type ValueReference struct {
+	ContentType string `json:"content_type"`
+	Id          string `json:"id"`
+	Field       string `json:"field"`
+}
+
+// FindValueReferences lists the entries that reference entry id of ctSlug.
+// It reads the index files of every content type with a reference field
+// pointing at ctSlug, ctSlug itself included, at any depth.
+func FindValueReferences(ctx context.Context, b *CommitBuilder, configFile *models.ConfigFile, ctSlug, id string) ([]ValueReference, error) {
+	references := []ValueReference{}
+	for _, ct := range configFile.ContentTypes {
+		if !referencesContentType(ct.Fields, ctSlug) {
+			continue
+		}
+
+		config, err := GetContentValueConfig(ctx, b, ct.Slug)
+		if err != nil {
+			return nil, err
+		}
+		for page := 1; page <= config.TotalPages; page++ {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			indexContent, err := b.GetFileContents(ctx, fmt.Sprintf("data/%s/index-%d.json", ct.Slug, page))
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch index file for page %d of %s: %w", page, ct.Slug, err)
+			}
+			var indexFile models.ContentValueIndexFile
+			if err := json.Unmarshal([]byte(indexContent), &indexFile); err != nil {
+				return nil, fmt.Errorf("failed to parse index file for page %d of %s: %w", page, ct.Slug, err)
+			}
+
+			for _, item := range indexFile.Items {
+				if ct.Slug == ctSlug && item.Id == id {
+					continue
+				}
+				for _, path := range referencePaths(ct.Fields, item.Value, ctSlug, id, "") {
+					references = append(references, ValueReference{ContentType: ct.Slug, Id: item.Id, Field: path})
+				}
+			}
+		}
+	}
+	return references, nil
+}
+
+// referencePaths returns the paths of the reference fields to ctSlug in
+// values that hold id, walking into the sub-fields of groups and repeaters
+func referencePaths(fields []models.ContentTypeField, values map[string]any, ctSlug, id, prefix string) []string {
+	var paths []string
+	for i := range fields {
+		field := &fields[i]
+		path := prefix + field.FieldName
+		if ReferenceTarget(*field) == ctSlug && slices.Contains(ReferenceIds(values[field.FieldName]), id) {
+			paths = append(paths, path)
+		}
+		for _, sub := range subValues(field, values[field.FieldName]) {
+			paths = append(paths, referencePaths(field.Fields, sub.Values, ctSlug, id, path+sub.Suffix+".")...)
+		}
+	}
+	return paths
+}
+
+// FindUniqueConflicts returns the unique fields of contentType whose value in
+// value is already taken by another entry. Empty values never conflict.
+func FindUniqueConflicts(ctx context.Context, b *CommitBuilder, ctSlug string, config *models.ContentValueConfigFile, contentType *models.ContentType, value *models.ContentValue) ([]string, error) {
+	var fields []string
+	for _, field := range contentType.Fields {
+		if field.Unique {
+			if v, ok := value.Value[field.FieldName]; ok && v != nil && v != "" {
+				fields = append(fields, field.FieldName)
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	var taken []string
+	for page := 1; page <= config.TotalPages && len(fields) > 0; page++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		indexContent, err := b.GetFileContents(ctx, fmt.Sprintf("data/%s/index-%d.json", ctSlug, page))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch index file for page %d: %w", page, err)
+		}
+		var indexFile models.ContentValueIndexFile
+		if err := json.Unmarshal([]byte(indexContent), &indexFile); err != nil {
+			return nil, fmt.Errorf("failed to parse index file for page %d: %w", page, err)
+		}
+
+		for _, item := range indexFile.Items {
+			if item.Id == value.Id {
+				continue
+			}
+			// Each field is reported once, however many entries share the value
+			fields = slices.DeleteFunc(fields, func(field string) bool {
+				if reflect.DeepEqual(item.Value[field], value.Value[field]) {
+					taken = append(taken, field)
+					return true
+				}
+				return false
+			})
+		}
+	}
+	slices.Sort(taken)
+	return taken, nil
+}
+
+// ReferenceIds returns the entry IDs stored in a reference field, which holds
+// either a single ID or an array of them. Anything else yields no IDs.
+func ReferenceIds(value any) []string {
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []any:
+		ids := make([]string, 0, len(v))
+		for _, item := range v {
+			if id, ok := item.(string); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	return nil
+}
+
+// SortContentValues orders config.Order by the content type's SortBy field.
+// Entries without a value go last either way, and entries with equal values
+// keep their previous order.
+func SortContentValues(ctx context.Context, b *CommitBuilder, ctSlug string, config *models.ContentValueConfigFile, contentType *models.ContentType) error {
+	if contentType.SortBy == "" {
+		return nil
+	}
+
+	keys := make(map[string]any, len(config.Order))
+	for _, id := range config.Order {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		value, err := GetContentValue(ctx, b, ctSlug, id)
+		if err != nil {
+			continue
+		}
+		keys[id] = value.Value[contentType.SortBy]
+	}
+
+	descending := contentType.SortDirection == "desc"
+	slices.SortStableFunc(config.Order, func(x, y string) int {
+		ka, kb := keys[x], keys[y]
+		switch {
+		case ka == nil && kb == nil:
+			return 0
+		case ka == nil:
+			return 1
+		case kb == nil:
+			return -1
+		}
+		result := compareSortKeys(ka, kb)
+		if descending {
+			return -result
+		}
+		return result
+	})
+	return nil
+}
+
+// compareSortKeys compares two field values. Dates and datetimes are stored
+// in sortable layouts, so they compare as strings like text does.
+func compareSortKeys(a, b any) int {
+	if na, ok := a.(float64); ok {
+		if nb, ok := b.(float64); ok {
+			return cmp.Compare(na, nb)
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
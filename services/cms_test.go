@@ -0,0 +1,87 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vachanmn123/vachancms/models"
+)
+
+func TestIsReservedSlug(t *testing.T) {
+	tests := []struct {
+		slug string
+		want bool
+	}{
+		{"media", true},
+		{"content-types", true},
+		{"config", true},
+		{"init", true},
+		{"pages", true},
+		{"admin", true},
+		{"blog-posts", false},
+		{"medias", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsReservedSlug(tt.slug); got != tt.want {
+			t.Errorf("IsReservedSlug(%q) = %v, want %v", tt.slug, got, tt.want)
+		}
+	}
+}
+
+func TestValidateReferenceTargets(t *testing.T) {
+	configFile := &models.ConfigFile{ContentTypes: []models.ContentType{{Slug: "authors"}}}
+	fields := []models.ContentTypeField{
+		{FieldName: "author", FieldType: "reference", Options: []string{"authors"}},
+		{FieldName: "parent", FieldType: "reference", Options: []string{"multiple", "posts"}},
+		{FieldName: "editor", FieldType: "reference", Options: []string{"editors"}},
+		{FieldName: "credits", FieldType: "repeater", Fields: []models.ContentTypeField{
+			{FieldName: "title", FieldType: "text", Options: []string{"unrelated"}},
+			{FieldName: "who", FieldType: "reference", Options: []string{"people"}},
+		}},
+	}
+
+	want := []models.FieldError{
+		{Field: "fields[2]", Message: "Field editor references unknown content type editors"},
+		{Field: "fields[3].fields[1]", Message: "Field who references unknown content type people"},
+	}
+	// The content type being defined may reference itself
+	if got := ValidateReferenceTargets(fields, "", "posts", configFile); !reflect.DeepEqual(got, want) {
+		t.Errorf("ValidateReferenceTargets = %v, want %v", got, want)
+	}
+}
+
+func TestContentTypeReferrers(t *testing.T) {
+	configFile := &models.ConfigFile{ContentTypes: []models.ContentType{
+		{Name: "Authors", Slug: "authors", Fields: []models.ContentTypeField{
+			{FieldName: "mentor", FieldType: "reference", Options: []string{"authors"}},
+		}},
+		{Name: "Posts", Slug: "posts", Fields: []models.ContentTypeField{
+			{FieldName: "author", FieldType: "reference", Options: []string{"multiple", "authors"}},
+		}},
+		{Name: "Pages", Slug: "pages", Fields: []models.ContentTypeField{
+			{FieldName: "credits", FieldType: "repeater", Fields: []models.ContentTypeField{
+				{FieldName: "who", FieldType: "reference", Options: []string{"authors"}},
+			}},
+		}},
+		{Name: "Tags", Slug: "tags", Fields: []models.ContentTypeField{
+			{FieldName: "kind", FieldType: "select", Options: []string{"authors"}},
+		}},
+	}}
+
+	tests := []struct {
+		slug string
+		want []string
+	}{
+		// References from a content type to itself do not count
+		{slug: "authors", want: []string{"Posts", "Pages"}},
+		{slug: "posts", want: []string{}},
+		{slug: "tags", want: []string{}},
+	}
+	for _, tt := range tests {
+		if got := ContentTypeReferrers(configFile, tt.slug); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ContentTypeReferrers(%s) = %v, want %v", tt.slug, got, tt.want)
+		}
+	}
+}
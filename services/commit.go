@@ -0,0 +1,282 @@
+package services
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// FileChange is a single staged write or delete within a commit. Large files
+// are staged with Body instead of Content so backends can stream them; Body is
+// rewound before every attempt to land the commit.
+type FileChange struct {
+	Path    string
+	Content []byte
+	Body    io.ReadSeeker
+	Delete  bool
+}
+
+// BranchMovedError is returned when a commit cannot be landed because the
+// branch no longer points at the commit the changes were built on.
+type BranchMovedError struct {
+	Branch string
+}
+
+func (e *BranchMovedError) Error() string {
+	return fmt.Sprintf("branch %s has moved since the changes were staged", e.Branch)
+}
+
+// BlobSHA returns the git blob SHA of content, which is what every backend
+// reports as the file's SHA. It changes whenever the file's content changes.
+func BlobSHA(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// CommitBuilder stages every file write and delete of one logical CMS
+// operation and lands them as a single commit on the content branch.
+//
+// Reads made through the builder see the repository as of the commit the
+// builder was started from, with the staged changes applied on top, so a
+// workflow can read back what it has written before anything is committed.
+// Paths are relative to the CMS root, which is the repository's configured
+// base path.
+type CommitBuilder struct {
+	storage  Storage
+	user     string
+	repo     string
+	branch   string
+	basePath string
+	base     string
+	changes  map[string]*FileChange
+	// exists records every path read from the base commit and whether it was
+	// there; it doubles as the read set checked when rebasing.
+	exists map[string]bool
+	// dirs are the directories deleted as a whole, each with a trailing slash.
+	// Any change below them while rebasing means the delete is incomplete.
+	dirs []string
+}
+
+// maxRebaseAttempts bounds how often a commit is moved onto a newer head
+// before giving up with a *BranchMovedError.
+const maxRebaseAttempts = 3
+
+// NewCommitBuilder starts a commit on top of the current head of the branch
+// (the repository's content branch if omitted).
+func NewCommitBuilder(ctx context.Context, token, user, repo string, branch ...string) (*CommitBuilder, error) {
+	branch, basePath, err := contentLocation(ctx, token, user, repo, branch)
+	if err != nil {
+		return nil, err
+	}
+	return newCommitBuilder(ctx, storageFor(token), user, repo, branchRef(branch), basePath)
+}
+
+func newCommitBuilder(ctx context.Context, storage Storage, user, repo, branch, basePath string) (*CommitBuilder, error) {
+	head, err := storage.GetHead(ctx, user, repo, branch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve branch head: %w", err)
+	}
+
+	return &CommitBuilder{
+		storage:  storage,
+		user:     user,
+		repo:     repo,
+		branch:   branch,
+		basePath: basePath,
+		base:     head,
+		changes:  map[string]*FileChange{},
+		exists:   map[string]bool{},
+	}, nil
+}
+
+// Base returns the commit SHA the staged changes are built on
+func (b *CommitBuilder) Base() string {
+	return b.base
+}
+
+// GetFileContents reads a file, taking staged changes into account
+func (b *CommitBuilder) GetFileContents(ctx context.Context, path string) (string, error) {
+	path = repoPath(b.basePath, path)
+	if change, ok := b.changes[path]; ok {
+		if change.Delete {
+			return "", &FileNotFoundError{}
+		}
+		if change.Body != nil {
+			return "", fmt.Errorf("%s is staged as a stream and cannot be read back", path)
+		}
+		return string(change.Content), nil
+	}
+
+	content, err := b.storage.GetFileContents(ctx, b.user, b.repo, path, b.base)
+	if err != nil {
+		var notFound *FileNotFoundError
+		if errors.As(err, &notFound) {
+			b.exists[path] = false
+		}
+		return "", err
+	}
+	b.exists[path] = true
+	return content, nil
+}
+
+// WriteFile stages a text file write
+func (b *CommitBuilder) WriteFile(path, content string) {
+	b.UploadFile(path, []byte(content))
+}
+
+// UploadFile stages a binary file write
+func (b *CommitBuilder) UploadFile(path string, content []byte) {
+	path = repoPath(b.basePath, path)
+	b.changes[path] = &FileChange{Path: path, Content: content}
+}
+
+// UploadStream stages a file write whose content is read from body when the
+// commit is landed, so large media never has to be held in memory.
+func (b *CommitBuilder) UploadStream(path string, body io.ReadSeeker) {
+	path = repoPath(b.basePath, path)
+	b.changes[path] = &FileChange{Path: path, Body: body}
+}
+
+// DeleteFile stages the removal of a file. Deleting a file that does not exist
+// in the base commit is a no-op, so callers do not need to check first.
+func (b *CommitBuilder) DeleteFile(ctx context.Context, path string) error {
+	path = repoPath(b.basePath, path)
+	existed, known := b.exists[path]
+	if !known {
+		_, err := b.storage.GetFileContents(ctx, b.user, b.repo, path, b.base)
+		if err != nil {
+			var notFound *FileNotFoundError
+			if !errors.As(err, &notFound) {
+				return err
+			}
+		}
+		existed = err == nil
+		b.exists[path] = existed
+	}
+
+	if existed {
+		b.changes[path] = &FileChange{Path: path, Delete: true}
+	} else {
+		delete(b.changes, path)
+	}
+	return nil
+}
+
+// DeleteDir stages the removal of every file below dir, including files
+// staged earlier by this builder.
+func (b *CommitBuilder) DeleteDir(ctx context.Context, dir string) error {
+	prefix := strings.TrimSuffix(repoPath(b.basePath, dir), "/") + "/"
+
+	paths, err := b.storage.ListFiles(ctx, b.user, b.repo, prefix, b.base)
+	if err != nil {
+		return err
+	}
+
+	for path := range b.changes {
+		if strings.HasPrefix(path, prefix) {
+			delete(b.changes, path)
+		}
+	}
+	for _, path := range paths {
+		b.exists[path] = true
+		b.changes[path] = &FileChange{Path: path, Delete: true}
+	}
+	b.dirs = append(b.dirs, prefix)
+	return nil
+}
+
+// HasChanges reports whether anything has been staged
+func (b *CommitBuilder) HasChanges() bool {
+	return len(b.changes) > 0
+}
+
+// Changes returns the staged changes sorted by path
+func (b *CommitBuilder) Changes() []FileChange {
+	changes := make([]FileChange, 0, len(b.changes))
+	for _, change := range b.changes {
+		changes = append(changes, *change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// Commit lands all staged changes as one commit. If the branch moved since
+// the builder was started, the changes are moved onto the new head as long as
+// none of the files this operation read or wrote were touched in between;
+// otherwise a *BranchMovedError is returned and nothing is written.
+// Committing with nothing staged is a no-op.
+func (b *CommitBuilder) Commit(ctx context.Context, message string) error {
+	if !b.HasChanges() {
+		return nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		// Stop retrying once the request that wanted the commit is gone
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		for _, change := range b.changes {
+			if change.Body != nil {
+				if _, err := change.Body.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+			}
+		}
+
+		head, err := b.storage.CommitChanges(ctx, b.user, b.repo, b.branch, b.base, message, b.Changes())
+		if err == nil {
+			b.base = head
+			b.changes = map[string]*FileChange{}
+			b.exists = map[string]bool{}
+			b.dirs = nil
+			return nil
+		}
+
+		var moved *BranchMovedError
+		if !errors.As(err, &moved) || attempt >= maxRebaseAttempts {
+			return err
+		}
+		if err := b.rebase(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// rebase moves the builder onto the branch's current head if the commits in
+// between did not change anything this operation depends on.
+func (b *CommitBuilder) rebase(ctx context.Context) error {
+	head, err := b.storage.GetHead(ctx, b.user, b.repo, b.branch)
+	if err != nil {
+		return err
+	}
+
+	changed, err := b.storage.ChangedFiles(ctx, b.user, b.repo, b.base, head)
+	if err != nil {
+		return err
+	}
+	for _, path := range changed {
+		_, read := b.exists[path]
+		_, written := b.changes[path]
+		if read || written {
+			return &BranchMovedError{Branch: b.branch}
+		}
+		for _, dir := range b.dirs {
+			if strings.HasPrefix(path, dir) {
+				return &BranchMovedError{Branch: b.branch}
+			}
+		}
+	}
+
+	b.base = head
+	return nil
+}
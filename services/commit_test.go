@@ -0,0 +1,232 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestBuilder(t *testing.T, s *MemoryStorage, basePath string) *CommitBuilder {
+	t.Helper()
+	b, err := newCommitBuilder(t.Context(), s, "o", "r", "", basePath)
+	if err != nil {
+		t.Fatalf("newCommitBuilder: %v", err)
+	}
+	return b
+}
+
+// pushFile commits a change to path the way another writer would
+func pushFile(t *testing.T, s *MemoryStorage, path, content string) {
+	t.Helper()
+	if err := s.CreateOrUpdateFile(t.Context(), "o", "r", path, "outside change", content); err != nil {
+		t.Fatalf("CreateOrUpdateFile: %v", err)
+	}
+}
+
+func TestCommitBuilderReadsStagedChanges(t *testing.T) {
+	ctx := t.Context()
+	s := newMemoryRepo(t, map[string]string{"cms/a": "1", "cms/b": "2"})
+	b := newTestBuilder(t, s, "cms")
+
+	b.WriteFile("a", "one")
+	if err := b.DeleteFile(ctx, "b"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if err := b.DeleteFile(ctx, "missing"); err != nil {
+		t.Fatalf("DeleteFile of missing file: %v", err)
+	}
+
+	if content, err := b.GetFileContents(ctx, "a"); err != nil || content != "one" {
+		t.Errorf("staged a = %q, %v; want %q", content, err, "one")
+	}
+	var notFound *FileNotFoundError
+	if _, err := b.GetFileContents(ctx, "b"); !errors.As(err, &notFound) {
+		t.Errorf("staged delete of b: got %v, want *FileNotFoundError", err)
+	}
+	paths := []string{}
+	for _, change := range b.Changes() {
+		paths = append(paths, change.Path)
+	}
+	if !slices.Equal(paths, []string{"cms/a", "cms/b"}) {
+		t.Errorf("changes = %v, want [cms/a cms/b]", paths)
+	}
+
+	// Nothing reaches the repository before the commit
+	if content, _ := s.GetFileContents(ctx, "o", "r", "cms/a"); content != "1" {
+		t.Errorf("cms/a = %q before commit, want %q", content, "1")
+	}
+}
+
+func TestCommitBuilderDeleteDir(t *testing.T) {
+	ctx := t.Context()
+	s := newMemoryRepo(t, map[string]string{
+		"cms/data/posts/1.json":     "1",
+		"cms/data/posts/sub/2.json": "2",
+		"cms/data/posts-old/3.json": "3",
+		"cms/config/config.json":    "{}",
+	})
+	b := newTestBuilder(t, s, "cms")
+
+	// Files staged below the directory go as well
+	b.WriteFile("data/posts/new.json", "new")
+	if err := b.DeleteDir(ctx, "data/posts/"); err != nil {
+		t.Fatalf("DeleteDir: %v", err)
+	}
+	if err := b.DeleteDir(ctx, "data/missing"); err != nil {
+		t.Fatalf("DeleteDir of missing directory: %v", err)
+	}
+	if err := b.Commit(ctx, "delete posts"); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	want := []string{"cms/config/config.json", "cms/data/posts-old/3.json"}
+	files := s.Files("o", "r")
+	slices.Sort(files)
+	if !slices.Equal(files, want) {
+		t.Errorf("files after DeleteDir = %v, want %v", files, want)
+	}
+}
+
+func TestCommitBuilderCommit(t *testing.T) {
+	ctx := t.Context()
+	s := newMemoryRepo(t, map[string]string{"a": "1", "b": "2"})
+	b := newTestBuilder(t, s, "")
+	base := b.Base()
+
+	b.WriteFile("a", "one")
+	b.UploadStream("c", strings.NewReader("three"))
+	if err := b.DeleteFile(ctx, "b"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if err := b.Commit(ctx, "change"); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if got := s.Files("o", "r"); !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("files = %v, want [a c]", got)
+	}
+	if content, _ := s.GetFileContents(ctx, "o", "r", "c"); content != "three" {
+		t.Errorf("streamed c = %q, want %q", content, "three")
+	}
+	// All changes land as a single commit on top of the base
+	changed, err := s.ChangedFiles(ctx, "o", "r", base, b.Base())
+	if err != nil {
+		t.Fatalf("ChangedFiles: %v", err)
+	}
+	if !slices.Equal(changed, []string{"a", "b", "c"}) {
+		t.Errorf("commit changed %v, want [a b c]", changed)
+	}
+	if b.HasChanges() {
+		t.Error("builder still has changes after commit")
+	}
+
+	head := b.Base()
+	if err := b.Commit(ctx, "nothing"); err != nil {
+		t.Fatalf("empty Commit: %v", err)
+	}
+	if current, _ := s.GetHead(ctx, "o", "r", ""); current != head {
+		t.Error("empty Commit created a commit")
+	}
+}
+
+func TestCommitBuilderRebasesOverUnrelatedChanges(t *testing.T) {
+	ctx := t.Context()
+	s := newMemoryRepo(t, map[string]string{"data/posts/config.json": "{}", "data/pages/config.json": "{}"})
+	b := newTestBuilder(t, s, "")
+
+	if _, err := b.GetFileContents(ctx, "data/posts/config.json"); err != nil {
+		t.Fatalf("GetFileContents: %v", err)
+	}
+	b.WriteFile("data/posts/config.json", `{"total_items":1}`)
+
+	// Another writer changes a different content type meanwhile
+	pushFile(t, s, "data/pages/config.json", `{"total_items":5}`)
+
+	if err := b.Commit(ctx, "add post"); err != nil {
+		t.Fatalf("Commit over unrelated change: %v", err)
+	}
+	for path, want := range map[string]string{
+		"data/posts/config.json": `{"total_items":1}`,
+		"data/pages/config.json": `{"total_items":5}`,
+	} {
+		if content, _ := s.GetFileContents(ctx, "o", "r", path); content != want {
+			t.Errorf("%s = %q, want %q", path, content, want)
+		}
+	}
+}
+
+func TestCommitBuilderRefusesConflictingChanges(t *testing.T) {
+	tests := []struct {
+		name string
+		// stage prepares the builder's commit
+		stage func(t *testing.T, b *CommitBuilder)
+		// push is the path another writer changes before the commit lands
+		push string
+	}{
+		{
+			name: "file read",
+			stage: func(t *testing.T, b *CommitBuilder) {
+				if _, err := b.GetFileContents(t.Context(), "data/posts/config.json"); err != nil {
+					t.Fatalf("GetFileContents: %v", err)
+				}
+				b.WriteFile("data/posts/index-1.json", "[]")
+			},
+			push: "data/posts/config.json",
+		},
+		{
+			name: "file missing when read",
+			stage: func(t *testing.T, b *CommitBuilder) {
+				b.GetFileContents(t.Context(), "data/posts/new.json")
+				b.WriteFile("data/posts/index-1.json", "[]")
+			},
+			push: "data/posts/new.json",
+		},
+		{
+			name: "file written",
+			stage: func(t *testing.T, b *CommitBuilder) {
+				b.WriteFile("data/posts/config.json", "{}")
+			},
+			push: "data/posts/config.json",
+		},
+		{
+			name: "file added to deleted directory",
+			stage: func(t *testing.T, b *CommitBuilder) {
+				if err := b.DeleteDir(t.Context(), "data/posts"); err != nil {
+					t.Fatalf("DeleteDir: %v", err)
+				}
+			},
+			push: "data/posts/late.json",
+		},
+		{
+			name: "referenced entry",
+			stage: func(t *testing.T, b *CommitBuilder) {
+				if invalid, err := ValidateReferenceIds(t.Context(), b, "posts", []string{"1"}); err != nil || len(invalid) != 0 {
+					t.Fatalf("ValidateReferenceIds = %v, %v; want no invalid IDs", invalid, err)
+				}
+				b.WriteFile("data/pages/index-1.json", "[]")
+			},
+			push: "data/posts/config.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			s := newMemoryRepo(t, map[string]string{"data/posts/config.json": `{"items":{"1":1}}`})
+			b := newTestBuilder(t, s, "")
+			tt.stage(t, b)
+
+			pushFile(t, s, tt.push, "outside")
+			head, _ := s.GetHead(ctx, "o", "r", "")
+
+			var moved *BranchMovedError
+			if err := b.Commit(ctx, "conflict"); !errors.As(err, &moved) {
+				t.Fatalf("Commit: got %v, want *BranchMovedError", err)
+			}
+			if current, _ := s.GetHead(ctx, "o", "r", ""); current != head {
+				t.Error("a conflicting commit was landed")
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"fmt"
+	"time"
+)
+
+// Dates are stored in these layouts. Both sort chronologically as plain
+// strings, which keeps index files and sorted listings simple.
+const (
+	DateLayout     = "2006-01-02"
+	DateTimeLayout = "2006-01-02T15:04:05Z"
+)
+
+// dateTimeLayouts are the ISO 8601 forms accepted for datetime fields. The
+// server cannot know the editor's time zone, so values without an offset are
+// taken to be UTC; clients should send local times with their offset.
+var dateTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+}
+
+// NormalizeDate checks that value is an ISO 8601 calendar date (YYYY-MM-DD)
+func NormalizeDate(value string) (string, error) {
+	date, err := time.Parse(DateLayout, value)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a date in the form YYYY-MM-DD", value)
+	}
+	return date.Format(DateLayout), nil
+}
+
+// NormalizeDateTime parses an ISO 8601 date and time and returns it in UTC,
+// e.g. "2024-05-01T10:00:00+02:00" becomes "2024-05-01T08:00:00Z". A value
+// without an offset is already UTC: "2024-05-01T10:00" becomes
+// "2024-05-01T10:00:00Z".
+func NormalizeDateTime(value string) (string, error) {
+	for _, layout := range dateTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC().Format(DateTimeLayout), nil
+		}
+	}
+	return "", fmt.Errorf("%q is not an ISO 8601 date and time", value)
+}
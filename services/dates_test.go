@@ -0,0 +1,106 @@
+package services
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/vachanmn123/vachancms/models"
+)
+
+func TestNormalizeDate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "2024-05-01", want: "2024-05-01"},
+		{value: "2024-02-29", want: "2024-02-29"},
+		{value: "2023-02-29", wantErr: true},
+		{value: "2024-5-1", wantErr: true},
+		{value: "01/05/2024", wantErr: true},
+		{value: "2024-05-01T10:00:00Z", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := NormalizeDate(tt.value)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("NormalizeDate(%q) = %q, %v; want %q, error %v", tt.value, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeDateTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "2024-05-01T10:00:00Z", want: "2024-05-01T10:00:00Z"},
+		{value: "2024-05-01T10:00:00+02:00", want: "2024-05-01T08:00:00Z"},
+		{value: "2024-05-01T23:30:00-01:00", want: "2024-05-02T00:30:00Z"},
+		{value: "2024-05-01T10:00:00.250Z", want: "2024-05-01T10:00:00Z"},
+		// Without an offset the value is taken to be UTC
+		{value: "2024-05-01T10:00:00", want: "2024-05-01T10:00:00Z"},
+		{value: "2024-05-01T10:00", want: "2024-05-01T10:00:00Z"},
+		{value: "2024-05-01", wantErr: true},
+		{value: "2024-05-01 10:00:00", wantErr: true},
+		{value: "2024-13-01T10:00:00Z", wantErr: true},
+		{value: "soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := NormalizeDateTime(tt.value)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("NormalizeDateTime(%q) = %q, %v; want %q, error %v", tt.value, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDateFieldValues(t *testing.T) {
+	fields := []models.ContentTypeField{
+		{FieldName: "day", FieldType: "date"},
+		{FieldName: "at", FieldType: "datetime"},
+	}
+	tests := []struct {
+		name   string
+		values map[string]any
+		// want is the stored values, or nil when the values are rejected
+		want map[string]any
+	}{
+		{
+			name:   "normalized",
+			values: map[string]any{"day": "2024-05-01", "at": "2024-05-01T10:00:00+02:00"},
+			want:   map[string]any{"day": "2024-05-01", "at": "2024-05-01T08:00:00Z"},
+		},
+		{
+			name:   "blank is unset",
+			values: map[string]any{"day": "", "at": ""},
+			want:   map[string]any{},
+		},
+		{name: "invalid date", values: map[string]any{"day": "May 1st"}},
+		{name: "not a string", values: map[string]any{"at": float64(1714557600)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fieldErrors, err := ValidateFieldValues(t.Context(), FieldContext{}, tt.values, fields, "")
+			if err != nil {
+				t.Fatalf("ValidateFieldValues: %v", err)
+			}
+			if tt.want == nil {
+				if len(fieldErrors) == 0 {
+					t.Errorf("values %v were accepted", tt.values)
+				}
+				return
+			}
+			if len(fieldErrors) > 0 || !maps.Equal(tt.values, tt.want) {
+				t.Errorf("stored %v with errors %v, want %v", tt.values, fieldErrors, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,513 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/vachanmn123/vachancms/models"
+)
+
+// FieldType is a kind of content type field, such as text or media. Every
+// field_type a content type may use is registered under the name its
+// description gives. Applications embedding the CMS can register their own.
+// Behaviour only some types have, such as rendering or referencing entries,
+// comes from the optional interfaces below.
+type FieldType interface {
+	// Validate checks a value that is set. It returns the problems to show in
+	// the editor, naming the field by path, and an error only when the check
+	// itself could not be done.
+	Validate(ctx context.Context, fc FieldContext, field *models.ContentTypeField, path string, value any) ([]models.FieldError, error)
+	// Normalize returns the form a valid value is stored in, or nil to store
+	// nothing for a value that only means unset, such as a blank date
+	Normalize(field *models.ContentTypeField, value any) any
+	// Default returns the value of an entry saved without the field, or nil
+	Default(field *models.ContentTypeField) any
+	// Describe tells the content types API and the editor about the type
+	Describe() FieldTypeDescription
+}
+
+// DefinitionValidator is implemented by field types that need more than a
+// name and a type in a content type definition, such as select options. It
+// reports every problem, locating them by path like ValidateFieldDefinitions.
+type DefinitionValidator interface {
+	ValidateDefinition(field *models.ContentTypeField, path string) []models.FieldError
+}
+
+// ValueConverter is implemented by field types that can take over values a
+// field of another type stored, as a change_type migration does. Convert
+// returns value in the shape this type stores, e.g. 42 for "42" in a number
+// field, and fails when it has no sensible equivalent.
+type ValueConverter interface {
+	Convert(ctx context.Context, fc FieldContext, field *models.ContentTypeField, value any) (any, error)
+}
+
+// ValueRenderer is implemented by field types whose values are served along
+// with a rendered form, such as the HTML of Markdown. Render returns "" when
+// there is nothing to render.
+type ValueRenderer interface {
+	Render(field *models.ContentTypeField, value any) (string, error)
+}
+
+// EntryReferrer is implemented by field types whose values are the IDs of
+// entries of another content type. ReferenceTarget returns the slug of that
+// content type, or "" if the field does not point at one.
+type EntryReferrer interface {
+	ReferenceTarget(field *models.ContentTypeField) string
+}
+
+// SubFieldHolder is implemented by field types whose values are made of the
+// field's sub-fields, such as groups
+type SubFieldHolder interface {
+	// SubValues returns the sub-field values held in value, each located by
+	// what follows the field's path: "" for a group, "[1]" for the second
+	// item of a repeater
+	SubValues(value any) []SubFieldValues
+}
+
+// SubFieldValues are the values of a field's sub-fields held in one object
+type SubFieldValues struct {
+	Suffix string
+	Values map[string]any
+}
+
+// FieldRules are the kinds of validation rules a field type takes besides
+// required and unique
+type FieldRules struct {
+	// Length is MinLength, MaxLength and Pattern
+	Length bool
+	// Range is Min, Max, Step and Integer
+	Range bool
+	// Items is MinItems and MaxItems
+	Items bool
+}
+
+// RuleSupporter is implemented by field types that take validation rules;
+// other types take none
+type RuleSupporter interface {
+	SupportedRules() FieldRules
+}
+
+// FieldContext is the repository an entry is saved to, for field types that
+// check values against other content such as media. Such content should be
+// read through Builder, the commit the entry is saved in, so that a
+// concurrent change to it stops the commit from landing.
+type FieldContext struct {
+	Token   string
+	Owner   string
+	Repo    string
+	Builder *CommitBuilder
+}
+
+// FieldTypeDescription describes a field type to API clients
+type FieldTypeDescription struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Sortable types store strings or numbers entries can be sorted by
+	Sortable bool `json:"sortable"`
+	// Unique types store single values that can be kept unique per content type
+	Unique bool `json:"unique"`
+}
+
+// BaseFieldType provides the Normalize and Default most field types use:
+// values are stored as they are and the field's declared default applies
+type BaseFieldType struct{}
+
+func (BaseFieldType) Normalize(field *models.ContentTypeField, value any) any {
+	return value
+}
+
+func (BaseFieldType) Default(field *models.ContentTypeField) any {
+	return field.Default
+}
+
+var (
+	fieldTypesMu sync.RWMutex
+	fieldTypes   = map[string]FieldType{}
+)
+
+// RegisterFieldType makes a field type available to content types. A type
+// registered under the name of an existing one replaces it.
+func RegisterFieldType(fieldType FieldType) {
+	name := fieldType.Describe().Name
+	if name == "" {
+		panic("services: field type registered without a name")
+	}
+
+	fieldTypesMu.Lock()
+	defer fieldTypesMu.Unlock()
+	fieldTypes[name] = fieldType
+}
+
+// LookupFieldType returns the field type registered under name
+func LookupFieldType(name string) (FieldType, bool) {
+	fieldTypesMu.RLock()
+	defer fieldTypesMu.RUnlock()
+	fieldType, ok := fieldTypes[name]
+	return fieldType, ok
+}
+
+// fieldRules returns the rules the named field type takes
+func fieldRules(name string) FieldRules {
+	fieldType, _ := LookupFieldType(name)
+	if supporter, ok := fieldType.(RuleSupporter); ok {
+		return supporter.SupportedRules()
+	}
+	return FieldRules{}
+}
+
+// typesTaking lists the field types that take a kind of rule, e.g.
+// "markdown, text or textarea"
+func typesTaking(kind func(FieldRules) bool) string {
+	fieldTypesMu.RLock()
+	names := []string{}
+	for name, fieldType := range fieldTypes {
+		if supporter, ok := fieldType.(RuleSupporter); ok && kind(supporter.SupportedRules()) {
+			names = append(names, name)
+		}
+	}
+	fieldTypesMu.RUnlock()
+
+	slices.Sort(names)
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// subValues returns the sub-field values a field holds in value, if its type
+// has sub-fields
+func subValues(field *models.ContentTypeField, value any) []SubFieldValues {
+	fieldType, _ := LookupFieldType(field.FieldType)
+	if holder, ok := fieldType.(SubFieldHolder); ok {
+		return holder.SubValues(value)
+	}
+	return nil
+}
+
+// RenderFieldValues renders every field of a content value with a rendered
+// form, including those inside group and repeater fields. The result is keyed
+// by the field's path, e.g. body or faq[1].answer. It returns nil when there
+// is nothing to render.
+func RenderFieldValues(contentType *models.ContentType, values map[string]any) (map[string]string, error) {
+	rendered := map[string]string{}
+	if err := renderFieldValues(contentType.Fields, values, "", rendered); err != nil {
+		return nil, err
+	}
+	if len(rendered) == 0 {
+		return nil, nil
+	}
+	return rendered, nil
+}
+
+func renderFieldValues(fields []models.ContentTypeField, values map[string]any, prefix string, rendered map[string]string) error {
+	for i := range fields {
+		field := &fields[i]
+		path := prefix + field.FieldName
+		value, ok := values[field.FieldName]
+		if !ok {
+			continue
+		}
+
+		fieldType, _ := LookupFieldType(field.FieldType)
+		if renderer, ok := fieldType.(ValueRenderer); ok {
+			html, err := renderer.Render(field, value)
+			if err != nil {
+				return err
+			}
+			if html != "" {
+				rendered[path] = html
+			}
+		}
+		for _, sub := range subValues(field, value) {
+			if err := renderFieldValues(field.Fields, sub.Values, path+sub.Suffix+".", rendered); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DescribeFieldTypes describes every registered field type, sorted by name
+func DescribeFieldTypes() []FieldTypeDescription {
+	fieldTypesMu.RLock()
+	defer fieldTypesMu.RUnlock()
+
+	descriptions := make([]FieldTypeDescription, 0, len(fieldTypes))
+	for _, fieldType := range fieldTypes {
+		descriptions = append(descriptions, fieldType.Describe())
+	}
+	slices.SortFunc(descriptions, func(x, y FieldTypeDescription) int {
+		return strings.Compare(x.Name, y.Name)
+	})
+	return descriptions
+}
+
+// ValidateFieldDefinitions checks a list of field definitions and returns
+// every problem found: names must be set and unique, types registered, and
+// rules and type-specific settings must make sense. Problems are located by
+// the field's position, e.g. fields[2] or fields[0].fields[1] inside a group.
+func ValidateFieldDefinitions(fields []models.ContentTypeField, prefix string) []models.FieldError {
+	problems := []models.FieldError{}
+	seen := map[string]bool{}
+	for i := range fields {
+		field := &fields[i]
+		path := fmt.Sprintf("%sfields[%d]", prefix, i)
+		problem := func(format string, args ...any) {
+			problems = append(problems, models.FieldError{Field: path, Message: fmt.Sprintf(format, args...)})
+		}
+
+		label := field.FieldName
+		if strings.TrimSpace(label) == "" {
+			label = strconv.Itoa(i + 1)
+			problem("Field %s needs a name", label)
+		} else if seen[field.FieldName] {
+			problem("Field name %s is used more than once", field.FieldName)
+		}
+		seen[field.FieldName] = true
+
+		fieldType, ok := LookupFieldType(field.FieldType)
+		if !ok {
+			problem("Field %s has unknown type %q", label, field.FieldType)
+			continue
+		}
+		for _, message := range validateFieldRules(field, fieldType.Describe()) {
+			problem("%s", message)
+		}
+		if validator, ok := fieldType.(DefinitionValidator); ok {
+			problems = append(problems, validator.ValidateDefinition(field, path)...)
+		}
+	}
+	return problems
+}
+
+// ValidateFieldDefaults checks the declared defaults of a list of field
+// definitions, at any depth, against their types and rules. Defaults can name
+// media or entries, so unlike ValidateFieldDefinitions this reads the
+// repository. Problems are located like those of ValidateFieldDefinitions.
+func ValidateFieldDefaults(ctx context.Context, fc FieldContext, fields []models.ContentTypeField, prefix string) ([]models.FieldError, error) {
+	problems := []models.FieldError{}
+	for i := range fields {
+		field := &fields[i]
+		path := fmt.Sprintf("%sfields[%d]", prefix, i)
+
+		if fieldType, ok := LookupFieldType(field.FieldType); ok && field.Default != nil {
+			valueErrors, err := fieldType.Validate(ctx, fc, field, field.FieldName, field.Default)
+			if err != nil {
+				return nil, err
+			}
+			if len(valueErrors) == 0 {
+				if message := checkFieldRules(field, field.FieldName, field.Default); message != "" {
+					valueErrors = []models.FieldError{{Message: message}}
+				}
+			}
+			for _, valueErr := range valueErrors {
+				problems = append(problems, models.FieldError{
+					Field:   path,
+					Message: fmt.Sprintf("Default of field %s is invalid: %s", field.FieldName, valueErr.Message),
+				})
+			}
+		}
+
+		nested, err := ValidateFieldDefaults(ctx, fc, field.Fields, path+".")
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, nested...)
+	}
+	return problems, nil
+}
+
+// validateFieldRules checks that a field's validation rules suit its type
+// and can be satisfied
+func validateFieldRules(field *models.ContentTypeField, description FieldTypeDescription) []string {
+	var problems []string
+	rules := fieldRules(field.FieldType)
+	hasTextRules := field.MinLength != nil || field.MaxLength != nil || field.Pattern != ""
+	if hasTextRules && !rules.Length {
+		problems = append(problems, fmt.Sprintf("Length and pattern rules of field %s need a %s field", field.FieldName, typesTaking(func(r FieldRules) bool { return r.Length })))
+	}
+	if (field.MinLength != nil && *field.MinLength < 0) || (field.MaxLength != nil && *field.MaxLength < 0) {
+		problems = append(problems, fmt.Sprintf("Lengths of field %s cannot be negative", field.FieldName))
+	}
+	if field.MinLength != nil && field.MaxLength != nil && *field.MinLength > *field.MaxLength {
+		problems = append(problems, fmt.Sprintf("MinLength of field %s is larger than its MaxLength", field.FieldName))
+	}
+	if field.Pattern != "" {
+		if _, err := regexp.Compile(field.Pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("Pattern of field %s is not a valid regular expression: %v", field.FieldName, err))
+		}
+	}
+
+	hasNumberRules := field.Min != nil || field.Max != nil || field.Step != nil || field.Integer
+	if hasNumberRules && !rules.Range {
+		problems = append(problems, fmt.Sprintf("Min, max, step and integer rules of field %s need a %s field", field.FieldName, typesTaking(func(r FieldRules) bool { return r.Range })))
+	}
+	if field.Min != nil && field.Max != nil && *field.Min > *field.Max {
+		problems = append(problems, fmt.Sprintf("Min of field %s is larger than its Max", field.FieldName))
+	}
+	if field.Step != nil && *field.Step <= 0 {
+		problems = append(problems, fmt.Sprintf("Step of field %s must be greater than 0", field.FieldName))
+	}
+
+	if field.Unique && !description.Unique {
+		problems = append(problems, fmt.Sprintf("Field %s of type %s cannot be unique", field.FieldName, field.FieldType))
+	}
+	return problems
+}
+
+// ValidateFieldValues checks and normalizes values against a list of field
+// definitions. Missing fields get their type's default first. prefix is the
+// path of the enclosing field, so problems in group and repeater fields are
+// reported as e.g. faq[1].question.
+func ValidateFieldValues(ctx context.Context, fc FieldContext, values map[string]any, fields []models.ContentTypeField, prefix string) ([]models.FieldError, error) {
+	fieldErrors := []models.FieldError{}
+
+	for i := range fields {
+		fieldDef := &fields[i]
+		if _, ok := values[fieldDef.FieldName]; !ok {
+			if fieldType, ok := LookupFieldType(fieldDef.FieldType); ok {
+				if defaultValue := fieldType.Default(fieldDef); defaultValue != nil {
+					values[fieldDef.FieldName] = defaultValue
+				}
+			}
+		}
+		if fieldDef.IsRequired && isEmptyFieldValue(values[fieldDef.FieldName]) {
+			fieldErrors = append(fieldErrors, models.FieldError{
+				Field:   prefix + fieldDef.FieldName,
+				Message: fmt.Sprintf("Field %s is required", prefix+fieldDef.FieldName),
+			})
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		path := prefix + key
+		fieldValue := values[key]
+		fieldIndex := slices.IndexFunc(fields, func(f models.ContentTypeField) bool {
+			return f.FieldName == key
+		})
+		if fieldIndex == -1 {
+			fieldErrors = append(fieldErrors, models.FieldError{
+				Field:   path,
+				Message: fmt.Sprintf("Field %s is not defined in content type", path),
+			})
+			continue
+		}
+		// An empty optional field is simply not set
+		if fieldValue == nil {
+			continue
+		}
+
+		fieldDef := &fields[fieldIndex]
+		fieldType, ok := LookupFieldType(fieldDef.FieldType)
+		if !ok {
+			fieldErrors = append(fieldErrors, models.FieldError{
+				Field:   path,
+				Message: fmt.Sprintf("Unsupported field type %s for field %s", fieldDef.FieldType, path),
+			})
+			continue
+		}
+
+		valueErrors, err := fieldType.Validate(ctx, fc, fieldDef, path, fieldValue)
+		if err != nil {
+			return nil, err
+		}
+		if len(valueErrors) == 0 {
+			if message := checkFieldRules(fieldDef, path, fieldValue); message != "" {
+				valueErrors = []models.FieldError{{Field: path, Message: message}}
+			}
+		}
+		if len(valueErrors) > 0 {
+			fieldErrors = append(fieldErrors, valueErrors...)
+			continue
+		}
+		if normalized := fieldType.Normalize(fieldDef, fieldValue); normalized != nil {
+			values[key] = normalized
+		} else {
+			delete(values, key)
+		}
+	}
+
+	return fieldErrors, nil
+}
+
+// isEmptyFieldValue reports whether a value counts as missing for a required
+// field. false and 0 are values; nothing, "", [] and {} are not.
+func isEmptyFieldValue(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(v) == ""
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	}
+	return false
+}
+
+// checkFieldRules applies the validation rules of a field to a value its
+// type accepted. Uniqueness needs the other entries and is checked by
+// FindUniqueConflicts instead.
+func checkFieldRules(fieldDef *models.ContentTypeField, key string, fieldValue any) string {
+	switch v := fieldValue.(type) {
+	case string:
+		// A blank optional field is left alone, as it is in the browser
+		if v == "" {
+			return ""
+		}
+		length := utf8.RuneCountInString(v)
+		if fieldDef.MinLength != nil && length < *fieldDef.MinLength {
+			return fmt.Sprintf("Field %s must be at least %d characters long", key, *fieldDef.MinLength)
+		}
+		if fieldDef.MaxLength != nil && length > *fieldDef.MaxLength {
+			return fmt.Sprintf("Field %s must be at most %d characters long", key, *fieldDef.MaxLength)
+		}
+		if fieldDef.Pattern != "" {
+			pattern, err := regexp.Compile(fieldDef.Pattern)
+			if err == nil && !pattern.MatchString(v) {
+				return fmt.Sprintf("Field %s must match the pattern %s", key, fieldDef.Pattern)
+			}
+		}
+	case float64:
+		if fieldDef.Integer && v != math.Trunc(v) {
+			return fmt.Sprintf("Field %s must be a whole number", key)
+		}
+		if fieldDef.Min != nil && v < *fieldDef.Min {
+			return fmt.Sprintf("Field %s must be at least %v", key, *fieldDef.Min)
+		}
+		if fieldDef.Max != nil && v > *fieldDef.Max {
+			return fmt.Sprintf("Field %s must be at most %v", key, *fieldDef.Max)
+		}
+		if fieldDef.Step != nil && *fieldDef.Step > 0 {
+			base := 0.0
+			if fieldDef.Min != nil {
+				base = *fieldDef.Min
+			}
+			// Allow for float rounding, e.g. 0.3 is a step of 0.1
+			steps := (v - base) / *fieldDef.Step
+			if math.Abs(steps-math.Round(steps)) > 1e-9 {
+				return fmt.Sprintf("Field %s must be in steps of %v", key, *fieldDef.Step)
+			}
+		}
+	}
+	return ""
+}
+
+// invalidField reports a single problem with the value at path
+func invalidField(path, format string, args ...any) []models.FieldError {
+	return []models.FieldError{{Field: path, Message: fmt.Sprintf(format, args...)}}
+}
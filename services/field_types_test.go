@@ -0,0 +1,306 @@
+package services
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/vachanmn123/vachancms/models"
+)
+
+// fieldErrorPaths returns the fields problems were reported for
+func fieldErrorPaths(fieldErrors []models.FieldError) []string {
+	paths := []string{}
+	for _, fieldErr := range fieldErrors {
+		paths = append(paths, fieldErr.Field)
+	}
+	return paths
+}
+
+func TestValidateFieldValuesRequiredAndUnknownFields(t *testing.T) {
+	fields := []models.ContentTypeField{
+		{FieldName: "title", FieldType: "text", IsRequired: true},
+		{FieldName: "views", FieldType: "number", IsRequired: true},
+		{FieldName: "draft", FieldType: "boolean", Default: true},
+		{FieldName: "tags", FieldType: "select", Options: []string{"a", "b"}},
+		{FieldName: "faq", FieldType: "repeater", Fields: []models.ContentTypeField{
+			{FieldName: "question", FieldType: "text", IsRequired: true},
+		}},
+	}
+
+	tests := []struct {
+		name   string
+		values map[string]any
+		// wantErrors are the fields problems are reported for, all at once
+		wantErrors []string
+		// wantValues are the values stored when there are no problems
+		wantValues map[string]any
+	}{
+		{
+			name:       "defaults applied",
+			values:     map[string]any{"title": "t", "views": float64(0)},
+			wantValues: map[string]any{"title": "t", "views": float64(0), "draft": true},
+		},
+		{
+			name:       "given value wins over default",
+			values:     map[string]any{"title": "t", "views": float64(1), "draft": false},
+			wantValues: map[string]any{"title": "t", "views": float64(1), "draft": false},
+		},
+		{
+			name:       "null optional field is left unset",
+			values:     map[string]any{"title": "t", "views": float64(1), "tags": nil},
+			wantValues: map[string]any{"title": "t", "views": float64(1), "draft": true, "tags": nil},
+		},
+		{
+			name:       "missing required fields",
+			values:     map[string]any{},
+			wantErrors: []string{"title", "views"},
+		},
+		{
+			name:       "blank required field",
+			values:     map[string]any{"title": "  ", "views": float64(1)},
+			wantErrors: []string{"title"},
+		},
+		{
+			name:       "every problem at once",
+			values:     map[string]any{"views": "many", "tags": "c", "extra": 1},
+			wantErrors: []string{"title", "extra", "tags", "views"},
+		},
+		{
+			name: "required sub-field",
+			values: map[string]any{"title": "t", "views": float64(1), "faq": []any{
+				map[string]any{"question": "q"},
+				map[string]any{"answer": "a"},
+			}},
+			wantErrors: []string{"faq[1].question", "faq[1].answer"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fieldErrors, err := ValidateFieldValues(t.Context(), FieldContext{}, tt.values, fields, "")
+			if err != nil {
+				t.Fatalf("ValidateFieldValues: %v", err)
+			}
+			if got := fieldErrorPaths(fieldErrors); !slices.Equal(got, tt.wantErrors) {
+				t.Errorf("problems with %v, want %v (%v)", got, tt.wantErrors, fieldErrors)
+			}
+			if tt.wantValues != nil && !reflect.DeepEqual(tt.values, tt.wantValues) {
+				t.Errorf("stored %v, want %v", tt.values, tt.wantValues)
+			}
+		})
+	}
+}
+
+func TestValidateFieldValuesRules(t *testing.T) {
+	two, five := 2, 5
+	one, ten, tenth := 1.0, 10.0, 0.1
+	fields := []models.ContentTypeField{
+		{FieldName: "code", FieldType: "text", MinLength: &two, MaxLength: &five, Pattern: "^[a-z]+$"},
+		{FieldName: "body", FieldType: "markdown", MaxLength: &five},
+		{FieldName: "count", FieldType: "number", Min: &one, Max: &ten, Integer: true},
+		{FieldName: "ratio", FieldType: "number", Step: &tenth},
+	}
+
+	tests := []struct {
+		name  string
+		value map[string]any
+		// want is the message of the only problem, "" for a valid value
+		want string
+	}{
+		{name: "valid", value: map[string]any{"code": "abc", "count": float64(3), "ratio": 0.3}},
+		{name: "blank text skips rules", value: map[string]any{"code": ""}},
+		{name: "too short", value: map[string]any{"code": "a"}, want: "Field code must be at least 2 characters long"},
+		{name: "too long", value: map[string]any{"code": "abcdef"}, want: "Field code must be at most 5 characters long"},
+		{name: "length counts characters", value: map[string]any{"code": "ééééé", "body": "ééééé"}, want: "Field code must match the pattern ^[a-z]+$"},
+		{name: "pattern", value: map[string]any{"code": "AB"}, want: "Field code must match the pattern ^[a-z]+$"},
+		{name: "markdown length", value: map[string]any{"body": "# long"}, want: "Field body must be at most 5 characters long"},
+		{name: "below min", value: map[string]any{"count": float64(0)}, want: "Field count must be at least 1"},
+		{name: "above max", value: map[string]any{"count": float64(11)}, want: "Field count must be at most 10"},
+		{name: "not whole", value: map[string]any{"count": 2.5}, want: "Field count must be a whole number"},
+		{name: "off step", value: map[string]any{"ratio": 0.25}, want: "Field ratio must be in steps of 0.1"},
+		{name: "type before rules", value: map[string]any{"count": "3"}, want: "Field count should be a number"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fieldErrors, err := ValidateFieldValues(t.Context(), FieldContext{}, tt.value, fields, "")
+			if err != nil {
+				t.Fatalf("ValidateFieldValues: %v", err)
+			}
+			switch {
+			case tt.want == "" && len(fieldErrors) > 0:
+				t.Errorf("value %v rejected: %v", tt.value, fieldErrors)
+			case tt.want != "" && (len(fieldErrors) != 1 || fieldErrors[0].Message != tt.want):
+				t.Errorf("problems %v, want only %q", fieldErrors, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFieldDefaults(t *testing.T) {
+	five := 5
+	tests := []struct {
+		name  string
+		field models.ContentTypeField
+		// want is the message of the only problem, "" for a valid default
+		want string
+	}{
+		{name: "valid", field: models.ContentTypeField{FieldName: "n", FieldType: "number", Default: float64(3)}},
+		{name: "no default", field: models.ContentTypeField{FieldName: "n", FieldType: "number"}},
+		{
+			name:  "wrong type",
+			field: models.ContentTypeField{FieldName: "n", FieldType: "number", Default: "3"},
+			want:  "Default of field n is invalid: Field n should be a number",
+		},
+		{
+			name:  "breaks a rule",
+			field: models.ContentTypeField{FieldName: "s", FieldType: "text", MaxLength: &five, Default: "too long"},
+			want:  "Default of field s is invalid: Field s must be at most 5 characters long",
+		},
+		{
+			name:  "unknown option",
+			field: models.ContentTypeField{FieldName: "s", FieldType: "select", Options: []string{"a"}, Default: "b"},
+			want:  "Default of field s is invalid: Field s has invalid option b",
+		},
+		{
+			name: "inside a group",
+			field: models.ContentTypeField{FieldName: "g", FieldType: "group", Fields: []models.ContentTypeField{
+				{FieldName: "d", FieldType: "date", Default: "yesterday"},
+			}},
+			want: `Default of field d is invalid: Field d: "yesterday" is not a date in the form YYYY-MM-DD`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems, err := ValidateFieldDefaults(t.Context(), FieldContext{}, []models.ContentTypeField{tt.field}, "")
+			if err != nil {
+				t.Fatalf("ValidateFieldDefaults: %v", err)
+			}
+			switch {
+			case tt.want == "" && len(problems) > 0:
+				t.Errorf("default rejected: %v", problems)
+			case tt.want != "" && (len(problems) != 1 || problems[0].Message != tt.want):
+				t.Errorf("problems %v, want only %q", problems, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFieldRulesSuitTheType(t *testing.T) {
+	two, one := 2, 1
+	step := 0.0
+	tests := []struct {
+		name  string
+		field models.ContentTypeField
+		want  []string
+	}{
+		{name: "text rules on text", field: models.ContentTypeField{FieldName: "f", FieldType: "textarea", MinLength: &one, MaxLength: &two}},
+		{name: "number rules on number", field: models.ContentTypeField{FieldName: "f", FieldType: "number", Integer: true}},
+		{
+			name:  "text rules on number",
+			field: models.ContentTypeField{FieldName: "f", FieldType: "number", Pattern: "a"},
+			want:  []string{"Length and pattern rules of field f need a markdown, text or textarea field"},
+		},
+		{
+			name:  "number rules on text",
+			field: models.ContentTypeField{FieldName: "f", FieldType: "text", Integer: true},
+			want:  []string{"Min, max, step and integer rules of field f need a number field"},
+		},
+		{
+			name:  "impossible rules",
+			field: models.ContentTypeField{FieldName: "f", FieldType: "text", MinLength: &two, MaxLength: &one, Pattern: "("},
+			want: []string{
+				"MinLength of field f is larger than its MaxLength",
+				"Pattern of field f is not a valid regular expression: error parsing regexp: missing closing ): `(`",
+			},
+		},
+		{
+			name:  "zero step",
+			field: models.ContentTypeField{FieldName: "f", FieldType: "number", Step: &step},
+			want:  []string{"Step of field f must be greater than 0"},
+		},
+		{
+			name:  "unique markdown",
+			field: models.ContentTypeField{FieldName: "f", FieldType: "markdown", Unique: true},
+			want:  []string{"Field f of type markdown cannot be unique"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fieldType, _ := LookupFieldType(tt.field.FieldType)
+			if got := validateFieldRules(&tt.field, fieldType.Describe()); !slices.Equal(got, tt.want) {
+				t.Errorf("validateFieldRules = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFieldDefinitions(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []models.ContentTypeField
+		want   []models.FieldError
+	}{
+		{
+			name: "valid",
+			fields: []models.ContentTypeField{
+				{FieldName: "title", FieldType: "text"},
+				{FieldName: "kind", FieldType: "select", Options: []string{"a", "b"}},
+			},
+			want: []models.FieldError{},
+		},
+		{
+			name: "names and types",
+			fields: []models.ContentTypeField{
+				{FieldName: "title", FieldType: "text"},
+				{FieldName: " ", FieldType: "text"},
+				{FieldName: "title", FieldType: "number"},
+				{FieldName: "color", FieldType: "colour"},
+			},
+			want: []models.FieldError{
+				{Field: "fields[1]", Message: "Field 2 needs a name"},
+				{Field: "fields[2]", Message: "Field name title is used more than once"},
+				{Field: "fields[3]", Message: `Field color has unknown type "colour"`},
+			},
+		},
+		{
+			name: "type settings",
+			fields: []models.ContentTypeField{
+				{FieldName: "kind", FieldType: "select"},
+				{FieldName: "size", FieldType: "select", Options: []string{"s", ""}},
+				{FieldName: "author", FieldType: "reference", Options: []string{"multiple"}},
+			},
+			want: []models.FieldError{
+				{Field: "fields[0]", Message: "Select field kind needs at least one option"},
+				{Field: "fields[1]", Message: "Options of select field size cannot be empty"},
+				{Field: "fields[2]", Message: "Reference field author needs the slug of a content type in its options"},
+			},
+		},
+		{
+			name: "inside groups",
+			fields: []models.ContentTypeField{
+				{FieldName: "title", FieldType: "text"},
+				{FieldName: "faq", FieldType: "repeater", MinItems: 3, MaxItems: 1, Fields: []models.ContentTypeField{
+					{FieldName: "question", FieldType: "text", Unique: true},
+					{FieldName: "answer", FieldType: "group"},
+				}},
+			},
+			want: []models.FieldError{
+				{Field: "fields[1]", Message: "MinItems of field faq is larger than its MaxItems"},
+				{Field: "fields[1]", Message: "Field question inside faq cannot be unique"},
+				{Field: "fields[1].fields[1]", Message: "Field answer needs at least one sub-field"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidateFieldDefinitions(tt.fields, ""); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ValidateFieldDefinitions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
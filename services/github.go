@@ -2,9 +2,14 @@ package services
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/go-github/v62/github"
 )
@@ -12,11 +17,25 @@ import (
 var (
 	// httpClient is shared across all calls to maintain TCP/TLS connections
 	httpClient *http.Client
-	once       sync.Once
+	// streamHTTPClient shares the same transport but has no overall timeout,
+	// so uploads and downloads of large media are not cut off midway
+	streamHTTPClient *http.Client
+	once             sync.Once
 )
 
 // getClient returns a github.Client using the global pooled http.Client
 func getClient(token string) *github.Client {
+	initHTTPClients()
+	return github.NewClient(httpClient).WithAuthToken(token)
+}
+
+// getStreamingClient returns a github.Client for transferring large files
+func getStreamingClient(token string) *github.Client {
+	initHTTPClients()
+	return github.NewClient(streamHTTPClient).WithAuthToken(token)
+}
+
+func initHTTPClients() {
 	once.Do(func() {
 		// 1. Create the base pooled transport
 		baseTransport := &http.Transport{
@@ -27,15 +46,49 @@ func getClient(token string) *github.Client {
 
 		httpClient = &http.Client{
 			Timeout:   time.Second * 30,
-			Transport: baseTransport,
+			Transport: &rateLimitTransport{base: baseTransport},
+		}
+		streamHTTPClient = &http.Client{
+			Transport: httpClient.Transport,
 		}
 	})
-	return github.NewClient(httpClient).WithAuthToken(token)
 }
 
-func ListRepos(token string) ([]*github.Repository, error) {
-	ctx := context.Background()
-	gh_client := getClient(token)
+// GitHubStorage is the Storage backend that talks to github.com on behalf of
+// a single user.
+type GitHubStorage struct {
+	client       *github.Client
+	streamClient *github.Client
+	tokenKey     string
+}
+
+// NewGitHubStorage returns a GitHub backend authenticated with the user's token
+func NewGitHubStorage(token string) Storage {
+	return &GitHubStorage{
+		client:       getClient(token),
+		streamClient: getStreamingClient(token),
+		tokenKey:     tokenKey(token),
+	}
+}
+
+// branchRef returns the optional branch argument, or "" for the default branch
+func branchRef(branch []string) string {
+	if len(branch) == 0 {
+		return ""
+	}
+	return branch[0]
+}
+
+func (s *GitHubStorage) GetUser(ctx context.Context) (*User, error) {
+	user, _, err := s.client.Users.Get(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return &User{Login: user.GetLogin(), Name: user.GetName(), AvatarURL: user.GetAvatarURL()}, nil
+}
+
+func (s *GitHubStorage) ListRepos(ctx context.Context) ([]*Repository, error) {
+	gh_client := s.client
 	repos, res, err := gh_client.Repositories.ListByAuthenticatedUser(ctx, &github.RepositoryListByAuthenticatedUserOptions{
 		Visibility: "all",
 		Sort:       "pushed_at",
@@ -45,30 +98,28 @@ func ListRepos(token string) ([]*github.Repository, error) {
 		return nil, err
 	}
 
-	return repos, nil
-}
-
-type FileNotFoundError struct{}
+	result := make([]*Repository, 0, len(repos))
+	for _, r := range repos {
+		result = append(result, &Repository{
+			FullName:      r.GetFullName(),
+			Description:   r.GetDescription(),
+			Private:       r.GetPrivate(),
+			DefaultBranch: r.GetDefaultBranch(),
+		})
+	}
 
-func (e *FileNotFoundError) Error() string {
-	return "file not found"
+	return result, nil
 }
 
-func GetFileContents(token, user, repo, path string, branch ...string) (string, error) {
-	ctx := context.Background()
-	gh_client := getClient(token)
-	var refString string
-	if len(branch) == 0 {
-		refString = ""
-	} else {
-		refString = branch[0]
-	}
+// getContents reads a file through the Contents API, bypassing the caches
+func (s *GitHubStorage) getContents(ctx context.Context, user, repo, path, refString string) (string, error) {
+	gh_client := s.client
 
 	fileContent, _, res, err := gh_client.Repositories.GetContents(ctx, user, repo, path, &github.RepositoryContentGetOptions{
 		Ref: refString,
 	})
 	if err != nil || res.StatusCode != 200 {
-		if res.StatusCode == 404 {
+		if res != nil && res.StatusCode == 404 {
 			return "", &FileNotFoundError{}
 		}
 		return "", err
@@ -82,15 +133,10 @@ func GetFileContents(token, user, repo, path string, branch ...string) (string,
 	return content, nil
 }
 
-func CreateOrUpdateFile(token, user, repo, path, message, content string, branch ...string) error {
-	ctx := context.Background()
-	gh_client := getClient(token)
-	var refString string
-	if len(branch) == 0 {
-		refString = ""
-	} else {
-		refString = branch[0]
-	}
+func (s *GitHubStorage) CreateOrUpdateFile(ctx context.Context, user, repo, path, message, content string, branch ...string) error {
+	defer s.unpinHeads(ctx, user, repo)
+	gh_client := s.client
+	refString := branchRef(branch)
 
 	fileContent, _, _, err := gh_client.Repositories.GetContents(ctx, user, repo, path, &github.RepositoryContentGetOptions{
 		Ref: refString,
@@ -113,15 +159,10 @@ func CreateOrUpdateFile(token, user, repo, path, message, content string, branch
 	return nil
 }
 
-func DeleteFile(token, user, repo, path, message string, branch ...string) error {
-	ctx := context.Background()
-	gh_client := getClient(token)
-	var refString string
-	if len(branch) == 0 {
-		refString = ""
-	} else {
-		refString = branch[0]
-	}
+func (s *GitHubStorage) DeleteFile(ctx context.Context, user, repo, path, message string, branch ...string) error {
+	defer s.unpinHeads(ctx, user, repo)
+	gh_client := s.client
+	refString := branchRef(branch)
 
 	fileContent, _, _, err := gh_client.Repositories.GetContents(ctx, user, repo, path, &github.RepositoryContentGetOptions{
 		Ref: refString,
@@ -140,15 +181,10 @@ func DeleteFile(token, user, repo, path, message string, branch ...string) error
 	return err
 }
 
-func UploadFile(token, user, repo, path, message string, content []byte, branch ...string) error {
-	ctx := context.Background()
-	gh_client := getClient(token)
-	var refString string
-	if len(branch) == 0 {
-		refString = ""
-	} else {
-		refString = branch[0]
-	}
+func (s *GitHubStorage) UploadFile(ctx context.Context, user, repo, path, message string, content []byte, branch ...string) error {
+	defer s.unpinHeads(ctx, user, repo)
+	gh_client := s.client
+	refString := branchRef(branch)
 
 	fileContent, _, _, err := gh_client.Repositories.GetContents(ctx, user, repo, path, &github.RepositoryContentGetOptions{
 		Ref: refString,
@@ -171,18 +207,12 @@ func UploadFile(token, user, repo, path, message string, content []byte, branch
 	return nil
 }
 
-type PageConfig struct {
-	Initialized bool
-	URL         string
-}
-
-func GetPagesConfig(token, user, repo string) (*PageConfig, error) {
-	ctx := context.Background()
-	gh_client := getClient(token)
+func (s *GitHubStorage) GetPagesConfig(ctx context.Context, user, repo string) (*PageConfig, error) {
+	gh_client := s.client
 
 	pagesConfig, res, err := gh_client.Repositories.GetPagesInfo(ctx, user, repo)
 	if err != nil || res.StatusCode != 200 {
-		if res.StatusCode == 404 {
+		if res != nil && res.StatusCode == 404 {
 			return &PageConfig{
 				Initialized: false,
 			}, nil
@@ -196,9 +226,8 @@ func GetPagesConfig(token, user, repo string) (*PageConfig, error) {
 	}, nil
 }
 
-func CreateBranch(token, user, repo, newBranch string, srcBranch ...string) error {
-	ctx := context.Background()
-	gh_client := getClient(token)
+func (s *GitHubStorage) CreateBranch(ctx context.Context, user, repo, newBranch string, srcBranch ...string) error {
+	gh_client := s.client
 
 	gh_repo, _, err := gh_client.Repositories.Get(ctx, user, repo)
 	if err != nil {
@@ -232,9 +261,9 @@ func CreateBranch(token, user, repo, newBranch string, srcBranch ...string) erro
 	return err
 }
 
-func MergeBranch(token, user, repo, fromBranch, message string, toBranch ...string) error {
-	ctx := context.Background()
-	gh_client := getClient(token)
+func (s *GitHubStorage) MergeBranch(ctx context.Context, user, repo, fromBranch, message string, toBranch ...string) error {
+	defer s.unpinHeads(ctx, user, repo)
+	gh_client := s.client
 	var baseBranchName string
 	if len(toBranch) == 0 {
 		gh_repo, _, err := gh_client.Repositories.Get(ctx, user, repo)
@@ -261,9 +290,8 @@ func MergeBranch(token, user, repo, fromBranch, message string, toBranch ...stri
 	return err
 }
 
-func IsRepoEmpty(token, user, repo string) (bool, string, error) {
-	ctx := context.Background()
-	gh_client := getClient(token)
+func (s *GitHubStorage) IsRepoEmpty(ctx context.Context, user, repo string) (bool, string, error) {
+	gh_client := s.client
 
 	// Get repository details to find default branch
 	gh_repo, _, err := gh_client.Repositories.Get(ctx, user, repo)
@@ -290,3 +318,186 @@ func IsRepoEmpty(token, user, repo string) (bool, string, error) {
 	// If we successfully got commits, the repo is not empty
 	return false, defaultBranch, nil
 }
+
+// GetHead always looks the branch up, since commits are built on what it
+// returns, and pins the result for the reads that follow
+func (s *GitHubStorage) GetHead(ctx context.Context, user, repo, branch string) (string, error) {
+	head, _, err := s.resolveHead(ctx, user, repo, branch)
+	if err != nil {
+		return "", err
+	}
+	s.pinHead(ctx, user, repo, branch, head)
+	return head, nil
+}
+
+// CommitChanges lands all changes as a single commit through the Git Data API:
+// one tree built on the parent's tree, one commit and a non-forced ref update.
+func (s *GitHubStorage) CommitChanges(ctx context.Context, user, repo, branch, parent, message string, changes []FileChange) (string, error) {
+	defer s.unpinHeads(ctx, user, repo)
+	gh_client := s.client
+
+	branch, err := s.resolveBranch(ctx, user, repo, branch)
+	if err != nil {
+		return "", err
+	}
+
+	parentCommit, _, err := gh_client.Git.GetCommit(ctx, user, repo, parent)
+	if err != nil {
+		return "", err
+	}
+
+	entries := make([]*github.TreeEntry, 0, len(changes))
+	for _, change := range changes {
+		entry := &github.TreeEntry{
+			Path: github.String(change.Path),
+			Mode: github.String("100644"),
+			Type: github.String("blob"),
+		}
+		switch {
+		case change.Delete:
+			// A nil SHA and nil Content removes the path from the tree
+		case change.Body != nil:
+			sha, err := s.createBlobStream(ctx, user, repo, change.Body)
+			if err != nil {
+				return "", err
+			}
+			entry.SHA = github.String(sha)
+		case utf8.Valid(change.Content):
+			entry.Content = github.String(string(change.Content))
+		default:
+			// Binary content has to go through a blob first
+			blob, _, err := gh_client.Git.CreateBlob(ctx, user, repo, &github.Blob{
+				Content:  github.String(base64.StdEncoding.EncodeToString(change.Content)),
+				Encoding: github.String("base64"),
+			})
+			if err != nil {
+				return "", err
+			}
+			entry.SHA = blob.SHA
+		}
+		entries = append(entries, entry)
+	}
+
+	tree, _, err := gh_client.Git.CreateTree(ctx, user, repo, parentCommit.GetTree().GetSHA(), entries)
+	if err != nil {
+		return "", err
+	}
+
+	commit, _, err := gh_client.Git.CreateCommit(ctx, user, repo, &github.Commit{
+		Message: github.String(message),
+		Tree:    tree,
+		Parents: []*github.Commit{{SHA: github.String(parent)}},
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// Not forced: GitHub rejects the update if the branch is no longer at parent
+	_, res, err := gh_client.Git.UpdateRef(ctx, user, repo, &github.Reference{
+		Ref:    github.String("refs/heads/" + branch),
+		Object: &github.GitObject{SHA: commit.SHA},
+	}, false)
+	if err != nil {
+		if res != nil && res.StatusCode == http.StatusUnprocessableEntity {
+			return "", &BranchMovedError{Branch: branch}
+		}
+		return "", err
+	}
+
+	return commit.GetSHA(), nil
+}
+
+// maxComparedFiles is the number of files GitHub lists in a comparison
+// before truncating it.
+const maxComparedFiles = 300
+
+func (s *GitHubStorage) ChangedFiles(ctx context.Context, user, repo, base, head string) ([]string, error) {
+	comparison, _, err := s.client.Repositories.CompareCommits(ctx, user, repo, base, head, &github.ListOptions{PerPage: 100})
+	if err != nil {
+		return nil, err
+	}
+	if len(comparison.Files) >= maxComparedFiles {
+		return nil, fmt.Errorf("too many changes between %s and %s to compare", base, head)
+	}
+
+	paths := make([]string, 0, len(comparison.Files))
+	for _, file := range comparison.Files {
+		paths = append(paths, file.GetFilename())
+		if file.GetPreviousFilename() != "" {
+			paths = append(paths, file.GetPreviousFilename())
+		}
+	}
+	return paths, nil
+}
+
+// createBlobStream uploads body as a blob without holding it in memory. The
+// JSON request is written on the fly with the content base64-encoded as it is
+// read, which lets media up to GitHub's 100 MB blob limit through.
+func (s *GitHubStorage) createBlobStream(ctx context.Context, user, repo string, body io.Reader) (string, error) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	go func() {
+		_, err := io.WriteString(pw, `{"encoding":"base64","content":"`)
+		if err == nil {
+			encoder := base64.NewEncoder(base64.StdEncoding, pw)
+			if _, err = io.Copy(encoder, body); err == nil {
+				err = encoder.Close()
+			}
+		}
+		if err == nil {
+			_, err = io.WriteString(pw, `"}`)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	u, err := s.streamClient.BaseURL.Parse(fmt.Sprintf("repos/%s/%s/git/blobs", url.PathEscape(user), url.PathEscape(repo)))
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), pr)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", s.streamClient.UserAgent)
+
+	var blob github.Blob
+	if _, err := s.streamClient.Do(ctx, req, &blob); err != nil {
+		return "", err
+	}
+	return blob.GetSHA(), nil
+}
+
+func (s *GitHubStorage) ListBranches(ctx context.Context, user, repo string) ([]*Branch, error) {
+	branches := []*Branch{}
+	opts := &github.BranchListOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		page, res, err := s.client.Repositories.ListBranches(ctx, user, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, branch := range page {
+			branches = append(branches, &Branch{Name: branch.GetName(), Head: branch.GetCommit().GetSHA()})
+		}
+		if res.NextPage == 0 {
+			return branches, nil
+		}
+		opts.Page = res.NextPage
+	}
+}
+
+func (s *GitHubStorage) DeleteBranch(ctx context.Context, user, repo, branch string) error {
+	defer s.unpinHeads(ctx, user, repo)
+	_, err := s.client.Git.DeleteRef(ctx, user, repo, "refs/heads/"+branch)
+	return err
+}
+
+func (s *GitHubStorage) CommitTime(ctx context.Context, user, repo, sha string) (time.Time, error) {
+	commit, _, err := s.client.Git.GetCommit(ctx, user, repo, sha)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return commit.GetCommitter().GetDate().Time, nil
+}
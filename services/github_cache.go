@@ -0,0 +1,394 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v62/github"
+)
+
+// Reads from GitHub go through three caches:
+//
+//   - refs: the user's last response (and its ETag) for repository and branch
+//     lookups, revalidated with a conditional request. A 304 does not count
+//     against the rate limit. Under WithPinnedHeads a branch is only looked up
+//     once per request, otherwise on every call.
+//   - trees: the recursive tree of a commit, keyed by commit SHA
+//   - blobs: file contents keyed by blob SHA
+//
+// Commits and blobs are immutable, so the last two never go stale and only
+// need to be bounded in size; trees are weighed by their approximate memory
+// use, like blobs. All three are keyed by the user's token as well:
+// an entry was fetched with that token, so serving it again cannot leak a
+// repository the user has no access to.
+var (
+	refCache  = newLRUCache(10000)
+	treeCache = newLRUCache(32 << 20)
+	blobCache = newLRUCache(64 << 20)
+)
+
+// maxCachedBlobSize keeps single large media files out of the blob cache
+const maxCachedBlobSize = 1 << 20
+
+var commitSHARegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+type cachedResponse struct {
+	etag string
+	body json.RawMessage
+}
+
+// treeBlob is a file in a commit's tree
+type treeBlob struct {
+	sha  string
+	size int64
+}
+
+// repoTree maps the paths of a commit's tree to their blobs
+type repoTree struct {
+	blobs map[string]treeBlob
+	// truncated is set when GitHub could not return the whole tree, in which
+	// case missing paths must be looked up through the Contents API.
+	truncated bool
+}
+
+// treeEntryOverhead approximates what a map entry, its string headers and
+// the size take besides the path and SHA bytes
+const treeEntryOverhead = 64
+
+// size approximates the memory the tree takes, in bytes
+func (t *repoTree) size() int {
+	size := 0
+	for path, blob := range t.blobs {
+		size += len(path) + len(blob.sha) + treeEntryOverhead
+	}
+	return size
+}
+
+// tokenKey identifies a user's token in cache keys without storing the token
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// conditionalGet fetches a GitHub API URL, revalidating the user's previous
+// response with If-None-Match so unchanged resources cost no rate limit.
+func (s *GitHubStorage) conditionalGet(ctx context.Context, u string, v any) (*github.Response, error) {
+	key := s.tokenKey + ":" + u
+
+	req, err := s.client.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cached, hasCached := refCache.Get(key)
+	if hasCached {
+		req.Header.Set("If-None-Match", cached.(*cachedResponse).etag)
+	}
+
+	var body json.RawMessage
+	res, err := s.client.Do(ctx, req, &body)
+	if hasCached && res != nil && res.StatusCode == http.StatusNotModified {
+		return res, json.Unmarshal(cached.(*cachedResponse).body, v)
+	}
+	if err != nil {
+		return res, err
+	}
+
+	if etag := res.Header.Get("ETag"); etag != "" {
+		refCache.Add(key, &cachedResponse{etag: etag, body: body}, 1)
+	}
+	return res, json.Unmarshal(body, v)
+}
+
+// resolveBranch returns branch, or the repository's default branch when empty
+func (s *GitHubStorage) resolveBranch(ctx context.Context, user, repo, branch string) (string, error) {
+	if branch != "" {
+		return branch, nil
+	}
+
+	var gh_repo github.Repository
+	_, err := s.conditionalGet(ctx, fmt.Sprintf("repos/%s/%s", url.PathEscape(user), url.PathEscape(repo)), &gh_repo)
+	if err != nil {
+		return "", err
+	}
+	return gh_repo.GetDefaultBranch(), nil
+}
+
+// headPinsKey is the context key of a request's headPins
+type headPinsKey struct{}
+
+// headPins are the commits branches were resolved to during one request,
+// keyed by token, repository and branch as passed in ("" for the default)
+type headPins struct {
+	mu    sync.Mutex
+	heads map[string]string
+}
+
+// WithPinnedHeads returns a context under which each branch is resolved to a
+// commit once and then read at that commit, so a request sees one snapshot of
+// the repository and does not look the head up again for every file. Writes
+// through the backend drop the pins of the repository they change. It is
+// meant to span a single request.
+func WithPinnedHeads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, headPinsKey{}, &headPins{heads: map[string]string{}})
+}
+
+func (s *GitHubStorage) pinKey(user, repo, ref string) string {
+	return s.tokenKey + ":" + user + "/" + repo + ":" + ref
+}
+
+// pinnedHead returns the commit ctx pinned ref to, if any
+func (s *GitHubStorage) pinnedHead(ctx context.Context, user, repo, ref string) (string, bool) {
+	pins, ok := ctx.Value(headPinsKey{}).(*headPins)
+	if !ok {
+		return "", false
+	}
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+	head, ok := pins.heads[s.pinKey(user, repo, ref)]
+	return head, ok
+}
+
+func (s *GitHubStorage) pinHead(ctx context.Context, user, repo, ref, head string) {
+	if pins, ok := ctx.Value(headPinsKey{}).(*headPins); ok {
+		pins.mu.Lock()
+		defer pins.mu.Unlock()
+		pins.heads[s.pinKey(user, repo, ref)] = head
+	}
+}
+
+// unpinHeads drops the pins of a repository after a write moved its branches
+func (s *GitHubStorage) unpinHeads(ctx context.Context, user, repo string) {
+	if pins, ok := ctx.Value(headPinsKey{}).(*headPins); ok {
+		pins.mu.Lock()
+		defer pins.mu.Unlock()
+		prefix := s.pinKey(user, repo, "")
+		for key := range pins.heads {
+			if strings.HasPrefix(key, prefix) {
+				delete(pins.heads, key)
+			}
+		}
+	}
+}
+
+// resolveCommit turns a branch name (or "" for the default branch) into the
+// SHA of the commit it points at, pinned for the rest of the request. Commit
+// SHAs are returned unchanged.
+func (s *GitHubStorage) resolveCommit(ctx context.Context, user, repo, ref string) (string, *github.Response, error) {
+	if commitSHARegex.MatchString(ref) {
+		return ref, nil, nil
+	}
+	if head, ok := s.pinnedHead(ctx, user, repo, ref); ok {
+		return head, nil, nil
+	}
+
+	head, res, err := s.resolveHead(ctx, user, repo, ref)
+	if err != nil {
+		return "", res, err
+	}
+	s.pinHead(ctx, user, repo, ref, head)
+	return head, res, nil
+}
+
+// resolveHead looks up the commit a branch currently points at
+func (s *GitHubStorage) resolveHead(ctx context.Context, user, repo, ref string) (string, *github.Response, error) {
+	branch, err := s.resolveBranch(ctx, user, repo, ref)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var gh_ref github.Reference
+	res, err := s.conditionalGet(ctx, fmt.Sprintf("repos/%s/%s/git/ref/heads/%s", url.PathEscape(user), url.PathEscape(repo), branch), &gh_ref)
+	if err != nil {
+		return "", res, err
+	}
+	return gh_ref.GetObject().GetSHA(), res, nil
+}
+
+// getTree returns the recursive tree of a commit, cached by commit SHA
+func (s *GitHubStorage) getTree(ctx context.Context, user, repo, commitSHA string) (*repoTree, error) {
+	key := s.tokenKey + ":" + user + "/" + repo + ":" + commitSHA
+	if cached, ok := treeCache.Get(key); ok {
+		return cached.(*repoTree), nil
+	}
+
+	tree, _, err := s.client.Git.GetTree(ctx, user, repo, commitSHA, true)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &repoTree{
+		blobs:     make(map[string]treeBlob, len(tree.Entries)),
+		truncated: tree.GetTruncated(),
+	}
+	for _, entry := range tree.Entries {
+		if entry.GetType() == "blob" {
+			result.blobs[entry.GetPath()] = treeBlob{sha: entry.GetSHA(), size: int64(entry.GetSize())}
+		}
+	}
+
+	treeCache.Add(key, result, result.size())
+	return result, nil
+}
+
+// getBlob returns the contents of a blob, cached by blob SHA
+func (s *GitHubStorage) getBlob(ctx context.Context, user, repo, blobSHA string) ([]byte, error) {
+	key := s.tokenKey + ":" + user + "/" + repo + ":" + blobSHA
+	if cached, ok := blobCache.Get(key); ok {
+		return cached.([]byte), nil
+	}
+
+	content, _, err := s.client.Git.GetBlobRaw(ctx, user, repo, blobSHA)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) <= maxCachedBlobSize {
+		blobCache.Add(key, content, len(content))
+	}
+	return content, nil
+}
+
+// GetFileContents reads a file through the commit/tree/blob caches. The branch
+// head is resolved once per call, or once per request under WithPinnedHeads;
+// everything below it is served from cache when the same commit or blob has
+// been seen before.
+func (s *GitHubStorage) GetFileContents(ctx context.Context, user, repo, path string, branch ...string) (string, error) {
+	commitSHA, res, err := s.resolveCommit(ctx, user, repo, branchRef(branch))
+	if err != nil {
+		// Empty repositories have no refs at all
+		if res != nil && (res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusConflict) {
+			return "", &FileNotFoundError{}
+		}
+		return "", err
+	}
+
+	tree, err := s.getTree(ctx, user, repo, commitSHA)
+	if err != nil {
+		return "", err
+	}
+
+	blob, ok := tree.blobs[path]
+	if !ok {
+		if tree.truncated {
+			return s.getContents(ctx, user, repo, path, commitSHA)
+		}
+		return "", &FileNotFoundError{}
+	}
+
+	content, err := s.getBlob(ctx, user, repo, blob.sha)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// ListFiles lists a directory through the cached recursive tree, falling back
+// to walking the Contents API when GitHub truncated the tree.
+func (s *GitHubStorage) ListFiles(ctx context.Context, user, repo, dir, ref string) ([]string, error) {
+	commitSHA, _, err := s.resolveCommit(ctx, user, repo, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := s.getTree(ctx, user, repo, commitSHA)
+	if err != nil {
+		return nil, err
+	}
+	if tree.truncated {
+		return s.listContents(ctx, user, repo, dir, commitSHA)
+	}
+
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	paths := []string{}
+	for path := range tree.blobs {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (s *GitHubStorage) listContents(ctx context.Context, user, repo, dir, commitSHA string) ([]string, error) {
+	_, entries, res, err := s.client.Repositories.GetContents(ctx, user, repo, dir, &github.RepositoryContentGetOptions{Ref: commitSHA})
+	if err != nil {
+		if res != nil && res.StatusCode == http.StatusNotFound {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, entry := range entries {
+		switch entry.GetType() {
+		case "file":
+			paths = append(paths, entry.GetPath())
+		case "dir":
+			nested, err := s.listContents(ctx, user, repo, entry.GetPath(), commitSHA)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, nested...)
+		}
+	}
+	return paths, nil
+}
+
+// OpenFile streams a file through the Git blobs API, which unlike the Contents
+// API serves files up to GitHub's 100 MB limit.
+func (s *GitHubStorage) OpenFile(ctx context.Context, user, repo, path string, branch ...string) (io.ReadCloser, int64, error) {
+	commitSHA, res, err := s.resolveCommit(ctx, user, repo, branchRef(branch))
+	if err != nil {
+		if res != nil && (res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusConflict) {
+			return nil, 0, &FileNotFoundError{}
+		}
+		return nil, 0, err
+	}
+
+	tree, err := s.getTree(ctx, user, repo, commitSHA)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blob, ok := tree.blobs[path]
+	if !ok {
+		if !tree.truncated {
+			return nil, 0, &FileNotFoundError{}
+		}
+		// The Contents API still reports the SHA of files it will not inline
+		fileContent, _, res, err := s.client.Repositories.GetContents(ctx, user, repo, path, &github.RepositoryContentGetOptions{Ref: commitSHA})
+		if err != nil {
+			if res != nil && res.StatusCode == http.StatusNotFound {
+				return nil, 0, &FileNotFoundError{}
+			}
+			return nil, 0, err
+		}
+		if fileContent == nil {
+			return nil, 0, &FileNotFoundError{}
+		}
+		blob = treeBlob{sha: fileContent.GetSHA(), size: int64(fileContent.GetSize())}
+	}
+
+	req, err := s.client.NewRequest(http.MethodGet, fmt.Sprintf("repos/%s/%s/git/blobs/%s", url.PathEscape(user), url.PathEscape(repo), blob.sha), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3.raw")
+
+	res, err = s.streamClient.BareDo(ctx, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	return res.Body, blob.size, nil
+}
@@ -0,0 +1,249 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGitHub serves the read side of the GitHub API GitHubStorage uses, for a
+// single repository o/r that only the token "tok" can see
+type fakeGitHub struct {
+	*httptest.Server
+	mu sync.Mutex
+	// head is the commit main points at
+	head    string
+	commits map[string]map[string]string
+	blobs   map[string]string
+	// requests counts the requests per path, notModified the 304s among them
+	requests    map[string]int
+	notModified map[string]int
+}
+
+func newFakeGitHub(t *testing.T, files map[string]string) *fakeGitHub {
+	t.Helper()
+	f := &fakeGitHub{
+		commits:     map[string]map[string]string{},
+		blobs:       map[string]string{},
+		requests:    map[string]int{},
+		notModified: map[string]int{},
+	}
+	f.push(files)
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// push moves main to a new commit holding files, as another writer would
+func (f *fakeGitHub) push(files map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.head = fmt.Sprintf("%040x", len(f.commits)+1)
+	f.commits[f.head] = files
+	for _, content := range files {
+		f.blobs[blobSHA(content)] = content
+	}
+}
+
+func blobSHA(content string) string {
+	sum := sha1.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *fakeGitHub) storage(token string) *GitHubStorage {
+	s := NewGitHubStorage(token).(*GitHubStorage)
+	baseURL, _ := url.Parse(f.URL + "/")
+	s.client.BaseURL = baseURL
+	s.streamClient.BaseURL = baseURL
+	return s
+}
+
+func (f *fakeGitHub) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.URL.Path]++
+
+	if r.Header.Get("Authorization") != "Bearer tok" {
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+		return
+	}
+
+	// Responses to conditional requests carry an ETag of their body
+	writeJSON := func(v any) {
+		body, _ := json.Marshal(v)
+		etag := `"` + blobSHA(string(body)) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			f.notModified[r.URL.Path]++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+
+	switch path := r.URL.Path; {
+	case path == "/repos/o/r":
+		writeJSON(map[string]any{"default_branch": "main"})
+	case path == "/repos/o/r/git/ref/heads/main":
+		writeJSON(map[string]any{"ref": "refs/heads/main", "object": map[string]any{"sha": f.head}})
+	case strings.HasPrefix(path, "/repos/o/r/git/trees/"):
+		files, ok := f.commits[strings.TrimPrefix(path, "/repos/o/r/git/trees/")]
+		if !ok {
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		entries := []map[string]any{}
+		for name, content := range files {
+			entries = append(entries, map[string]any{"path": name, "type": "blob", "sha": blobSHA(content), "size": len(content)})
+		}
+		writeJSON(map[string]any{"tree": entries, "truncated": false})
+	case strings.HasPrefix(path, "/repos/o/r/git/blobs/"):
+		content, ok := f.blobs[strings.TrimPrefix(path, "/repos/o/r/git/blobs/")]
+		if !ok {
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(content))
+	default:
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	}
+}
+
+// count returns how often path was requested, and how many of those got a 304
+func (f *fakeGitHub) count(path string) (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path], f.notModified[path]
+}
+
+func TestGitHubStorageCachesReads(t *testing.T) {
+	ctx := t.Context()
+	f := newFakeGitHub(t, map[string]string{"a.json": "a", "b.json": "b"})
+	// A token of its own keeps other tests' cache entries out
+	s := f.storage("tok")
+	s.tokenKey = tokenKey(t.Name())
+
+	for _, path := range []string{"a.json", "a.json", "b.json"} {
+		if content, err := s.GetFileContents(ctx, "o", "r", path); err != nil || content != strings.TrimSuffix(path, ".json") {
+			t.Fatalf("GetFileContents(%s) = %q, %v", path, content, err)
+		}
+	}
+	if _, err := s.GetFileContents(ctx, "o", "r", "missing.json"); err == nil {
+		t.Error("GetFileContents of a missing file succeeded")
+	}
+
+	// The head is looked up on every call, but revalidated for free
+	if requests, notModified := f.count("/repos/o/r/git/ref/heads/main"); requests != 4 || notModified != 3 {
+		t.Errorf("ref requested %d times with %d 304s, want 4 with 3", requests, notModified)
+	}
+	if requests, _ := f.count("/repos/o/r/git/trees/" + f.head); requests != 1 {
+		t.Errorf("tree requested %d times, want 1", requests)
+	}
+	if requests, _ := f.count("/repos/o/r/git/blobs/" + blobSHA("a")); requests != 1 {
+		t.Errorf("blob of a.json requested %d times, want 1", requests)
+	}
+
+	// A new head is picked up by the next read
+	f.push(map[string]string{"a.json": "new"})
+	if content, _ := s.GetFileContents(ctx, "o", "r", "a.json"); content != "new" {
+		t.Errorf("a.json = %q after a push, want %q", content, "new")
+	}
+}
+
+func TestGitHubStoragePinsHeadsPerRequest(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"a.json": "old"})
+	s := f.storage("tok")
+	s.tokenKey = tokenKey(t.Name())
+	ctx := WithPinnedHeads(t.Context())
+
+	read := func() string {
+		t.Helper()
+		content, err := s.GetFileContents(ctx, "o", "r", "a.json")
+		if err != nil {
+			t.Fatalf("GetFileContents: %v", err)
+		}
+		return content
+	}
+
+	read()
+	f.push(map[string]string{"a.json": "new"})
+	if content := read(); content != "old" {
+		t.Errorf("a.json = %q after a push mid-request, want the pinned %q", content, "old")
+	}
+	if requests, _ := f.count("/repos/o/r/git/ref/heads/main"); requests != 1 {
+		t.Errorf("ref requested %d times, want 1", requests)
+	}
+
+	// Looking the head up for a commit moves the pin along
+	head, err := s.GetHead(ctx, "o", "r", "")
+	if err != nil || head != f.head {
+		t.Fatalf("GetHead = %s, %v; want %s", head, err, f.head)
+	}
+	if content := read(); content != "new" {
+		t.Errorf("a.json = %q after GetHead, want %q", content, "new")
+	}
+}
+
+func TestGitHubStorageCachesPerToken(t *testing.T) {
+	ctx := t.Context()
+	f := newFakeGitHub(t, map[string]string{"a.json": "secret"})
+	s := f.storage("tok")
+	s.tokenKey = tokenKey(t.Name())
+
+	if content, err := s.GetFileContents(ctx, "o", "r", "a.json", f.head); err != nil || content != "secret" {
+		t.Fatalf("GetFileContents = %q, %v", content, err)
+	}
+
+	// A commit SHA skips the ref lookup, so the cached tree must not answer
+	// for a token that cannot see the repository
+	other := f.storage("other")
+	if content, err := other.GetFileContents(ctx, "o", "r", "a.json", f.head); err == nil {
+		t.Errorf("GetFileContents with another token = %q, want an error", content)
+	}
+}
+
+func TestGitHubStorageWeighsCachedTrees(t *testing.T) {
+	ctx := t.Context()
+	previous := treeCache
+	treeCache = newLRUCache(4 << 10)
+	t.Cleanup(func() { treeCache = previous })
+
+	small := map[string]string{"a.json": "a"}
+	large := map[string]string{}
+	for i := range 100 {
+		large[fmt.Sprintf("data/posts/%d.json", i)] = "x"
+	}
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		// want is how often the tree is fetched for two reads
+		want int
+	}{
+		{name: "small tree", files: small, want: 1},
+		{name: "tree over the cache's size", files: large, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeGitHub(t, tt.files)
+			s := f.storage("tok")
+			s.tokenKey = tokenKey(t.Name())
+			for range 2 {
+				if _, err := s.ListFiles(ctx, "o", "r", "", f.head); err != nil {
+					t.Fatalf("ListFiles: %v", err)
+				}
+			}
+			if requests, _ := f.count("/repos/o/r/git/trees/" + f.head); requests != tt.want {
+				t.Errorf("tree requested %d times, want %d", requests, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,640 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	pathpkg "path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitLabStorage is the Storage backend that talks to a GitLab instance's REST
+// API on behalf of a single user. A repository's owner and name form the
+// project's path, so a project is addressed as <namespace>/<project>. Projects
+// in subgroups have longer paths, which do not fit; they are left out of the
+// repository list with a warning.
+type GitLabStorage struct {
+	baseURL string
+	token   string
+}
+
+// NewGitLabStorage returns a backend for the GitLab instance at baseURL (e.g.
+// https://gitlab.com) authenticated with the user's OAuth token.
+func NewGitLabStorage(baseURL, token string) *GitLabStorage {
+	initHTTPClients()
+	return &GitLabStorage{baseURL: strings.TrimSuffix(baseURL, "/") + "/api/v4", token: token}
+}
+
+// GitLabError is a non-2xx response from the GitLab API
+type GitLabError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *GitLabError) Error() string {
+	return fmt.Sprintf("gitlab api: %d %s", e.StatusCode, e.Message)
+}
+
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	Description       string `json:"description"`
+	Visibility        string `json:"visibility"`
+	DefaultBranch     string `json:"default_branch"`
+	EmptyRepo         bool   `json:"empty_repo"`
+}
+
+type gitlabCommit struct {
+	ID        string   `json:"id"`
+	ParentIDs []string `json:"parent_ids"`
+}
+
+type gitlabBranch struct {
+	Commit gitlabCommit `json:"commit"`
+}
+
+// escapePath encodes a project or file path as a single URL path segment,
+// which is how GitLab expects them.
+func escapePath(path string) string {
+	return strings.ReplaceAll(url.PathEscape(path), "/", "%2F")
+}
+
+func projectPath(user, repo string) string {
+	return "projects/" + escapePath(user+"/"+repo)
+}
+
+// request sends an API request. body may be a value to encode as JSON or an
+// io.Reader of JSON; non-2xx responses are returned as a *GitLabError.
+func (s *GitLabStorage) request(ctx context.Context, client *http.Client, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.baseURL+"/"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		var apiErr struct {
+			Message any    `json:"message"`
+			Error   string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&apiErr)
+		message := apiErr.Error
+		if apiErr.Message != nil {
+			message = fmt.Sprint(apiErr.Message)
+		}
+		return nil, &GitLabError{StatusCode: res.StatusCode, Message: message}
+	}
+	return res, nil
+}
+
+// do sends an API request and decodes the JSON response into v, if not nil
+func (s *GitLabStorage) do(ctx context.Context, method, path string, body, v any) (*http.Response, error) {
+	res, err := s.request(ctx, httpClient, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			return nil, fmt.Errorf("failed to parse gitlab response: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// isNotFound reports whether err is a 404 from the API
+func isNotFound(err error) bool {
+	var apiErr *GitLabError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+func (s *GitLabStorage) getProject(ctx context.Context, user, repo string) (*gitlabProject, error) {
+	var project gitlabProject
+	if _, err := s.do(ctx, http.MethodGet, projectPath(user, repo), nil, &project); err != nil {
+		return nil, err
+	}
+	return &project, nil
+}
+
+// resolveBranch turns an empty branch into the project's default branch
+func (s *GitLabStorage) resolveBranch(ctx context.Context, user, repo, branch string) (string, error) {
+	if branch != "" {
+		return branch, nil
+	}
+	project, err := s.getProject(ctx, user, repo)
+	if err != nil {
+		return "", err
+	}
+	if project.DefaultBranch == "" {
+		// Projects without commits have no default branch yet
+		return "main", nil
+	}
+	return project.DefaultBranch, nil
+}
+
+func (s *GitLabStorage) GetUser(ctx context.Context) (*User, error) {
+	var user struct {
+		Username  string `json:"username"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if _, err := s.do(ctx, http.MethodGet, "user", nil, &user); err != nil {
+		return nil, err
+	}
+	return &User{Login: user.Username, Name: user.Name, AvatarURL: user.AvatarURL}, nil
+}
+
+func (s *GitLabStorage) ListRepos(ctx context.Context) ([]*Repository, error) {
+	repos := []*Repository{}
+	for page := "1"; page != ""; {
+		var projects []gitlabProject
+		// Developer access (30) is the least that can push to a branch
+		res, err := s.do(ctx, http.MethodGet, "projects?membership=true&min_access_level=30&order_by=last_activity_at&per_page=100&page="+page, nil, &projects)
+		if err != nil {
+			return nil, err
+		}
+		for _, project := range projects {
+			// Repositories are addressed as /:owner/:repo, which projects in
+			// subgroups do not fit, so they cannot be opened in the CMS
+			if strings.Count(project.PathWithNamespace, "/") != 1 {
+				log.Printf("[WARN] Skipping GitLab project %s: projects in subgroups are not supported", project.PathWithNamespace)
+				continue
+			}
+			repos = append(repos, &Repository{
+				FullName:      project.PathWithNamespace,
+				Description:   project.Description,
+				Private:       project.Visibility != "public",
+				DefaultBranch: project.DefaultBranch,
+			})
+		}
+		page = res.Header.Get("X-Next-Page")
+	}
+	return repos, nil
+}
+
+// fileRef returns the ref to read files at, letting GitLab resolve HEAD to
+// the default branch instead of looking it up.
+func fileRef(branch []string) string {
+	if ref := branchRef(branch); ref != "" {
+		return ref
+	}
+	return "HEAD"
+}
+
+func (s *GitLabStorage) GetFileContents(ctx context.Context, user, repo, path string, branch ...string) (string, error) {
+	res, err := s.request(ctx, httpClient, http.MethodGet, fmt.Sprintf("%s/repository/files/%s/raw?ref=%s", projectPath(user, repo), escapePath(path), url.QueryEscape(fileRef(branch))), nil)
+	if err != nil {
+		if isNotFound(err) {
+			return "", &FileNotFoundError{}
+		}
+		return "", err
+	}
+	defer res.Body.Close()
+
+	content, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// gitlabFile is what GitLab tells about a file at a ref without sending it
+type gitlabFile struct {
+	BlobID string
+	Size   int64
+	// LastCommitID is the last commit up to the ref that changed the file
+	LastCommitID string
+}
+
+// fileHead looks a file up without downloading it
+func (s *GitLabStorage) fileHead(ctx context.Context, user, repo, path, ref string) (*gitlabFile, error) {
+	res, err := s.do(ctx, http.MethodHead, fmt.Sprintf("%s/repository/files/%s?ref=%s", projectPath(user, repo), escapePath(path), url.QueryEscape(ref)), nil, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, &FileNotFoundError{}
+		}
+		return nil, err
+	}
+	size, _ := strconv.ParseInt(res.Header.Get("X-Gitlab-Size"), 10, 64)
+	return &gitlabFile{
+		BlobID:       res.Header.Get("X-Gitlab-Blob-Id"),
+		Size:         size,
+		LastCommitID: res.Header.Get("X-Gitlab-Last-Commit-Id"),
+	}, nil
+}
+
+func (s *GitLabStorage) OpenFile(ctx context.Context, user, repo, path string, branch ...string) (io.ReadCloser, int64, error) {
+	file, err := s.fileHead(ctx, user, repo, path, fileRef(branch))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, err := s.request(ctx, streamHTTPClient, http.MethodGet, fmt.Sprintf("%s/repository/blobs/%s/raw", projectPath(user, repo), file.BlobID), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return res.Body, file.Size, nil
+}
+
+// commitFile lands a single change on the branch as it is now
+func (s *GitLabStorage) commitFile(ctx context.Context, user, repo, message string, change FileChange, branch []string) error {
+	branchName, err := s.resolveBranch(ctx, user, repo, branchRef(branch))
+	if err != nil {
+		return err
+	}
+	_, err = s.createCommit(ctx, user, repo, branchName, "", message, []FileChange{change})
+	return err
+}
+
+func (s *GitLabStorage) CreateOrUpdateFile(ctx context.Context, user, repo, path, message, content string, branch ...string) error {
+	return s.commitFile(ctx, user, repo, message, FileChange{Path: path, Content: []byte(content)}, branch)
+}
+
+func (s *GitLabStorage) DeleteFile(ctx context.Context, user, repo, path, message string, branch ...string) error {
+	return s.commitFile(ctx, user, repo, message, FileChange{Path: path, Delete: true}, branch)
+}
+
+func (s *GitLabStorage) UploadFile(ctx context.Context, user, repo, path, message string, content []byte, branch ...string) error {
+	return s.commitFile(ctx, user, repo, message, FileChange{Path: path, Content: content}, branch)
+}
+
+func (s *GitLabStorage) GetPagesConfig(ctx context.Context, user, repo string) (*PageConfig, error) {
+	var pages struct {
+		URL string `json:"url"`
+	}
+	if _, err := s.do(ctx, http.MethodGet, projectPath(user, repo)+"/pages", nil, &pages); err != nil {
+		// Projects without Pages, or users who may not see its settings, get a 404
+		if isNotFound(err) {
+			return &PageConfig{Initialized: false}, nil
+		}
+		return nil, err
+	}
+	return &PageConfig{Initialized: true, URL: pages.URL}, nil
+}
+
+func (s *GitLabStorage) CreateBranch(ctx context.Context, user, repo, newBranch string, srcBranch ...string) error {
+	src, err := s.resolveBranch(ctx, user, repo, branchRef(srcBranch))
+	if err != nil {
+		return err
+	}
+	_, err = s.do(ctx, http.MethodPost, fmt.Sprintf("%s/repository/branches?branch=%s&ref=%s", projectPath(user, repo), url.QueryEscape(newBranch), url.QueryEscape(src)), nil, nil)
+	return err
+}
+
+// mergeStatusPolls bounds how long MergeBranch waits for GitLab to work out
+// whether a merge request can be merged.
+const mergeStatusPolls = 10
+
+func (s *GitLabStorage) MergeBranch(ctx context.Context, user, repo, fromBranch, message string, toBranch ...string) error {
+	target, err := s.resolveBranch(ctx, user, repo, branchRef(toBranch))
+	if err != nil {
+		return err
+	}
+
+	// GitLab only merges through merge requests
+	var mr struct {
+		IID         int    `json:"iid"`
+		MergeStatus string `json:"merge_status"`
+	}
+	_, err = s.do(ctx, http.MethodPost, projectPath(user, repo)+"/merge_requests", map[string]any{
+		"source_branch":        fromBranch,
+		"target_branch":        target,
+		"title":                message,
+		"remove_source_branch": true,
+	}, &mr)
+	if err != nil {
+		return err
+	}
+
+	mrPath := fmt.Sprintf("%s/merge_requests/%d", projectPath(user, repo), mr.IID)
+	for poll := 0; (mr.MergeStatus == "unchecked" || mr.MergeStatus == "checking") && poll < mergeStatusPolls; poll++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryBaseDelay):
+		}
+		if _, err := s.do(ctx, http.MethodGet, mrPath, nil, &mr); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.do(ctx, http.MethodPut, mrPath+"/merge", map[string]any{
+		"merge_commit_message":        message,
+		"should_remove_source_branch": true,
+	}, nil)
+	return err
+}
+
+func (s *GitLabStorage) IsRepoEmpty(ctx context.Context, user, repo string) (bool, string, error) {
+	project, err := s.getProject(ctx, user, repo)
+	if err != nil {
+		return false, "", err
+	}
+	defaultBranch := project.DefaultBranch
+	if defaultBranch == "" {
+		defaultBranch = "main"
+	}
+	return project.EmptyRepo, defaultBranch, nil
+}
+
+func (s *GitLabStorage) GetHead(ctx context.Context, user, repo, branch string) (string, error) {
+	branchName, err := s.resolveBranch(ctx, user, repo, branch)
+	if err != nil {
+		return "", err
+	}
+	var b gitlabBranch
+	if _, err := s.do(ctx, http.MethodGet, fmt.Sprintf("%s/repository/branches/%s", projectPath(user, repo), escapePath(branchName)), nil, &b); err != nil {
+		return "", err
+	}
+	return b.Commit.ID, nil
+}
+
+// CommitChanges lands the changes through the commits API. GitLab cannot move
+// a branch only if it still points at a given commit, so the head is checked
+// right before committing, and every existing file is sent along with the
+// commit that last changed it as of parent. GitLab refuses to touch a file
+// changed since, so a push landing in between fails the commit instead of
+// being overwritten.
+//
+// That guard only covers the files written. A push landing between the head
+// check and the commit that changes only files the caller read still goes
+// unnoticed by GitLab; the new commit's parent is checked afterwards so this
+// is at least reported, although the commit has landed by then.
+func (s *GitLabStorage) CommitChanges(ctx context.Context, user, repo, branch, parent, message string, changes []FileChange) (string, error) {
+	branchName, err := s.resolveBranch(ctx, user, repo, branch)
+	if err != nil {
+		return "", err
+	}
+	head, err := s.GetHead(ctx, user, repo, branchName)
+	if err != nil {
+		return "", err
+	}
+	if head != parent {
+		return "", &BranchMovedError{Branch: branchName}
+	}
+	commit, err := s.createCommit(ctx, user, repo, branchName, parent, message, changes)
+	if isStaleFileError(err) {
+		return "", &BranchMovedError{Branch: branchName}
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(commit.ParentIDs) != 1 || commit.ParentIDs[0] != parent {
+		return "", fmt.Errorf("commit %s landed on %s on top of changes made after %s", commit.ID, branchName, parent)
+	}
+	return commit.ID, nil
+}
+
+// isStaleFileError reports whether GitLab refused a commit because one of its
+// files was created, changed or deleted after the commit it was based on
+func isStaleFileError(err error) bool {
+	var apiErr *GitLabError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	message := strings.ToLower(apiErr.Message)
+	return strings.Contains(message, "has changed since") ||
+		strings.Contains(message, "already exists") ||
+		strings.Contains(message, "doesn't exist")
+}
+
+// createCommit commits changes on top of the branch's current head. Files are
+// looked up as of parent if given, which GitLab then checks them against, and
+// as of the branch otherwise. The request is streamed so staged bodies are
+// base64-encoded as they are sent.
+func (s *GitLabStorage) createCommit(ctx context.Context, user, repo, branch, parent, message string, changes []FileChange) (*gitlabCommit, error) {
+	ref := branch
+	if parent != "" {
+		ref = parent
+	}
+
+	// The commits API has no upsert, so check which one each change is. One
+	// listing per directory covers all changes in it.
+	existing := map[string]bool{}
+	listed := map[string]bool{}
+	for _, change := range changes {
+		dir := pathpkg.Dir(change.Path)
+		if dir == "." {
+			dir = ""
+		}
+		if listed[dir] {
+			continue
+		}
+		listed[dir] = true
+		paths, err := s.listTree(ctx, user, repo, dir, ref, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			existing[path] = true
+		}
+	}
+
+	actions := make([]map[string]any, len(changes))
+	for i, change := range changes {
+		action := map[string]any{"file_path": change.Path, "action": "create"}
+		if existing[change.Path] {
+			action["action"] = "update"
+			if parent != "" {
+				file, err := s.fileHead(ctx, user, repo, change.Path, parent)
+				if err != nil {
+					return nil, err
+				}
+				action["last_commit_id"] = file.LastCommitID
+			}
+		}
+		if change.Delete {
+			action["action"] = "delete"
+		} else {
+			action["encoding"] = "base64"
+		}
+		actions[i] = action
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(writeCommitRequest(pw, branch, message, changes, actions))
+	}()
+
+	res, err := s.request(ctx, streamHTTPClient, http.MethodPost, projectPath(user, repo)+"/repository/commits", pr)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var commit gitlabCommit
+	if err := json.NewDecoder(res.Body).Decode(&commit); err != nil {
+		return nil, fmt.Errorf("failed to parse gitlab response: %w", err)
+	}
+	return &commit, nil
+}
+
+// writeCommitRequest writes the JSON body of a commits API request, adding
+// each file's content as base64 after the rest of its action.
+func writeCommitRequest(w io.Writer, branch, message string, changes []FileChange, actions []map[string]any) error {
+	header, err := json.Marshal(map[string]any{"branch": branch, "commit_message": message})
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, `%s,"actions":[`, header[:len(header)-1]); err != nil {
+		return err
+	}
+
+	for i, action := range actions {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		encoded, err := json.Marshal(action)
+		if err != nil {
+			return err
+		}
+		if changes[i].Delete {
+			if _, err := w.Write(encoded); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := fmt.Fprintf(w, `%s,"content":"`, encoded[:len(encoded)-1]); err != nil {
+			return err
+		}
+		var content io.Reader = bytes.NewReader(changes[i].Content)
+		if changes[i].Body != nil {
+			content = changes[i].Body
+		}
+		encoder := base64.NewEncoder(base64.StdEncoding, w)
+		if _, err := io.Copy(encoder, content); err != nil {
+			return err
+		}
+		if err := encoder.Close(); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, `"}`); err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(w, "]}")
+	return err
+}
+
+func (s *GitLabStorage) ChangedFiles(ctx context.Context, user, repo, base, head string) ([]string, error) {
+	var compare struct {
+		Diffs []struct {
+			OldPath string `json:"old_path"`
+			NewPath string `json:"new_path"`
+		} `json:"diffs"`
+	}
+	_, err := s.do(ctx, http.MethodGet, fmt.Sprintf("%s/repository/compare?from=%s&to=%s&straight=true", projectPath(user, repo), url.QueryEscape(base), url.QueryEscape(head)), nil, &compare)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var paths []string
+	for _, diff := range compare.Diffs {
+		for _, path := range []string{diff.OldPath, diff.NewPath} {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths, nil
+}
+
+func (s *GitLabStorage) ListFiles(ctx context.Context, user, repo, dir, ref string) ([]string, error) {
+	return s.listTree(ctx, user, repo, dir, ref, true)
+}
+
+// listTree returns the paths of the files in dir at ref, and in its
+// subdirectories if recursive is set
+func (s *GitLabStorage) listTree(ctx context.Context, user, repo, dir, ref string, recursive bool) ([]string, error) {
+	paths := []string{}
+	for page := "1"; page != ""; {
+		var batch []struct {
+			Path string `json:"path"`
+			Type string `json:"type"`
+		}
+		res, err := s.do(ctx, http.MethodGet, fmt.Sprintf("%s/repository/tree?path=%s&ref=%s&recursive=%t&per_page=100&page=%s", projectPath(user, repo), url.QueryEscape(strings.TrimSuffix(dir, "/")), url.QueryEscape(fileRef([]string{ref})), recursive, page), nil, &batch)
+		if err != nil {
+			if isNotFound(err) {
+				return []string{}, nil
+			}
+			return nil, err
+		}
+		for _, entry := range batch {
+			if entry.Type == "blob" {
+				paths = append(paths, entry.Path)
+			}
+		}
+		page = res.Header.Get("X-Next-Page")
+	}
+	return paths, nil
+}
+
+func (s *GitLabStorage) ListBranches(ctx context.Context, user, repo string) ([]*Branch, error) {
+	branches := []*Branch{}
+	for page := "1"; page != ""; {
+		var batch []struct {
+			Name   string       `json:"name"`
+			Commit gitlabCommit `json:"commit"`
+		}
+		res, err := s.do(ctx, http.MethodGet, fmt.Sprintf("%s/repository/branches?per_page=100&page=%s", projectPath(user, repo), page), nil, &batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, branch := range batch {
+			branches = append(branches, &Branch{Name: branch.Name, Head: branch.Commit.ID})
+		}
+		page = res.Header.Get("X-Next-Page")
+	}
+	return branches, nil
+}
+
+func (s *GitLabStorage) DeleteBranch(ctx context.Context, user, repo, branch string) error {
+	_, err := s.do(ctx, http.MethodDelete, fmt.Sprintf("%s/repository/branches/%s", projectPath(user, repo), escapePath(branch)), nil, nil)
+	return err
+}
+
+func (s *GitLabStorage) CommitTime(ctx context.Context, user, repo, sha string) (time.Time, error) {
+	var commit struct {
+		CommittedDate time.Time `json:"committed_date"`
+	}
+	if _, err := s.do(ctx, http.MethodGet, fmt.Sprintf("%s/repository/commits/%s", projectPath(user, repo), url.PathEscape(sha)), nil, &commit); err != nil {
+		return time.Time{}, err
+	}
+	return commit.CommittedDate, nil
+}
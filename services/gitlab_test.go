@@ -0,0 +1,412 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeGitLabCommit struct {
+	parent string
+	files  map[string][]byte
+}
+
+// fakeGitLab serves the part of the GitLab REST API GitLabStorage uses, for a
+// single project o/r
+type fakeGitLab struct {
+	*httptest.Server
+	mu       sync.Mutex
+	branches map[string]string
+	commits  map[string]*fakeGitLabCommit
+	seq      int
+	// projects is what the projects list returns, one page per element
+	projects [][]gitlabProject
+	// beforeCommit runs when a commit request arrives, before it is applied
+	beforeCommit func()
+	// actions records the actions of every commit request
+	actions [][]map[string]any
+	// requests records the method and path of every request
+	requests []string
+}
+
+func newFakeGitLab(t *testing.T, files map[string]string) *fakeGitLab {
+	t.Helper()
+	f := &fakeGitLab{branches: map[string]string{}, commits: map[string]*fakeGitLabCommit{}}
+	initial := map[string][]byte{}
+	for path, content := range files {
+		initial[path] = []byte(content)
+	}
+	f.branches["main"] = f.commit("", initial)
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeGitLab) storage() *GitLabStorage {
+	return NewGitLabStorage(f.URL, "tok")
+}
+
+// commit records a commit and returns its id
+func (f *fakeGitLab) commit(parent string, files map[string][]byte) string {
+	f.seq++
+	id := fmt.Sprintf("%040x", f.seq)
+	f.commits[id] = &fakeGitLabCommit{parent: parent, files: files}
+	return id
+}
+
+// push commits a change to main the way another client would
+func (f *fakeGitLab) push(path, content string) {
+	files := maps.Clone(f.commits[f.branches["main"]].files)
+	files[path] = []byte(content)
+	f.branches["main"] = f.commit(f.branches["main"], files)
+}
+
+func (f *fakeGitLab) resolve(ref string) (string, bool) {
+	if ref == "HEAD" {
+		ref = "main"
+	}
+	if id, ok := f.branches[ref]; ok {
+		return id, true
+	}
+	_, ok := f.commits[ref]
+	return ref, ok
+}
+
+// lastCommitFor returns the last commit up to id that changed path
+func (f *fakeGitLab) lastCommitFor(id, path string) string {
+	for {
+		commit := f.commits[id]
+		parent, ok := f.commits[commit.parent]
+		if !ok {
+			return id
+		}
+		old, existed := parent.files[path]
+		current, exists := commit.files[path]
+		if existed != exists || string(old) != string(current) {
+			return id
+		}
+		id = commit.parent
+	}
+}
+
+func (f *fakeGitLab) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reply := func(status int, v any) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	notFound := func() { reply(http.StatusNotFound, map[string]any{"message": "404 Not found"}) }
+
+	if r.Header.Get("Authorization") != "Bearer tok" {
+		reply(http.StatusUnauthorized, map[string]any{"message": "401 Unauthorized"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/v4/")
+	query := r.URL.Query()
+	f.requests = append(f.requests, r.Method+" "+path)
+	if path == "projects" {
+		page := 1
+		fmt.Sscan(query.Get("page"), &page)
+		if page < len(f.projects) {
+			w.Header().Set("X-Next-Page", fmt.Sprint(page+1))
+		}
+		reply(http.StatusOK, f.projects[page-1])
+		return
+	}
+	rest, ok := strings.CutPrefix(path, "projects/o%2Fr")
+	if !ok {
+		notFound()
+		return
+	}
+	segments := strings.Split(strings.TrimPrefix(rest, "/"), "/")
+
+	switch {
+	case rest == "":
+		reply(http.StatusOK, gitlabProject{PathWithNamespace: "o/r", DefaultBranch: "main"})
+
+	case segments[0] == "repository" && segments[1] == "files":
+		filePath, _ := url.PathUnescape(segments[2])
+		id, ok := f.resolve(query.Get("ref"))
+		content, exists := f.commits[id].files[filePath]
+		if !ok || !exists {
+			notFound()
+			return
+		}
+		w.Header().Set("X-Gitlab-Blob-Id", BlobSHA(content))
+		w.Header().Set("X-Gitlab-Size", fmt.Sprint(len(content)))
+		w.Header().Set("X-Gitlab-Last-Commit-Id", f.lastCommitFor(id, filePath))
+		if r.Method == http.MethodGet {
+			w.Write(content)
+		}
+
+	case segments[0] == "repository" && segments[1] == "blobs":
+		for _, commit := range f.commits {
+			for _, content := range commit.files {
+				if BlobSHA(content) == segments[2] {
+					w.Write(content)
+					return
+				}
+			}
+		}
+		notFound()
+
+	case segments[0] == "repository" && segments[1] == "branches" && len(segments) == 3:
+		name, _ := url.PathUnescape(segments[2])
+		id, ok := f.branches[name]
+		if !ok {
+			notFound()
+			return
+		}
+		reply(http.StatusOK, gitlabBranch{Commit: gitlabCommit{ID: id}})
+
+	case segments[0] == "repository" && segments[1] == "tree":
+		id, ok := f.resolve(query.Get("ref"))
+		if !ok {
+			notFound()
+			return
+		}
+		entries := []map[string]string{}
+		for filePath := range f.commits[id].files {
+			rest, ok := strings.CutPrefix(filePath, query.Get("path")+"/")
+			if query.Get("path") == "" {
+				rest, ok = filePath, true
+			}
+			if ok && (query.Get("recursive") == "true" || !strings.Contains(rest, "/")) {
+				entries = append(entries, map[string]string{"path": filePath, "type": "blob"})
+			}
+		}
+		reply(http.StatusOK, entries)
+
+	case segments[0] == "repository" && segments[1] == "commits" && r.Method == http.MethodPost:
+		var req struct {
+			Branch  string           `json:"branch"`
+			Actions []map[string]any `json:"actions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			reply(http.StatusBadRequest, map[string]any{"message": err.Error()})
+			return
+		}
+		f.actions = append(f.actions, req.Actions)
+		if f.beforeCommit != nil {
+			f.beforeCommit()
+			f.beforeCommit = nil
+		}
+
+		head := f.branches[req.Branch]
+		files := maps.Clone(f.commits[head].files)
+		for _, action := range req.Actions {
+			filePath := action["file_path"].(string)
+			_, exists := files[filePath]
+			switch {
+			case action["action"] == "create" && exists:
+				reply(http.StatusBadRequest, map[string]any{"message": "A file with this name already exists"})
+				return
+			case action["action"] != "create" && !exists:
+				reply(http.StatusBadRequest, map[string]any{"message": "A file with this name doesn't exist"})
+				return
+			case action["last_commit_id"] != nil && action["last_commit_id"] != f.lastCommitFor(head, filePath):
+				reply(http.StatusBadRequest, map[string]any{"message": "You are attempting to update a file that has changed since you started editing it."})
+				return
+			}
+			if action["action"] == "delete" {
+				delete(files, filePath)
+				continue
+			}
+			content, err := base64.StdEncoding.DecodeString(action["content"].(string))
+			if err != nil {
+				reply(http.StatusBadRequest, map[string]any{"message": err.Error()})
+				return
+			}
+			files[filePath] = content
+		}
+		id := f.commit(head, files)
+		f.branches[req.Branch] = id
+		reply(http.StatusCreated, gitlabCommit{ID: id, ParentIDs: []string{head}})
+
+	default:
+		notFound()
+	}
+}
+
+func TestGitLabStorageReadsFiles(t *testing.T) {
+	ctx := t.Context()
+	f := newFakeGitLab(t, map[string]string{"config/config.json": `{"site_name":"S"}`, "media/a b.png": "image"})
+	s := f.storage()
+
+	content, err := s.GetFileContents(ctx, "o", "r", "config/config.json")
+	if err != nil || content != `{"site_name":"S"}` {
+		t.Errorf("GetFileContents = %q, %v", content, err)
+	}
+
+	body, size, err := s.OpenFile(ctx, "o", "r", "media/a b.png")
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "image" || size != 5 {
+		t.Errorf("OpenFile = %q (size %d), want %q", data, size, "image")
+	}
+
+	var notFound *FileNotFoundError
+	if _, err := s.GetFileContents(ctx, "o", "r", "missing.json"); !errors.As(err, &notFound) {
+		t.Errorf("GetFileContents of missing file: got %v, want *FileNotFoundError", err)
+	}
+	if _, _, err := s.OpenFile(ctx, "o", "r", "missing.json"); !errors.As(err, &notFound) {
+		t.Errorf("OpenFile of missing file: got %v, want *FileNotFoundError", err)
+	}
+
+	var apiErr *GitLabError
+	if _, err := NewGitLabStorage(f.URL, "wrong").GetFileContents(ctx, "o", "r", "config/config.json"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GetFileContents with a bad token: got %v, want a 401 *GitLabError", err)
+	}
+}
+
+func TestGitLabStorageCommitChanges(t *testing.T) {
+	ctx := t.Context()
+	f := newFakeGitLab(t, map[string]string{"a": "1", "b": "2"})
+	s := f.storage()
+
+	parent, err := s.GetHead(ctx, "o", "r", "")
+	if err != nil {
+		t.Fatalf("GetHead: %v", err)
+	}
+	head, err := s.CommitChanges(ctx, "o", "r", "", parent, "change", []FileChange{
+		{Path: "a", Content: []byte("one")},
+		{Path: "b", Delete: true},
+		{Path: "c", Body: strings.NewReader("three")},
+	})
+	if err != nil {
+		t.Fatalf("CommitChanges: %v", err)
+	}
+	if head != f.branches["main"] {
+		t.Errorf("CommitChanges returned %s, branch is at %s", head, f.branches["main"])
+	}
+
+	files := f.commits[head].files
+	if string(files["a"]) != "one" || string(files["c"]) != "three" || files["b"] != nil {
+		t.Errorf("files after commit = %q", files)
+	}
+
+	// Existing files are sent with the commit they were last changed in, and
+	// only they are looked up one by one
+	actions := f.actions[len(f.actions)-1]
+	want := map[string][2]string{"a": {"update", parent}, "b": {"delete", parent}, "c": {"create", ""}}
+	for _, action := range actions {
+		path := action["file_path"].(string)
+		lastCommit, _ := action["last_commit_id"].(string)
+		if got := [2]string{action["action"].(string), lastCommit}; got != want[path] {
+			t.Errorf("action for %s = %v, want %v", path, got, want[path])
+		}
+	}
+	for _, request := range f.requests {
+		if strings.HasSuffix(request, "/repository/files/c") {
+			t.Errorf("CommitChanges looked up the new file: %s", request)
+		}
+	}
+}
+
+func TestGitLabStorageCommitChangesDetectsMovedBranch(t *testing.T) {
+	tests := []struct {
+		name string
+		// push is the file another client changes, and whether it does so
+		// after the head check, while the commit request is in flight
+		push     string
+		inFlight bool
+	}{
+		{name: "before the head check", push: "a"},
+		{name: "changed file while committing", push: "a", inFlight: true},
+		{name: "created file while committing", push: "c", inFlight: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			f := newFakeGitLab(t, map[string]string{"a": "1"})
+			s := f.storage()
+			parent, _ := s.GetHead(ctx, "o", "r", "")
+
+			push := func() { f.push(tt.push, "outside") }
+			if tt.inFlight {
+				f.beforeCommit = push
+			} else {
+				push()
+			}
+
+			_, err := s.CommitChanges(ctx, "o", "r", "", parent, "change", []FileChange{
+				{Path: "a", Content: []byte("mine")},
+				{Path: "c", Content: []byte("mine")},
+			})
+			var moved *BranchMovedError
+			if !errors.As(err, &moved) {
+				t.Fatalf("CommitChanges: got %v, want *BranchMovedError", err)
+			}
+			if content := f.commits[f.branches["main"]].files[tt.push]; string(content) != "outside" {
+				t.Errorf("the other client's change to %s was overwritten with %q", tt.push, content)
+			}
+		})
+	}
+}
+
+func TestGitLabStorageCommitChangesReportsUnguardedPush(t *testing.T) {
+	ctx := t.Context()
+	f := newFakeGitLab(t, map[string]string{"a": "1", "b": "2"})
+	s := f.storage()
+	parent, _ := s.GetHead(ctx, "o", "r", "")
+
+	// A push to a file the commit does not write lands between the head check
+	// and the commit; GitLab applies the commit on top of it
+	f.beforeCommit = func() { f.push("b", "outside") }
+	_, err := s.CommitChanges(ctx, "o", "r", "", parent, "change", []FileChange{{Path: "a", Content: []byte("mine")}})
+	if err == nil || errors.As(err, new(*BranchMovedError)) {
+		t.Fatalf("CommitChanges: got %v, want an error about the commit's parent", err)
+	}
+	files := f.commits[f.branches["main"]].files
+	if string(files["a"]) != "mine" || string(files["b"]) != "outside" {
+		t.Errorf("files after commit = %q", files)
+	}
+	if len(f.actions) != 1 {
+		t.Errorf("%d commit requests, want 1", len(f.actions))
+	}
+}
+
+func TestGitLabStorageListRepos(t *testing.T) {
+	f := newFakeGitLab(t, nil)
+	f.projects = [][]gitlabProject{
+		{
+			{PathWithNamespace: "o/r", Visibility: "private", DefaultBranch: "main"},
+			{PathWithNamespace: "group/sub/project", Visibility: "public"},
+		},
+		{
+			{PathWithNamespace: "o/site", Visibility: "public", DefaultBranch: "pages"},
+		},
+	}
+
+	repos, err := f.storage().ListRepos(t.Context())
+	if err != nil {
+		t.Fatalf("ListRepos: %v", err)
+	}
+	var names []string
+	for _, repo := range repos {
+		names = append(names, repo.FullName)
+	}
+	if !slices.Equal(names, []string{"o/r", "o/site"}) {
+		t.Errorf("ListRepos = %v, want [o/r o/site]", names)
+	}
+	if !repos[0].Private || repos[1].Private || repos[1].DefaultBranch != "pages" {
+		t.Errorf("ListRepos details = %+v, %+v", *repos[0], *repos[1])
+	}
+}
@@ -0,0 +1,217 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tempBranchRegex matches the random (version 4) uuid-named branches earlier
+// versions of the CMS created for every operation and merged into the default
+// branch afterwards. Operations that failed halfway left them behind.
+var tempBranchRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// tempBranchDirs are the directories those versions wrote to, always at the
+// repository root. A branch changing anything else is not one of theirs.
+var tempBranchDirs = []string{"config/", "data/", "media/"}
+
+// StaleBranch is a temporary CMS branch that has not moved in a while
+type StaleBranch struct {
+	Name      string    `json:"name"`
+	Head      string    `json:"head"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CleanupResult reports what a cleanup deleted and what it could not
+type CleanupResult struct {
+	Deleted []StaleBranch    `json:"deleted"`
+	Failed  []CleanupFailure `json:"failed"`
+}
+
+type CleanupFailure struct {
+	Branch string `json:"branch"`
+	Error  string `json:"error"`
+}
+
+// FindStaleBranches lists the temporary CMS branches whose last commit is
+// older than olderThan. The default and content branches are never reported,
+// and repositories without a CMS config have no temporary branches.
+func FindStaleBranches(ctx context.Context, token, owner, repo string, olderThan time.Duration) ([]StaleBranch, error) {
+	storage := storageFor(token)
+
+	stale := []StaleBranch{}
+	if _, err := GetRepoConfig(ctx, token, owner, repo); err != nil {
+		var notFound *FileNotFoundError
+		if errors.As(err, &notFound) {
+			return stale, nil
+		}
+		return nil, err
+	}
+
+	_, defaultBranch, err := storage.IsRepoEmpty(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	defaultHead, err := storage.GetHead(ctx, owner, repo, defaultBranch)
+	if err != nil {
+		return nil, err
+	}
+	contentBranch, err := ContentBranch(ctx, token, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	branches, err := storage.ListBranches(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, branch := range branches {
+		if branch.Name == defaultBranch || branch.Name == contentBranch || !tempBranchRegex.MatchString(branch.Name) {
+			continue
+		}
+		updatedAt, err := storage.CommitTime(ctx, owner, repo, branch.Head)
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(updatedAt) < olderThan {
+			continue
+		}
+		ours, err := onlyChangesTempBranchDirs(ctx, storage, owner, repo, defaultHead, branch.Head)
+		if err != nil {
+			return nil, err
+		}
+		if ours {
+			stale = append(stale, StaleBranch{Name: branch.Name, Head: branch.Head, UpdatedAt: updatedAt})
+		}
+	}
+	return stale, nil
+}
+
+// onlyChangesTempBranchDirs reports whether a branch differs from the default
+// branch in CMS content only. Backends that compare the two heads directly
+// also count what changed on the default branch since, which only ever keeps
+// a branch that could have gone.
+func onlyChangesTempBranchDirs(ctx context.Context, storage Storage, owner, repo, base, head string) (bool, error) {
+	paths, err := storage.ChangedFiles(ctx, owner, repo, base, head)
+	if err != nil {
+		return false, err
+	}
+	for _, path := range paths {
+		if !slices.ContainsFunc(tempBranchDirs, func(dir string) bool { return strings.HasPrefix(path, dir) }) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// CleanupStaleBranches deletes the branches FindStaleBranches reports. A
+// branch that cannot be deleted does not stop the others from being removed.
+func CleanupStaleBranches(ctx context.Context, token, owner, repo string, olderThan time.Duration) (*CleanupResult, error) {
+	stale, err := FindStaleBranches(ctx, token, owner, repo, olderThan)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := storageFor(token)
+	result := &CleanupResult{Deleted: []StaleBranch{}, Failed: []CleanupFailure{}}
+	for _, branch := range stale {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if err := storage.DeleteBranch(ctx, owner, repo, branch.Name); err != nil {
+			result.Failed = append(result.Failed, CleanupFailure{Branch: branch.Name, Error: err.Error()})
+			continue
+		}
+		result.Deleted = append(result.Deleted, branch)
+	}
+	return result, nil
+}
+
+type trackedRepo struct {
+	owner    string
+	repo     string
+	token    string
+	lastSeen time.Time
+}
+
+var (
+	trackedReposMu sync.Mutex
+	// trackedRepos holds the repositories used since the last sweep, keyed by
+	// owner/repo, along with the last token that opened them. Each is dropped,
+	// token and all, once it has been swept.
+	trackedRepos = map[string]*trackedRepo{}
+)
+
+// TrackRepo records that a repository was just used with the given token, so
+// the background sweeper cleans it up the next time it runs.
+func TrackRepo(token, owner, repo string) {
+	trackedReposMu.Lock()
+	defer trackedReposMu.Unlock()
+
+	trackedRepos[strings.ToLower(owner+"/"+repo)] = &trackedRepo{
+		owner:    owner,
+		repo:     repo,
+		token:    token,
+		lastSeen: time.Now(),
+	}
+}
+
+// StartJanitor removes stale temporary branches from the repositories used
+// since its last run once per interval until ctx is done.
+func StartJanitor(ctx context.Context, interval, olderThan time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sweepRepos(ctx, olderThan)
+			}
+		}
+	}()
+}
+
+func sweepRepos(ctx context.Context, olderThan time.Duration) {
+	trackedReposMu.Lock()
+	repos := make([]trackedRepo, 0, len(trackedRepos))
+	for _, tracked := range trackedRepos {
+		repos = append(repos, *tracked)
+	}
+	trackedReposMu.Unlock()
+
+	for _, tracked := range repos {
+		if ctx.Err() != nil {
+			return
+		}
+		result, err := CleanupStaleBranches(ctx, tracked.token, tracked.owner, tracked.repo, olderThan)
+		untrackRepo(tracked)
+		if err != nil {
+			log.Printf("[WARN] Branch cleanup of %s/%s failed: %v", tracked.owner, tracked.repo, err)
+			continue
+		}
+		for _, failure := range result.Failed {
+			log.Printf("[WARN] Could not delete branch %s of %s/%s: %s", failure.Branch, tracked.owner, tracked.repo, failure.Error)
+		}
+		if len(result.Deleted) > 0 {
+			log.Printf("Deleted %d stale branches from %s/%s", len(result.Deleted), tracked.owner, tracked.repo)
+		}
+	}
+}
+
+// untrackRepo forgets a swept repository unless it was used again meanwhile
+func untrackRepo(swept trackedRepo) {
+	trackedReposMu.Lock()
+	defer trackedReposMu.Unlock()
+
+	key := strings.ToLower(swept.owner + "/" + swept.repo)
+	if tracked, ok := trackedRepos[key]; ok && !tracked.lastSeen.After(swept.lastSeen) {
+		delete(trackedRepos, key)
+	}
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+const (
+	defaultUUID = "0b8f7c1e-2d3a-4f5b-9c6d-7e8f9a0b1c2d"
+	contentUUID = "1c9a8d2f-3e4b-4a6c-8d7e-8f9a0b1c2d3e"
+	staleUUID   = "2da9be3a-4f5c-4b7d-9e8f-9a0b1c2d3e4f"
+	freshUUID   = "3ebacf4b-5a6d-4c8e-af9a-0b1c2d3e4f5a"
+	foreignUUID = "4fcbda5c-6b7e-4d9f-8a0b-1c2d3e4f5a6b"
+	// v1UUID is a time-based uuid, which the CMS never used for branches
+	v1UUID = "5adceb6d-7c8f-1e0a-9b1c-2d3e4f5a6b7c"
+)
+
+// newJanitorRepo returns a CMS repository whose default and content branches
+// are uuid-named, with one branch per kind the janitor must tell apart. Every
+// commit is a day old except the head of freshUUID.
+func newJanitorRepo(t *testing.T) *MemoryStorage {
+	t.Helper()
+	ctx := t.Context()
+	s := NewMemoryStorage()
+	s.CreateRepo("o", "r", defaultUUID)
+	head, err := s.CommitChanges(ctx, "o", "r", "", "", "initial", []FileChange{
+		{Path: RepoSettingsPath, Content: []byte(`{"content_branch":"` + contentUUID + `"}`)},
+		{Path: "config/config.json", Content: []byte(`{"site_name":"S"}`)},
+	})
+	if err != nil {
+		t.Fatalf("initial commit: %v", err)
+	}
+
+	branches := map[string]string{
+		contentUUID: "data/posts/1.json",
+		staleUUID:   "data/posts/2.json",
+		freshUUID:   "media/a.png",
+		foreignUUID: "src/main.go",
+		v1UUID:      "data/posts/3.json",
+		"feature":   "data/posts/4.json",
+	}
+	for branch, path := range branches {
+		if err := s.CreateBranch(ctx, "o", "r", branch); err != nil {
+			t.Fatalf("CreateBranch: %v", err)
+		}
+		if _, err := s.CommitChanges(ctx, "o", "r", branch, head, "change", []FileChange{{Path: path, Content: []byte("x")}}); err != nil {
+			t.Fatalf("CommitChanges on %s: %v", branch, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.repos["o/r"]
+	for sha := range r.times {
+		if sha != r.branches[freshUUID] {
+			r.times[sha] = time.Now().Add(-24 * time.Hour)
+		}
+	}
+	return s
+}
+
+func TestFindStaleBranches(t *testing.T) {
+	tests := []struct {
+		name      string
+		olderThan time.Duration
+		want      []string
+	}{
+		{name: "older than an hour", olderThan: time.Hour, want: []string{staleUUID}},
+		{name: "any age", olderThan: 0, want: []string{staleUUID, freshUUID}},
+		{name: "older than two days", olderThan: 48 * time.Hour, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useStorage(t, newJanitorRepo(t))
+			stale, err := FindStaleBranches(t.Context(), "", "o", "r", tt.olderThan)
+			if err != nil {
+				t.Fatalf("FindStaleBranches: %v", err)
+			}
+			names := []string{}
+			for _, branch := range stale {
+				names = append(names, branch.Name)
+			}
+			slices.Sort(names)
+			slices.Sort(tt.want)
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("FindStaleBranches = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindStaleBranchesIgnoresReposWithoutConfig(t *testing.T) {
+	s := newMemoryRepo(t, nil)
+	if err := s.CreateBranch(t.Context(), "o", "r", staleUUID); err != nil {
+		t.Fatalf("CreateBranch: %v", err)
+	}
+	useStorage(t, s)
+
+	stale, err := FindStaleBranches(t.Context(), "", "o", "r", 0)
+	if err != nil || len(stale) != 0 {
+		t.Errorf("FindStaleBranches = %v, %v; want none", stale, err)
+	}
+}
+
+func TestCleanupStaleBranches(t *testing.T) {
+	ctx := t.Context()
+	s := newJanitorRepo(t)
+	useStorage(t, s)
+
+	result, err := CleanupStaleBranches(ctx, "", "o", "r", 0)
+	if err != nil {
+		t.Fatalf("CleanupStaleBranches: %v", err)
+	}
+	if len(result.Deleted) != 2 || len(result.Failed) != 0 {
+		t.Errorf("CleanupStaleBranches = %+v, want %s and %s deleted", result, staleUUID, freshUUID)
+	}
+
+	branches, _ := s.ListBranches(ctx, "o", "r")
+	names := []string{}
+	for _, branch := range branches {
+		names = append(names, branch.Name)
+	}
+	want := []string{defaultUUID, contentUUID, foreignUUID, v1UUID, "feature"}
+	slices.Sort(want)
+	if !slices.Equal(names, want) {
+		t.Errorf("branches left = %v, want %v", names, want)
+	}
+}
+
+func TestSweepReposUntracksSweptRepos(t *testing.T) {
+	trackedReposMu.Lock()
+	previous := trackedRepos
+	trackedRepos = map[string]*trackedRepo{}
+	trackedReposMu.Unlock()
+	t.Cleanup(func() {
+		trackedReposMu.Lock()
+		trackedRepos = previous
+		trackedReposMu.Unlock()
+	})
+
+	s := newJanitorRepo(t)
+	useStorage(t, s)
+	TrackRepo("token", "o", "r")
+
+	sweepRepos(t.Context(), time.Hour)
+	if len(trackedRepos) != 0 {
+		t.Errorf("tracked after the sweep: %v", trackedRepos)
+	}
+	if _, err := s.GetHead(t.Context(), "o", "r", staleUUID); err == nil {
+		t.Errorf("stale branch %s survived the sweep", staleUUID)
+	}
+
+	// A repository used again while it was being swept stays tracked
+	TrackRepo("token", "o", "r")
+	swept := *trackedRepos["o/r"]
+	time.Sleep(time.Millisecond)
+	TrackRepo("token2", "o", "r")
+	untrackRepo(swept)
+	if tracked, ok := trackedRepos["o/r"]; !ok || tracked.token != "token2" {
+		t.Errorf("repository used during the sweep was untracked")
+	}
+}
@@ -0,0 +1,454 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONSchema is a compiled JSON Schema. It understands the subset of draft
+// 2020-12 that is useful for describing settings without references:
+//
+//   - type, enum, const
+//   - properties, required, additionalProperties, minProperties, maxProperties
+//   - items, prefixItems, minItems, maxItems, uniqueItems
+//   - minLength, maxLength, pattern (RE2 syntax)
+//   - minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf
+//   - allOf, anyOf, oneOf, not
+//
+// Other keywords, such as title, description and format, are ignored.
+type JSONSchema struct {
+	// always is set for the boolean schemas true and false
+	always *bool
+
+	types    []string
+	enum     []any
+	constant any
+	hasConst bool
+
+	properties           map[string]*JSONSchema
+	required             []string
+	additionalProperties *JSONSchema
+	minProperties        *int
+	maxProperties        *int
+
+	items       *JSONSchema
+	prefixItems []*JSONSchema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	allOf []*JSONSchema
+	anyOf []*JSONSchema
+	oneOf []*JSONSchema
+	not   *JSONSchema
+}
+
+// SchemaError is a value that does not satisfy a schema. Pointer is the JSON
+// pointer (RFC 6901) of the offending part of the value, "" for the whole.
+type SchemaError struct {
+	Pointer string
+	Message string
+}
+
+func (e SchemaError) Error() string {
+	if e.Pointer == "" {
+		return e.Message
+	}
+	return e.Pointer + ": " + e.Message
+}
+
+var jsonSchemaTypes = []string{"array", "boolean", "integer", "null", "number", "object", "string"}
+
+// CompileJSONSchema checks a schema and prepares it for validation. The error
+// names the JSON pointer of the first invalid keyword.
+func CompileJSONSchema(schema any) (*JSONSchema, error) {
+	return compileJSONSchema(schema, "")
+}
+
+func compileJSONSchema(schema any, pointer string) (*JSONSchema, error) {
+	switch s := schema.(type) {
+	case bool:
+		return &JSONSchema{always: &s}, nil
+	case map[string]any:
+		return compileJSONSchemaObject(s, pointer)
+	}
+	return nil, fmt.Errorf("%s must be an object or a boolean", pointerOrRoot(pointer))
+}
+
+func compileJSONSchemaObject(s map[string]any, pointer string) (*JSONSchema, error) {
+	compiled := &JSONSchema{}
+	invalid := func(keyword, expected string) error {
+		return fmt.Errorf("%s must be %s", pointerOrRoot(pointer+"/"+keyword), expected)
+	}
+
+	if raw, ok := s["type"]; ok {
+		switch t := raw.(type) {
+		case string:
+			compiled.types = []string{t}
+		case []any:
+			for _, item := range t {
+				name, ok := item.(string)
+				if !ok {
+					return nil, invalid("type", "a type name or an array of them")
+				}
+				compiled.types = append(compiled.types, name)
+			}
+		default:
+			return nil, invalid("type", "a type name or an array of them")
+		}
+		for _, t := range compiled.types {
+			if !slices.Contains(jsonSchemaTypes, t) {
+				return nil, invalid("type", "one of "+strings.Join(jsonSchemaTypes, ", "))
+			}
+		}
+	}
+
+	if raw, ok := s["enum"]; ok {
+		values, ok := raw.([]any)
+		if !ok {
+			return nil, invalid("enum", "an array")
+		}
+		compiled.enum = values
+	}
+	if raw, ok := s["const"]; ok {
+		compiled.constant, compiled.hasConst = raw, true
+	}
+
+	if raw, ok := s["properties"]; ok {
+		properties, ok := raw.(map[string]any)
+		if !ok {
+			return nil, invalid("properties", "an object")
+		}
+		compiled.properties = make(map[string]*JSONSchema, len(properties))
+		// Sorted, so an invalid schema always reports the same problem
+		names := make([]string, 0, len(properties))
+		for name := range properties {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			property, err := compileJSONSchema(properties[name], pointer+"/properties/"+escapeJSONPointer(name))
+			if err != nil {
+				return nil, err
+			}
+			compiled.properties[name] = property
+		}
+	}
+	if raw, ok := s["required"]; ok {
+		names, ok := raw.([]any)
+		if !ok {
+			return nil, invalid("required", "an array of property names")
+		}
+		for _, item := range names {
+			name, ok := item.(string)
+			if !ok {
+				return nil, invalid("required", "an array of property names")
+			}
+			compiled.required = append(compiled.required, name)
+		}
+	}
+
+	var err error
+	subschema := func(keyword string) (*JSONSchema, error) {
+		raw, ok := s[keyword]
+		if !ok {
+			return nil, nil
+		}
+		return compileJSONSchema(raw, pointer+"/"+keyword)
+	}
+	if compiled.additionalProperties, err = subschema("additionalProperties"); err != nil {
+		return nil, err
+	}
+	if compiled.items, err = subschema("items"); err != nil {
+		return nil, err
+	}
+	if compiled.not, err = subschema("not"); err != nil {
+		return nil, err
+	}
+
+	subschemas := func(keyword string) ([]*JSONSchema, error) {
+		raw, ok := s[keyword]
+		if !ok {
+			return nil, nil
+		}
+		items, ok := raw.([]any)
+		if !ok || len(items) == 0 {
+			return nil, invalid(keyword, "a non-empty array of schemas")
+		}
+		list := make([]*JSONSchema, len(items))
+		for i, item := range items {
+			if list[i], err = compileJSONSchema(item, fmt.Sprintf("%s/%s/%d", pointer, keyword, i)); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	if compiled.prefixItems, err = subschemas("prefixItems"); err != nil {
+		return nil, err
+	}
+	if compiled.allOf, err = subschemas("allOf"); err != nil {
+		return nil, err
+	}
+	if compiled.anyOf, err = subschemas("anyOf"); err != nil {
+		return nil, err
+	}
+	if compiled.oneOf, err = subschemas("oneOf"); err != nil {
+		return nil, err
+	}
+
+	count := func(keyword string) (*int, error) {
+		raw, ok := s[keyword]
+		if !ok {
+			return nil, nil
+		}
+		n, ok := raw.(float64)
+		if !ok || n < 0 || n != math.Trunc(n) {
+			return nil, invalid(keyword, "a non-negative integer")
+		}
+		i := int(n)
+		return &i, nil
+	}
+	for keyword, target := range map[string]**int{
+		"minProperties": &compiled.minProperties,
+		"maxProperties": &compiled.maxProperties,
+		"minItems":      &compiled.minItems,
+		"maxItems":      &compiled.maxItems,
+		"minLength":     &compiled.minLength,
+		"maxLength":     &compiled.maxLength,
+	} {
+		if *target, err = count(keyword); err != nil {
+			return nil, err
+		}
+	}
+
+	for keyword, target := range map[string]**float64{
+		"minimum":          &compiled.minimum,
+		"maximum":          &compiled.maximum,
+		"exclusiveMinimum": &compiled.exclusiveMinimum,
+		"exclusiveMaximum": &compiled.exclusiveMaximum,
+		"multipleOf":       &compiled.multipleOf,
+	} {
+		raw, ok := s[keyword]
+		if !ok {
+			continue
+		}
+		n, ok := raw.(float64)
+		if !ok {
+			return nil, invalid(keyword, "a number")
+		}
+		*target = &n
+	}
+	if compiled.multipleOf != nil && *compiled.multipleOf <= 0 {
+		return nil, invalid("multipleOf", "greater than 0")
+	}
+
+	if raw, ok := s["uniqueItems"]; ok {
+		unique, ok := raw.(bool)
+		if !ok {
+			return nil, invalid("uniqueItems", "a boolean")
+		}
+		compiled.uniqueItems = unique
+	}
+
+	if raw, ok := s["pattern"]; ok {
+		pattern, ok := raw.(string)
+		if !ok {
+			return nil, invalid("pattern", "a string")
+		}
+		if compiled.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, invalid("pattern", "a valid regular expression")
+		}
+	}
+
+	return compiled, nil
+}
+
+// Validate checks a decoded JSON value against the schema and returns every
+// problem found, ordered by pointer
+func (s *JSONSchema) Validate(value any) []SchemaError {
+	errs := s.validate(value, "")
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Pointer < errs[j].Pointer
+	})
+	return errs
+}
+
+func (s *JSONSchema) validate(value any, pointer string) []SchemaError {
+	if s.always != nil {
+		if *s.always {
+			return nil
+		}
+		return []SchemaError{{Pointer: pointer, Message: "is not allowed"}}
+	}
+
+	var errs []SchemaError
+	fail := func(format string, args ...any) {
+		errs = append(errs, SchemaError{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(s.types) > 0 && !slices.ContainsFunc(s.types, func(t string) bool { return jsonTypeMatches(t, value) }) {
+		fail("must be of type %s", strings.Join(s.types, " or "))
+		// The remaining keywords would only repeat the mismatch
+		return errs
+	}
+	if s.enum != nil && !slices.ContainsFunc(s.enum, func(allowed any) bool { return reflect.DeepEqual(allowed, value) }) {
+		fail("must be one of the allowed values")
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, value) {
+		fail("must be %s", formatJSONValue(s.constant))
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		if s.minProperties != nil && len(v) < *s.minProperties {
+			fail("must have at least %d properties", *s.minProperties)
+		}
+		if s.maxProperties != nil && len(v) > *s.maxProperties {
+			fail("must have at most %d properties", *s.maxProperties)
+		}
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				errs = append(errs, SchemaError{Pointer: pointer + "/" + escapeJSONPointer(name), Message: "is required"})
+			}
+		}
+		for name, property := range v {
+			propertyPointer := pointer + "/" + escapeJSONPointer(name)
+			if schema, ok := s.properties[name]; ok {
+				errs = append(errs, schema.validate(property, propertyPointer)...)
+			} else if s.additionalProperties != nil {
+				errs = append(errs, s.additionalProperties.validate(property, propertyPointer)...)
+			}
+		}
+	case []any:
+		if s.minItems != nil && len(v) < *s.minItems {
+			fail("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			fail("must have at most %d items", *s.maxItems)
+		}
+		if s.uniqueItems {
+			for i := range v {
+				if slices.ContainsFunc(v[:i], func(other any) bool { return reflect.DeepEqual(other, v[i]) }) {
+					fail("must not contain duplicate items")
+					break
+				}
+			}
+		}
+		for i, item := range v {
+			itemPointer := pointer + "/" + strconv.Itoa(i)
+			if i < len(s.prefixItems) {
+				errs = append(errs, s.prefixItems[i].validate(item, itemPointer)...)
+			} else if s.items != nil {
+				errs = append(errs, s.items.validate(item, itemPointer)...)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			fail("must be at least %d characters long", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			fail("must be at most %d characters long", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match the pattern %s", s.pattern)
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			fail("must be at least %v", *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			fail("must be at most %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			fail("must be greater than %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			fail("must be less than %v", *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil {
+			// Allow for float rounding, e.g. 0.3 is a multiple of 0.1
+			if quotient := v / *s.multipleOf; math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+				fail("must be a multiple of %v", *s.multipleOf)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		errs = append(errs, sub.validate(value, pointer)...)
+	}
+	if s.anyOf != nil && !slices.ContainsFunc(s.anyOf, func(sub *JSONSchema) bool { return len(sub.validate(value, pointer)) == 0 }) {
+		fail("must match at least one of the allowed schemas")
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if len(sub.validate(value, pointer)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one of the allowed schemas, matched %d", matched)
+		}
+	}
+	if s.not != nil && len(s.not.validate(value, pointer)) == 0 {
+		fail("must not match the excluded schema")
+	}
+
+	return errs
+}
+
+// jsonTypeMatches reports whether a decoded JSON value is of a schema type
+func jsonTypeMatches(t string, value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case float64:
+		return t == "number" || (t == "integer" && v == math.Trunc(v) && !math.IsInf(v, 0))
+	case []any:
+		return t == "array"
+	case map[string]any:
+		return t == "object"
+	}
+	return false
+}
+
+func formatJSONValue(value any) string {
+	if s, ok := value.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(value)
+}
+
+// escapeJSONPointer escapes a property name for use as a JSON pointer token
+func escapeJSONPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+func pointerOrRoot(pointer string) string {
+	if pointer == "" {
+		return "root"
+	}
+	return pointer
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, raw string) any {
+	t.Helper()
+	var value any
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		t.Fatalf("decoding %s: %v", raw, err)
+	}
+	return value
+}
+
+func TestCompileJSONSchemaRejectsInvalidSchemas(t *testing.T) {
+	tests := []struct {
+		schema string
+		want   string
+	}{
+		{`"object"`, "root must be an object or a boolean"},
+		{`{"type": "text"}`, "/type must be one of array, boolean, integer, null, number, object, string"},
+		{`{"type": ["string", 1]}`, "/type must be a type name or an array of them"},
+		{`{"enum": "a"}`, "/enum must be an array"},
+		{`{"required": ["a", 1]}`, "/required must be an array of property names"},
+		{`{"properties": {"a": {"type": "string"}, "b": {"minLength": -1}}}`, "/properties/b/minLength must be a non-negative integer"},
+		{`{"properties": {"a/b": 1}}`, "/properties/a~1b must be an object or a boolean"},
+		{`{"items": {"maxItems": 1.5}}`, "/items/maxItems must be a non-negative integer"},
+		{`{"anyOf": []}`, "/anyOf must be a non-empty array of schemas"},
+		{`{"oneOf": [true, {"type": 1}]}`, "/oneOf/1/type must be a type name or an array of them"},
+		{`{"minimum": "1"}`, "/minimum must be a number"},
+		{`{"multipleOf": 0}`, "/multipleOf must be greater than 0"},
+		{`{"uniqueItems": "yes"}`, "/uniqueItems must be a boolean"},
+		{`{"pattern": "("}`, "/pattern must be a valid regular expression"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.schema, func(t *testing.T) {
+			_, err := CompileJSONSchema(decodeJSON(t, tt.schema))
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("CompileJSONSchema error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		// want lists the errors as "pointer: message", nil for a valid value
+		want []string
+	}{
+		{"true", `true`, `{"a": 1}`, nil},
+		{"false", `false`, `1`, []string{"is not allowed"}},
+		{"type", `{"type": "string"}`, `1`, []string{"must be of type string"}},
+		{"type list", `{"type": ["string", "null"]}`, `null`, nil},
+		{"integer", `{"type": "integer"}`, `2.0`, nil},
+		{"not an integer", `{"type": "integer"}`, `2.5`, []string{"must be of type integer"}},
+		{"enum", `{"enum": ["a", 1, {"b": true}]}`, `{"b": true}`, nil},
+		{"not in enum", `{"enum": ["a", "b"]}`, `"c"`, []string{"must be one of the allowed values"}},
+		{"const", `{"const": "a"}`, `"b"`, []string{`must be "a"`}},
+		{
+			"object",
+			`{"type": "object", "properties": {"name": {"type": "string"}, "a/b": {"type": "number"}}, "required": ["name", "id"], "additionalProperties": false}`,
+			`{"name": 1, "a/b": 2, "extra": true}`,
+			[]string{"/extra: is not allowed", "/id: is required", "/name: must be of type string"},
+		},
+		{"properties count", `{"minProperties": 2, "maxProperties": 3}`, `{"a": 1}`, []string{"must have at least 2 properties"}},
+		{
+			"array",
+			`{"prefixItems": [{"type": "string"}], "items": {"type": "number"}, "maxItems": 3, "uniqueItems": true}`,
+			`["a", "b", 1, 1]`,
+			[]string{"must have at most 3 items", "must not contain duplicate items", "/1: must be of type number"},
+		},
+		{"string", `{"minLength": 2, "pattern": "^[a-z]+$"}`, `"É"`, []string{"must be at least 2 characters long", "must match the pattern ^[a-z]+$"}},
+		{"string length counts characters", `{"maxLength": 2}`, `"éé"`, nil},
+		{"range", `{"minimum": 1, "exclusiveMaximum": 10}`, `10`, []string{"must be less than 10"}},
+		{"exclusive minimum", `{"exclusiveMinimum": 0, "maximum": 5}`, `0`, []string{"must be greater than 0"}},
+		{"multipleOf", `{"multipleOf": 0.1}`, `0.3`, nil},
+		{"multipleOf of large value", `{"multipleOf": 0.01}`, `1234.56`, nil},
+		{"not a multiple", `{"multipleOf": 0.1}`, `0.35`, []string{"must be a multiple of 0.1"}},
+		{"allOf", `{"allOf": [{"type": "number"}, {"minimum": 5}]}`, `3`, []string{"must be at least 5"}},
+		{"anyOf", `{"anyOf": [{"type": "string"}, {"type": "null"}]}`, `1`, []string{"must match at least one of the allowed schemas"}},
+		{"oneOf", `{"oneOf": [{"type": "number"}, {"minimum": 0}]}`, `1`, []string{"must match exactly one of the allowed schemas, matched 2"}},
+		{"not", `{"not": {"type": "null"}}`, `null`, []string{"must not match the excluded schema"}},
+		{
+			"nested",
+			`{"properties": {"links": {"items": {"properties": {"url": {"type": "string"}}}}}}`,
+			`{"links": [{"url": "a"}, {"url": 2}]}`,
+			[]string{"/links/1/url: must be of type string"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := CompileJSONSchema(decodeJSON(t, tt.schema))
+			if err != nil {
+				t.Fatalf("CompileJSONSchema: %v", err)
+			}
+			var got []string
+			for _, e := range schema.Validate(decodeJSON(t, tt.value)) {
+				got = append(got, e.Error())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Validate(%s) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vachanmn123/vachancms/config"
+)
+
+const (
+	lfsPointerVersion = "https://git-lfs.github.com/spec/v1"
+	lfsMediaType      = "application/vnd.git-lfs+json"
+	// maxLFSPointerSize is the largest file git-lfs itself treats as a pointer
+	maxLFSPointerSize = 1024
+)
+
+// lfsAttributes are the .gitattributes lines that hand media/<id> to git-lfs
+// while keeping the media library's own JSON files as regular blobs.
+var lfsAttributes = []string{
+	"media/* filter=lfs diff=lfs merge=lfs -text",
+	"media/.gitkeep !filter !diff !merge text",
+	"media/config.json !filter !diff !merge text",
+	"media/index-*.json !filter !diff !merge text",
+}
+
+// LFSPointer identifies an object stored on a Git LFS server
+type LFSPointer struct {
+	OID  string
+	Size int64
+}
+
+// String returns the pointer file committed in place of the object
+func (p *LFSPointer) String() string {
+	return fmt.Sprintf("version %s\noid sha256:%s\nsize %d\n", lfsPointerVersion, p.OID, p.Size)
+}
+
+// ParseLFSPointer returns the pointer stored in content, or false if content
+// is not a Git LFS pointer file.
+func ParseLFSPointer(content []byte) (*LFSPointer, bool) {
+	if len(content) > maxLFSPointerSize || !bytes.HasPrefix(content, []byte("version "+lfsPointerVersion+"\n")) {
+		return nil, false
+	}
+
+	pointer := &LFSPointer{Size: -1}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		switch key {
+		case "oid":
+			pointer.OID = strings.TrimPrefix(value, "sha256:")
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			pointer.Size = size
+		}
+	}
+	if len(pointer.OID) != sha256.Size*2 || pointer.Size < 0 {
+		return nil, false
+	}
+	return pointer, true
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+	HashAlgo  string      `json:"hash_algo"`
+}
+
+type lfsBatchResponse struct {
+	Objects []lfsObject `json:"objects"`
+}
+
+type lfsObject struct {
+	OID     string               `json:"oid"`
+	Size    int64                `json:"size"`
+	Actions map[string]lfsAction `json:"actions,omitempty"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+// ErrNoLFSServer is returned by LFS operations when the storage backend has
+// no LFS server of its own and LFS_URL does not name one
+var ErrNoLFSServer = errors.New("no LFS server: set LFS_URL to use LFS with the local backend")
+
+// lfsEndpoint returns the LFS server URL of a repository. LFS_URL points all
+// repositories at another server, such as a local LFS server for development,
+// and is the only option for local repositories.
+func lfsEndpoint(owner, repo string) (string, error) {
+	if config.Cfg != nil && config.Cfg.LFSURL != "" {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(config.Cfg.LFSURL, "/"), owner, repo), nil
+	}
+	if config.Cfg != nil && config.Cfg.StorageBackend == "local" {
+		return "", ErrNoLFSServer
+	}
+	if config.Cfg != nil && config.Cfg.StorageBackend == "gitlab" {
+		return fmt.Sprintf("%s/%s/%s.git/info/lfs", strings.TrimSuffix(config.Cfg.GitLabURL, "/"), owner, repo), nil
+	}
+	return fmt.Sprintf("https://github.com/%s/%s.git/info/lfs", owner, repo), nil
+}
+
+// LFSAvailable reports whether media can be stored with Git LFS
+func LFSAvailable() bool {
+	_, err := lfsEndpoint("", "")
+	return err == nil
+}
+
+// lfsBatch asks the LFS server what to do to upload or download an object
+func lfsBatch(ctx context.Context, token, owner, repo, operation string, pointer *LFSPointer) (*lfsObject, error) {
+	body, err := json.Marshal(lfsBatchRequest{
+		Operation: operation,
+		Transfers: []string{"basic"},
+		Objects:   []lfsObject{{OID: pointer.OID, Size: pointer.Size}},
+		HashAlgo:  "sha256",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := lfsEndpoint(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	// GitHub ignores the username; GitLab expects "oauth2" for OAuth tokens
+	req.SetBasicAuth("oauth2", token)
+
+	initHTTPClients()
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lfs batch %s failed with status %d", operation, res.StatusCode)
+	}
+
+	var batch lfsBatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("failed to parse lfs batch response: %w", err)
+	}
+	if len(batch.Objects) != 1 {
+		return nil, fmt.Errorf("lfs batch %s returned %d objects", operation, len(batch.Objects))
+	}
+	object := batch.Objects[0]
+	if object.Error != nil {
+		if object.Error.Code == http.StatusNotFound {
+			return nil, &FileNotFoundError{}
+		}
+		return nil, fmt.Errorf("lfs object %s: %s", pointer.OID, object.Error.Message)
+	}
+	return &object, nil
+}
+
+// lfsTransfer performs a single basic transfer action against the LFS server
+// or the storage it delegated to.
+func lfsTransfer(ctx context.Context, method string, action lfsAction, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, action.Href, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for key, value := range action.Header {
+		req.Header.Set(key, value)
+	}
+
+	initHTTPClients()
+	res, err := streamHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		drainBody(res)
+		return nil, fmt.Errorf("lfs %s %s failed with status %d", strings.ToLower(method), action.Href, res.StatusCode)
+	}
+	return res, nil
+}
+
+// UploadLFSObject stores content on the repository's LFS server and returns
+// the pointer to commit in its place. content is read twice, once to hash it
+// and once to upload it, so it is never held in memory.
+func UploadLFSObject(ctx context.Context, token, owner, repo string, content io.ReadSeeker) (*LFSPointer, error) {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, content)
+	if err != nil {
+		return nil, err
+	}
+	pointer := &LFSPointer{OID: hex.EncodeToString(h.Sum(nil)), Size: size}
+
+	object, err := lfsBatch(ctx, token, owner, repo, "upload", pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	// No upload action means the server already has the object
+	upload, ok := object.Actions["upload"]
+	if !ok {
+		return pointer, nil
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	res, err := lfsTransfer(ctx, http.MethodPut, upload, content, size)
+	if err != nil {
+		return nil, err
+	}
+	drainBody(res)
+
+	if verify, ok := object.Actions["verify"]; ok {
+		body, _ := json.Marshal(lfsObject{OID: pointer.OID, Size: pointer.Size})
+		if verify.Header == nil {
+			verify.Header = map[string]string{}
+		}
+		verify.Header["Content-Type"] = lfsMediaType
+		res, err := lfsTransfer(ctx, http.MethodPost, verify, bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			return nil, err
+		}
+		drainBody(res)
+	}
+
+	return pointer, nil
+}
+
+// OpenLFSObject streams the object a pointer refers to
+func OpenLFSObject(ctx context.Context, token, owner, repo string, pointer *LFSPointer) (io.ReadCloser, int64, error) {
+	object, err := lfsBatch(ctx, token, owner, repo, "download", pointer)
+	if err != nil {
+		return nil, 0, err
+	}
+	download, ok := object.Actions["download"]
+	if !ok {
+		return nil, 0, fmt.Errorf("lfs server returned no download for %s", pointer.OID)
+	}
+	res, err := lfsTransfer(ctx, http.MethodGet, download, nil, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return res.Body, pointer.Size, nil
+}
+
+// OpenMediaFile streams a media file, transparently resolving Git LFS
+// pointers so callers get the file's real content either way.
+func OpenMediaFile(ctx context.Context, token, owner, repo, path string, branch ...string) (io.ReadCloser, int64, error) {
+	content, size, err := OpenFile(ctx, token, owner, repo, path, branch...)
+	if err != nil || size > maxLFSPointerSize {
+		return content, size, err
+	}
+
+	// Small enough to be a pointer, so buffer it and check
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, 0, err
+	}
+	if pointer, ok := ParseLFSPointer(data); ok {
+		return OpenLFSObject(ctx, token, owner, repo, pointer)
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+// TrackMediaWithLFS stages the .gitattributes lines that mark media files as
+// Git LFS objects, so git clients check out their content instead of pointers.
+func TrackMediaWithLFS(ctx context.Context, b *CommitBuilder) error {
+	attributes, err := b.GetFileContents(ctx, ".gitattributes")
+	if err != nil {
+		var notFound *FileNotFoundError
+		if !errors.As(err, &notFound) {
+			return fmt.Errorf("failed to fetch .gitattributes: %w", err)
+		}
+	}
+
+	existing := map[string]bool{}
+	for _, line := range strings.Split(attributes, "\n") {
+		existing[strings.TrimSpace(line)] = true
+	}
+
+	updated := attributes
+	for _, line := range lfsAttributes {
+		if existing[line] {
+			continue
+		}
+		if updated != "" && !strings.HasSuffix(updated, "\n") {
+			updated += "\n"
+		}
+		updated += line + "\n"
+	}
+	if updated != attributes {
+		b.WriteFile(".gitattributes", updated)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vachanmn123/vachancms/config"
+)
+
+// fakeLFSServer is a Git LFS server speaking the batch API and the basic
+// transfer adapter for repository o/r
+type fakeLFSServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  int
+	verified int
+}
+
+func newFakeLFSServer(t *testing.T) *fakeLFSServer {
+	t.Helper()
+	s := &fakeLFSServer{objects: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	previous := config.Cfg
+	config.Cfg = &config.Config{LFSURL: s.URL + "/lfs"}
+	t.Cleanup(func() { config.Cfg = previous })
+	return s
+}
+
+func (s *fakeLFSServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, token, ok := r.BasicAuth(); r.URL.Path == "/lfs/o/r/objects/batch" && (!ok || user != "oauth2" || token != "tok") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/lfs/o/r/objects/batch":
+		var batch lfsBatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil || r.Header.Get("Content-Type") != lfsMediaType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		response := lfsBatchResponse{}
+		for _, object := range batch.Objects {
+			_, stored := s.objects[object.OID]
+			href := s.URL + "/objects/" + object.OID
+			switch {
+			case batch.Operation == "upload" && !stored:
+				object.Actions = map[string]lfsAction{
+					"upload": {Href: href, Header: map[string]string{"X-Transfer": "ok"}},
+					"verify": {Href: href + "/verify"},
+				}
+			case batch.Operation == "download" && stored:
+				object.Actions = map[string]lfsAction{"download": {Href: href, Header: map[string]string{"X-Transfer": "ok"}}}
+			case batch.Operation == "download":
+				object.Error = &struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				}{Code: http.StatusNotFound, Message: "Object does not exist"}
+			}
+			response.Objects = append(response.Objects, object)
+		}
+		w.Header().Set("Content-Type", lfsMediaType)
+		json.NewEncoder(w).Encode(response)
+
+	case strings.HasPrefix(r.URL.Path, "/objects/") && r.Header.Get("X-Transfer") != "ok" && !strings.HasSuffix(r.URL.Path, "/verify"):
+		w.WriteHeader(http.StatusForbidden)
+
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/objects/"):
+		content, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(content)
+		oid := strings.TrimPrefix(r.URL.Path, "/objects/")
+		if hex.EncodeToString(sum[:]) != oid {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[oid] = content
+		s.uploads++
+
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/verify"):
+		var object lfsObject
+		json.NewDecoder(r.Body).Decode(&object)
+		if _, ok := s.objects[object.OID]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.verified++
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/objects/"):
+		content, ok := s.objects[strings.TrimPrefix(r.URL.Path, "/objects/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// useStorage makes the services use storage until the test ends
+func useStorage(t *testing.T, storage Storage) {
+	t.Helper()
+	storageMu.RLock()
+	previous := storageFactory
+	storageMu.RUnlock()
+	SetStorageFactory(func(string) Storage { return storage })
+	t.Cleanup(func() { SetStorageFactory(previous) })
+}
+
+func TestParseLFSPointer(t *testing.T) {
+	oid := strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		content string
+		want    *LFSPointer
+	}{
+		{"pointer", "version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize 12345\n", &LFSPointer{OID: oid, Size: 12345}},
+		{"empty object", "version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize 0\n", &LFSPointer{OID: oid, Size: 0}},
+		{"regular file", "hello world", nil},
+		{"other version", "version https://example.com/v2\noid sha256:" + oid + "\nsize 1\n", nil},
+		{"short oid", "version https://git-lfs.github.com/spec/v1\noid sha256:abcd\nsize 1\n", nil},
+		{"missing size", "version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\n", nil},
+		{"bad size", "version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize big\n", nil},
+		{"too large", "version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize 1\n" + strings.Repeat("x", maxLFSPointerSize), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseLFSPointer([]byte(tt.content))
+			if tt.want == nil {
+				if ok {
+					t.Fatalf("ParseLFSPointer = %+v, want no pointer", got)
+				}
+				return
+			}
+			if !ok || *got != *tt.want {
+				t.Fatalf("ParseLFSPointer = %+v, %v; want %+v", got, ok, tt.want)
+			}
+			// A pointer written out parses back to itself
+			if again, ok := ParseLFSPointer([]byte(got.String())); !ok || *again != *got {
+				t.Errorf("pointer %q does not round trip", got.String())
+			}
+		})
+	}
+}
+
+func TestLFSEndpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		want    string
+		wantErr error
+	}{
+		{name: "github", cfg: config.Config{}, want: "https://github.com/o/r.git/info/lfs"},
+		{name: "gitlab", cfg: config.Config{StorageBackend: "gitlab", GitLabURL: "https://gitlab.example/"}, want: "https://gitlab.example/o/r.git/info/lfs"},
+		{name: "LFS_URL", cfg: config.Config{StorageBackend: "gitlab", LFSURL: "http://localhost:9000/"}, want: "http://localhost:9000/o/r"},
+		{name: "local with LFS_URL", cfg: config.Config{StorageBackend: "local", LFSURL: "http://localhost:9000"}, want: "http://localhost:9000/o/r"},
+		{name: "local", cfg: config.Config{StorageBackend: "local"}, wantErr: ErrNoLFSServer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := config.Cfg
+			config.Cfg = &tt.cfg
+			t.Cleanup(func() { config.Cfg = previous })
+
+			got, err := lfsEndpoint("o", "r")
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("lfsEndpoint = %q, %v; want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+			if available := LFSAvailable(); available != (tt.wantErr == nil) {
+				t.Errorf("LFSAvailable = %v, want %v", available, !available)
+			}
+		})
+	}
+}
+
+func TestLFSObjectRoundTrip(t *testing.T) {
+	ctx := t.Context()
+	server := newFakeLFSServer(t)
+	content := bytes.Repeat([]byte("media bytes "), 500)
+
+	pointer, err := UploadLFSObject(ctx, "tok", "o", "r", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("UploadLFSObject: %v", err)
+	}
+	sum := sha256.Sum256(content)
+	if pointer.OID != hex.EncodeToString(sum[:]) || pointer.Size != int64(len(content)) {
+		t.Errorf("pointer = %+v, want sha256 %x of %d bytes", pointer, sum, len(content))
+	}
+	if server.uploads != 1 || server.verified != 1 {
+		t.Errorf("server saw %d uploads and %d verifications, want 1 each", server.uploads, server.verified)
+	}
+
+	// Objects the server already has are not sent again
+	if _, err := UploadLFSObject(ctx, "tok", "o", "r", bytes.NewReader(content)); err != nil {
+		t.Fatalf("second UploadLFSObject: %v", err)
+	}
+	if server.uploads != 1 {
+		t.Errorf("existing object was uploaded again")
+	}
+
+	body, size, err := OpenLFSObject(ctx, "tok", "o", "r", pointer)
+	if err != nil {
+		t.Fatalf("OpenLFSObject: %v", err)
+	}
+	defer body.Close()
+	downloaded, _ := io.ReadAll(body)
+	if size != int64(len(content)) || !bytes.Equal(downloaded, content) {
+		t.Errorf("downloaded %d bytes (size %d), want the %d uploaded", len(downloaded), size, len(content))
+	}
+}
+
+func TestLFSErrors(t *testing.T) {
+	ctx := t.Context()
+	newFakeLFSServer(t)
+
+	missing := &LFSPointer{OID: strings.Repeat("0", 64), Size: 1}
+	var notFound *FileNotFoundError
+	if _, _, err := OpenLFSObject(ctx, "tok", "o", "r", missing); !errors.As(err, &notFound) {
+		t.Errorf("OpenLFSObject of missing object: got %v, want *FileNotFoundError", err)
+	}
+	if _, err := UploadLFSObject(ctx, "wrong", "o", "r", strings.NewReader("x")); err == nil {
+		t.Error("UploadLFSObject with a rejected token succeeded")
+	}
+}
+
+func TestOpenMediaFileResolvesPointers(t *testing.T) {
+	ctx := t.Context()
+	newFakeLFSServer(t)
+	storage := newMemoryRepo(t, nil)
+	useStorage(t, storage)
+
+	content := []byte("the real image")
+	pointer, err := UploadLFSObject(ctx, "tok", "o", "r", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("UploadLFSObject: %v", err)
+	}
+	pushFile(t, storage, "media/lfs", pointer.String())
+	pushFile(t, storage, "media/plain", "a plain file")
+
+	for path, want := range map[string]string{"media/lfs": string(content), "media/plain": "a plain file"} {
+		body, size, err := OpenMediaFile(ctx, "tok", "o", "r", path)
+		if err != nil {
+			t.Fatalf("OpenMediaFile(%s): %v", path, err)
+		}
+		got, _ := io.ReadAll(body)
+		body.Close()
+		if string(got) != want || size != int64(len(want)) {
+			t.Errorf("OpenMediaFile(%s) = %q (size %d), want %q", path, got, size, want)
+		}
+	}
+}
+
+func TestTrackMediaWithLFS(t *testing.T) {
+	ctx := t.Context()
+	storage := newMemoryRepo(t, map[string]string{".gitattributes": "*.png binary"})
+	b := newTestBuilder(t, storage, "")
+
+	if err := TrackMediaWithLFS(ctx, b); err != nil {
+		t.Fatalf("TrackMediaWithLFS: %v", err)
+	}
+	attributes, _ := b.GetFileContents(ctx, ".gitattributes")
+	want := "*.png binary\n" + strings.Join(lfsAttributes, "\n") + "\n"
+	if attributes != want {
+		t.Errorf(".gitattributes = %q, want %q", attributes, want)
+	}
+
+	// Tracking again leaves the file alone
+	if err := b.Commit(ctx, "track"); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := TrackMediaWithLFS(ctx, b); err != nil {
+		t.Fatalf("second TrackMediaWithLFS: %v", err)
+	}
+	if b.HasChanges() {
+		t.Error("second TrackMediaWithLFS staged changes")
+	}
+}
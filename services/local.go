@@ -0,0 +1,553 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zeroSHA tells update-ref that the ref must not exist yet
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+// LocalStorage is a Storage backend for git repositories on disk, laid out as
+// <root>/<owner>/<repo> (or <repo>.git for bare repositories). It shells out
+// to the git binary and commits through plumbing commands, so it works on
+// bare repositories and never touches a checkout's index. When the checked
+// out branch of a working tree is updated, the working tree is fast-forwarded
+// along with it unless that would overwrite local changes.
+type LocalStorage struct {
+	root        string
+	authorName  string
+	authorEmail string
+}
+
+// NewLocalStorage returns a backend for the repositories under root that
+// commits as the given author.
+func NewLocalStorage(root, authorName, authorEmail string) *LocalStorage {
+	return &LocalStorage{root: root, authorName: authorName, authorEmail: authorEmail}
+}
+
+// LocalAccessToken encodes an author as the access token of a local session,
+// so every commit made in that session is attributed to them.
+func LocalAccessToken(name, email string) string {
+	return (&mail.Address{Name: name, Address: email}).String()
+}
+
+// ParseLocalAccessToken returns the author encoded by LocalAccessToken
+func ParseLocalAccessToken(token string) (name, email string, ok bool) {
+	address, err := mail.ParseAddress(token)
+	if err != nil {
+		return "", "", false
+	}
+	return address.Name, address.Address, true
+}
+
+// repoDir returns the directory of a repository, refusing names that would
+// escape the root directory.
+func (s *LocalStorage) repoDir(user, repo string) (string, error) {
+	for _, name := range []string{user, repo} {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return "", fmt.Errorf("invalid repository name %s/%s", user, repo)
+		}
+	}
+
+	for _, name := range []string{repo, repo + ".git"} {
+		dir := filepath.Join(s.root, user, name)
+		if isGitDir(dir) {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("repository %s/%s not found", user, repo)
+}
+
+// isGitDir reports whether dir is a working tree or a bare repository
+func isGitDir(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(dir, "objects"))
+	return err == nil
+}
+
+// git runs a git command in dir with stdin as its input and returns its
+// trimmed output.
+func (s *LocalStorage) git(ctx context.Context, dir string, stdin io.Reader, env []string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := s.command(ctx, dir, env, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			// Report the cancellation, not the killed process
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (s *LocalStorage) command(ctx context.Context, dir string, env []string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME="+s.authorName,
+		"GIT_AUTHOR_EMAIL="+s.authorEmail,
+		"GIT_COMMITTER_NAME="+s.authorName,
+		"GIT_COMMITTER_EMAIL="+s.authorEmail,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	return cmd
+}
+
+// defaultBranch returns the branch HEAD points at
+func (s *LocalStorage) defaultBranch(ctx context.Context, dir string) (string, error) {
+	return s.git(ctx, dir, nil, nil, "symbolic-ref", "--short", "HEAD")
+}
+
+// resolveRef turns an empty branch into the default branch and anything else
+// into a full ref or commit SHA.
+func (s *LocalStorage) resolveRef(ctx context.Context, dir, branch string) (string, error) {
+	if branch == "" {
+		name, err := s.defaultBranch(ctx, dir)
+		if err != nil {
+			return "", err
+		}
+		return "refs/heads/" + name, nil
+	}
+	if commitSHARegex.MatchString(branch) {
+		return branch, nil
+	}
+	return "refs/heads/" + branch, nil
+}
+
+// headOf returns the commit a branch points at, or "" if it does not exist
+func (s *LocalStorage) headOf(ctx context.Context, dir, ref string) string {
+	head, err := s.git(ctx, dir, nil, nil, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return ""
+	}
+	return head
+}
+
+// blobSHA resolves a file at a branch or commit to its blob SHA
+func (s *LocalStorage) blobSHA(ctx context.Context, user, repo, path string, branch []string) (string, string, error) {
+	dir, err := s.repoDir(user, repo)
+	if err != nil {
+		return "", "", err
+	}
+	ref, err := s.resolveRef(ctx, dir, branchRef(branch))
+	if err != nil {
+		return "", "", err
+	}
+	// An unknown path, or a branch without commits, is reported as missing
+	sha, err := s.git(ctx, dir, nil, nil, "rev-parse", "--verify", "--quiet", ref+":"+path)
+	if err != nil {
+		return "", "", &FileNotFoundError{}
+	}
+	return dir, sha, nil
+}
+
+func (s *LocalStorage) GetUser(ctx context.Context) (*User, error) {
+	return &User{Login: s.authorName, Name: s.authorName}, nil
+}
+
+func (s *LocalStorage) ListRepos(ctx context.Context) ([]*Repository, error) {
+	owners, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	repos := []*Repository{}
+	for _, owner := range owners {
+		if !owner.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.root, owner.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			dir := filepath.Join(s.root, owner.Name(), entry.Name())
+			if !entry.IsDir() || !isGitDir(dir) {
+				continue
+			}
+			defaultBranch, _ := s.defaultBranch(ctx, dir)
+			description, _ := os.ReadFile(filepath.Join(dir, "description"))
+			if strings.HasPrefix(string(description), "Unnamed repository") {
+				description = nil
+			}
+			repos = append(repos, &Repository{
+				FullName:      owner.Name() + "/" + strings.TrimSuffix(entry.Name(), ".git"),
+				Description:   strings.TrimSpace(string(description)),
+				Private:       true,
+				DefaultBranch: defaultBranch,
+			})
+		}
+	}
+	return repos, nil
+}
+
+func (s *LocalStorage) GetFileContents(ctx context.Context, user, repo, path string, branch ...string) (string, error) {
+	dir, sha, err := s.blobSHA(ctx, user, repo, path, branch)
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := s.command(ctx, dir, nil, "cat-file", "blob", sha)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git cat-file: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// gitReader streams the output of a git command and reaps it on Close
+type gitReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *gitReader) Close() error {
+	r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
+
+func (s *LocalStorage) OpenFile(ctx context.Context, user, repo, path string, branch ...string) (io.ReadCloser, int64, error) {
+	dir, sha, err := s.blobSHA(ctx, user, repo, path, branch)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sizeOutput, err := s.git(ctx, dir, nil, nil, "cat-file", "-s", sha)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := strconv.ParseInt(sizeOutput, 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cmd := s.command(ctx, dir, nil, "cat-file", "blob", sha)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, 0, err
+	}
+	return &gitReader{ReadCloser: stdout, cmd: cmd}, size, nil
+}
+
+// commitFile lands a single change on top of whatever the branch points at
+func (s *LocalStorage) commitFile(ctx context.Context, user, repo, message string, change FileChange, branch []string) error {
+	dir, err := s.repoDir(user, repo)
+	if err != nil {
+		return err
+	}
+	ref, err := s.resolveRef(ctx, dir, branchRef(branch))
+	if err != nil {
+		return err
+	}
+	_, err = s.CommitChanges(ctx, user, repo, strings.TrimPrefix(ref, "refs/heads/"), s.headOf(ctx, dir, ref), message, []FileChange{change})
+	return err
+}
+
+func (s *LocalStorage) CreateOrUpdateFile(ctx context.Context, user, repo, path, message, content string, branch ...string) error {
+	return s.commitFile(ctx, user, repo, message, FileChange{Path: path, Content: []byte(content)}, branch)
+}
+
+func (s *LocalStorage) DeleteFile(ctx context.Context, user, repo, path, message string, branch ...string) error {
+	return s.commitFile(ctx, user, repo, message, FileChange{Path: path, Delete: true}, branch)
+}
+
+func (s *LocalStorage) UploadFile(ctx context.Context, user, repo, path, message string, content []byte, branch ...string) error {
+	return s.commitFile(ctx, user, repo, message, FileChange{Path: path, Content: content}, branch)
+}
+
+func (s *LocalStorage) GetPagesConfig(ctx context.Context, user, repo string) (*PageConfig, error) {
+	return &PageConfig{Initialized: false}, nil
+}
+
+func (s *LocalStorage) CreateBranch(ctx context.Context, user, repo, newBranch string, srcBranch ...string) error {
+	dir, err := s.repoDir(user, repo)
+	if err != nil {
+		return err
+	}
+	src, err := s.resolveRef(ctx, dir, branchRef(srcBranch))
+	if err != nil {
+		return err
+	}
+	head := s.headOf(ctx, dir, src)
+	if head == "" {
+		return fmt.Errorf("branch %s not found", strings.TrimPrefix(src, "refs/heads/"))
+	}
+	_, err = s.git(ctx, dir, nil, nil, "update-ref", "refs/heads/"+newBranch, head, zeroSHA)
+	return err
+}
+
+func (s *LocalStorage) MergeBranch(ctx context.Context, user, repo, fromBranch, message string, toBranch ...string) error {
+	dir, err := s.repoDir(user, repo)
+	if err != nil {
+		return err
+	}
+	target, err := s.resolveRef(ctx, dir, branchRef(toBranch))
+	if err != nil {
+		return err
+	}
+	base, from := s.headOf(ctx, dir, target), s.headOf(ctx, dir, "refs/heads/"+fromBranch)
+	if base == "" || from == "" {
+		return fmt.Errorf("cannot merge %s into %s", fromBranch, strings.TrimPrefix(target, "refs/heads/"))
+	}
+
+	tree, err := s.git(ctx, dir, nil, nil, "merge-tree", "--write-tree", "--no-messages", base, from)
+	if err != nil {
+		return fmt.Errorf("merge of %s has conflicts: %w", fromBranch, err)
+	}
+	commit, err := s.git(ctx, dir, nil, nil, "commit-tree", tree, "-p", base, "-p", from, "-m", message)
+	if err != nil {
+		return err
+	}
+	if err := s.moveBranch(ctx, dir, target, commit, base); err != nil {
+		return err
+	}
+
+	_, err = s.git(ctx, dir, nil, nil, "update-ref", "-d", "refs/heads/"+fromBranch, from)
+	return err
+}
+
+func (s *LocalStorage) IsRepoEmpty(ctx context.Context, user, repo string) (bool, string, error) {
+	dir, err := s.repoDir(user, repo)
+	if err != nil {
+		return false, "", err
+	}
+	defaultBranch, err := s.defaultBranch(ctx, dir)
+	if err != nil {
+		return false, "", err
+	}
+	return s.headOf(ctx, dir, "refs/heads/"+defaultBranch) == "", defaultBranch, nil
+}
+
+func (s *LocalStorage) GetHead(ctx context.Context, user, repo, branch string) (string, error) {
+	dir, err := s.repoDir(user, repo)
+	if err != nil {
+		return "", err
+	}
+	ref, err := s.resolveRef(ctx, dir, branch)
+	if err != nil {
+		return "", err
+	}
+	head := s.headOf(ctx, dir, ref)
+	if head == "" {
+		return "", fmt.Errorf("branch %s not found", strings.TrimPrefix(ref, "refs/heads/"))
+	}
+	return head, nil
+}
+
+func (s *LocalStorage) CommitChanges(ctx context.Context, user, repo, branch, parent, message string, changes []FileChange) (string, error) {
+	dir, err := s.repoDir(user, repo)
+	if err != nil {
+		return "", err
+	}
+	ref, err := s.resolveRef(ctx, dir, branch)
+	if err != nil {
+		return "", err
+	}
+	if s.headOf(ctx, dir, ref) != parent {
+		return "", &BranchMovedError{Branch: strings.TrimPrefix(ref, "refs/heads/")}
+	}
+
+	// Build the tree in a throwaway index so a checkout's index is untouched
+	index, err := os.CreateTemp("", "vachancms-index-")
+	if err != nil {
+		return "", err
+	}
+	index.Close()
+	os.Remove(index.Name())
+	defer os.Remove(index.Name())
+	env := []string{"GIT_INDEX_FILE=" + index.Name()}
+
+	if parent != "" {
+		if _, err := s.git(ctx, dir, nil, env, "read-tree", parent); err != nil {
+			return "", err
+		}
+	}
+
+	var indexInfo strings.Builder
+	for _, change := range changes {
+		if change.Delete {
+			fmt.Fprintf(&indexInfo, "0 %s\t%s\x00", zeroSHA, change.Path)
+			continue
+		}
+		var content io.Reader = bytes.NewReader(change.Content)
+		if change.Body != nil {
+			content = change.Body
+		}
+		sha, err := s.git(ctx, dir, content, nil, "hash-object", "-w", "--stdin")
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&indexInfo, "100644 %s\t%s\x00", sha, change.Path)
+	}
+	// Records are NUL-terminated so no path can end one early
+	if _, err := s.git(ctx, dir, strings.NewReader(indexInfo.String()), env, "update-index", "-z", "--index-info"); err != nil {
+		return "", err
+	}
+
+	tree, err := s.git(ctx, dir, nil, env, "write-tree")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"commit-tree", tree, "-m", message}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	commit, err := s.git(ctx, dir, nil, nil, args...)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.moveBranch(ctx, dir, ref, commit, parent); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// moveBranch points ref at commit if it still points at old, then brings a
+// working tree that has ref checked out up to date.
+func (s *LocalStorage) moveBranch(ctx context.Context, dir, ref, commit, old string) error {
+	expected := old
+	if expected == "" {
+		expected = zeroSHA
+	}
+	if _, err := s.git(ctx, dir, nil, nil, "update-ref", ref, commit, expected); err != nil {
+		if s.headOf(ctx, dir, ref) != old {
+			return &BranchMovedError{Branch: strings.TrimPrefix(ref, "refs/heads/")}
+		}
+		return err
+	}
+
+	// The branch has moved, so finish the checkout even if the caller is gone
+	ctx = context.WithoutCancel(ctx)
+	bare, err := s.git(ctx, dir, nil, nil, "rev-parse", "--is-bare-repository")
+	if err != nil || bare == "true" {
+		return nil
+	}
+	checkedOut, err := s.git(ctx, dir, nil, nil, "symbolic-ref", "HEAD")
+	if err != nil || checkedOut != ref {
+		return nil
+	}
+
+	// A two-tree read-tree refuses to run if it would lose local changes, in
+	// which case the commit stands and the checkout is left for its owner.
+	if old == "" {
+		_, err = s.git(ctx, dir, nil, nil, "read-tree", "-u", "-m", commit)
+	} else {
+		_, err = s.git(ctx, dir, nil, nil, "read-tree", "-u", "-m", old, commit)
+	}
+	if err != nil {
+		log.Printf("[WARN] Could not update working tree of %s: %v", dir, err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) ChangedFiles(ctx context.Context, user, repo, base, head string) ([]string, error) {
+	dir, err := s.repoDir(user, repo)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.git(ctx, dir, nil, nil, "diff", "--name-only", "--no-renames", "-z", base, head)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, path := range strings.Split(output, "\x00") {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func (s *LocalStorage) ListFiles(ctx context.Context, user, repo, dir, ref string) ([]string, error) {
+	repoDir, err := s.repoDir(user, repo)
+	if err != nil {
+		return nil, err
+	}
+	ref, err = s.resolveRef(ctx, repoDir, ref)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.git(ctx, repoDir, nil, nil, "ls-tree", "-r", "-z", "--name-only", ref, "--", strings.TrimSuffix(dir, "/")+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, path := range strings.Split(output, "\x00") {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func (s *LocalStorage) ListBranches(ctx context.Context, user, repo string) ([]*Branch, error) {
+	dir, err := s.repoDir(user, repo)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.git(ctx, dir, nil, nil, "for-each-ref", "--format=%(refname:short) %(objectname)", "refs/heads")
+	if err != nil {
+		return nil, err
+	}
+
+	branches := []*Branch{}
+	for _, line := range strings.Split(output, "\n") {
+		if name, head, ok := strings.Cut(line, " "); ok {
+			branches = append(branches, &Branch{Name: name, Head: head})
+		}
+	}
+	return branches, nil
+}
+
+func (s *LocalStorage) DeleteBranch(ctx context.Context, user, repo, branch string) error {
+	dir, err := s.repoDir(user, repo)
+	if err != nil {
+		return err
+	}
+	_, err = s.git(ctx, dir, nil, nil, "update-ref", "-d", "refs/heads/"+branch)
+	return err
+}
+
+func (s *LocalStorage) CommitTime(ctx context.Context, user, repo, sha string) (time.Time, error) {
+	dir, err := s.repoDir(user, repo)
+	if err != nil {
+		return time.Time{}, err
+	}
+	output, err := s.git(ctx, dir, nil, nil, "show", "-s", "--format=%ct", sha)
+	if err != nil {
+		return time.Time{}, err
+	}
+	seconds, err := strconv.ParseInt(output, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vachanmn123/vachancms/config"
+)
+
+// newLocalRepo creates the git repository o/r (o/r.git if bare) under a
+// temporary root and returns a backend for it committing as Test User
+func newLocalRepo(t *testing.T, bare bool) (*LocalStorage, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	dir := filepath.Join(root, "o", "r")
+	args := []string{"init", "--quiet", "--initial-branch=main"}
+	if bare {
+		dir += ".git"
+		args = append(args, "--bare")
+	}
+	if output, err := exec.Command("git", append(args, dir)...).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, output)
+	}
+	return NewLocalStorage(root, "Test User", "test@example.com"), dir
+}
+
+// gitOutput runs a git command in dir and returns its trimmed output
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	output, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+	if err != nil {
+		t.Fatalf("git %s: %v", args[0], err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestLocalStorageReadsFiles(t *testing.T) {
+	ctx := t.Context()
+	s, _ := newLocalRepo(t, true)
+
+	if empty, branch, err := s.IsRepoEmpty(ctx, "o", "r"); err != nil || !empty || branch != "main" {
+		t.Fatalf("IsRepoEmpty = %v, %q, %v; want true, main", empty, branch, err)
+	}
+	if _, err := s.CommitChanges(ctx, "o", "r", "", "", "initial", []FileChange{
+		{Path: "config/config.json", Content: []byte(`{"site_name":"S"}`)},
+		{Path: "media/a b.png", Body: strings.NewReader("image")},
+	}); err != nil {
+		t.Fatalf("CommitChanges: %v", err)
+	}
+
+	content, err := s.GetFileContents(ctx, "o", "r", "config/config.json")
+	if err != nil || content != `{"site_name":"S"}` {
+		t.Errorf("GetFileContents = %q, %v", content, err)
+	}
+	body, size, err := s.OpenFile(ctx, "o", "r", "media/a b.png")
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	if err := body.Close(); err != nil {
+		t.Errorf("closing OpenFile reader: %v", err)
+	}
+	if string(data) != "image" || size != 5 {
+		t.Errorf("OpenFile = %q (size %d), want %q", data, size, "image")
+	}
+
+	files, err := s.ListFiles(ctx, "o", "r", "media", "")
+	if err != nil || !slices.Equal(files, []string{"media/a b.png"}) {
+		t.Errorf("ListFiles = %v, %v; want [media/a b.png]", files, err)
+	}
+
+	var notFound *FileNotFoundError
+	if _, err := s.GetFileContents(ctx, "o", "r", "missing.json"); !errors.As(err, &notFound) {
+		t.Errorf("GetFileContents of missing file: got %v, want *FileNotFoundError", err)
+	}
+	if _, _, err := s.OpenFile(ctx, "o", "r", "missing.json"); !errors.As(err, &notFound) {
+		t.Errorf("OpenFile of missing file: got %v, want *FileNotFoundError", err)
+	}
+	for _, repo := range []string{"nope", "..", "r/../r"} {
+		if _, err := s.GetFileContents(ctx, "o", repo, "config/config.json"); err == nil || errors.As(err, &notFound) {
+			t.Errorf("GetFileContents of repository %q: got %v, want an error", repo, err)
+		}
+	}
+}
+
+func TestLocalStorageCommitChanges(t *testing.T) {
+	ctx := t.Context()
+	s, dir := newLocalRepo(t, false)
+
+	parent, err := s.CommitChanges(ctx, "o", "r", "", "", "initial", []FileChange{
+		{Path: "a", Content: []byte("1")},
+		{Path: "b", Content: []byte("2")},
+	})
+	if err != nil {
+		t.Fatalf("initial CommitChanges: %v", err)
+	}
+	head, err := s.CommitChanges(ctx, "o", "r", "", parent, "change", []FileChange{
+		{Path: "a", Content: []byte("one")},
+		{Path: "b", Delete: true},
+		{Path: "c", Content: []byte("3")},
+	})
+	if err != nil {
+		t.Fatalf("CommitChanges: %v", err)
+	}
+	if current, _ := s.GetHead(ctx, "o", "r", ""); current != head {
+		t.Errorf("GetHead = %s, want %s", current, head)
+	}
+	changed, err := s.ChangedFiles(ctx, "o", "r", parent, head)
+	if err != nil || !slices.Equal(changed, []string{"a", "b", "c"}) {
+		t.Errorf("ChangedFiles = %v, %v; want [a b c]", changed, err)
+	}
+
+	// The checked out working tree follows the branch
+	if content, err := os.ReadFile(filepath.Join(dir, "a")); err != nil || string(content) != "one" {
+		t.Errorf("working tree a = %q, %v; want %q", content, err, "one")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Errorf("working tree still has deleted file b: %v", err)
+	}
+
+	// A commit built on the old head must not land
+	_, err = s.CommitChanges(ctx, "o", "r", "", parent, "stale", []FileChange{{Path: "a", Content: []byte("stale")}})
+	var moved *BranchMovedError
+	if !errors.As(err, &moved) {
+		t.Fatalf("CommitChanges on stale parent: got %v, want *BranchMovedError", err)
+	}
+	if content, _ := s.GetFileContents(ctx, "o", "r", "a"); content != "one" {
+		t.Errorf("a = %q after rejected commit, want %q", content, "one")
+	}
+}
+
+func TestLocalStorageCommitChangesKeepsPathsWhole(t *testing.T) {
+	ctx := t.Context()
+	s, _ := newLocalRepo(t, true)
+
+	parent, err := s.CommitChanges(ctx, "o", "r", "", "", "initial", []FileChange{{Path: "a", Content: []byte("1")}})
+	if err != nil {
+		t.Fatalf("initial CommitChanges: %v", err)
+	}
+	// A path with a newline must not be read as a second index record
+	injected := "media/x.png\n100644 " + BlobSHA([]byte("1")) + "\ta"
+	head, err := s.CommitChanges(ctx, "o", "r", "", parent, "upload", []FileChange{{Path: injected, Content: []byte("evil")}})
+	if err != nil {
+		t.Fatalf("CommitChanges: %v", err)
+	}
+	files, err := s.ListFiles(ctx, "o", "r", "media", head)
+	if err != nil || !slices.Equal(files, []string{injected}) {
+		t.Errorf("ListFiles = %q, %v", files, err)
+	}
+	if content, _ := s.GetFileContents(ctx, "o", "r", "a", head); content != "1" {
+		t.Errorf("a = %q, want %q", content, "1")
+	}
+}
+
+func TestLocalStorageCommitsAsSignedInUser(t *testing.T) {
+	ctx := t.Context()
+	_, dir := newLocalRepo(t, true)
+	root := filepath.Dir(filepath.Dir(dir))
+
+	previous := storageFactory
+	t.Cleanup(func() { SetStorageFactory(previous) })
+	cfg := &config.Config{
+		StorageBackend: "local",
+		LocalReposDir:  root,
+		LocalUserName:  "Admin",
+		LocalUserEmail: "admin@localhost",
+		JWTSecret:      "secret",
+	}
+	if err := SetupStorage(cfg); err != nil {
+		t.Fatalf("SetupStorage: %v", err)
+	}
+
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{token: LocalAccessToken("Jane Doe", "jane@example.com"), want: "Jane Doe <jane@example.com>"},
+		// Sessions without an author fall back to the configured user
+		{token: "", want: "Admin <admin@localhost>"},
+	}
+	for _, tt := range tests {
+		if err := storageFor(tt.token).CreateOrUpdateFile(ctx, "o", "r", "a", "change", tt.want); err != nil {
+			t.Fatalf("CreateOrUpdateFile: %v", err)
+		}
+		for _, format := range []string{"%an <%ae>", "%cn <%ce>"} {
+			if got := gitOutput(t, dir, "log", "-1", "--format="+format); got != tt.want {
+				t.Errorf("commit %s = %q, want %q", format, got, tt.want)
+			}
+		}
+	}
+	if user, _ := storageFor(LocalAccessToken("Jane Doe", "jane@example.com")).GetUser(ctx); user.Login != "Jane Doe" {
+		t.Errorf("GetUser = %+v, want Jane Doe", user)
+	}
+
+	cfg.JWTSecret = ""
+	if err := SetupStorage(cfg); err == nil {
+		t.Error("SetupStorage of the local backend without JWT_SECRET succeeded")
+	}
+}
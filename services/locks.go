@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// repoLock is shared by every request writing to the same scope. Holding it
+// means having sent to held; releasing it means receiving again.
+type repoLock struct {
+	held chan struct{}
+	refs int
+}
+
+var (
+	repoLocksMu sync.Mutex
+	repoLocks   = map[string]*repoLock{}
+)
+
+// LockRepo serializes mutating operations on one scope of a repository, such
+// as a content type slug, "media" or "config". Every read-modify-write of the
+// scope's config and index files must happen while the lock is held, so that
+// concurrent editors cannot drop each other's changes to Order, Items or Slugs.
+// It blocks until the lock is acquired and returns the function that releases
+// it, or gives up with ctx.Err() once ctx is done.
+func LockRepo(ctx context.Context, owner, repo, scope string) (func(), error) {
+	// GitHub owner and repository names are case-insensitive
+	key := strings.ToLower(owner + "/" + repo + "/" + scope)
+
+	repoLocksMu.Lock()
+	lock, ok := repoLocks[key]
+	if !ok {
+		lock = &repoLock{held: make(chan struct{}, 1)}
+		repoLocks[key] = lock
+	}
+	lock.refs++
+	repoLocksMu.Unlock()
+
+	forget := func() {
+		repoLocksMu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(repoLocks, key)
+		}
+		repoLocksMu.Unlock()
+	}
+
+	select {
+	case lock.held <- struct{}{}:
+	case <-ctx.Done():
+		forget()
+		return nil, ctx.Err()
+	}
+
+	return func() {
+		<-lock.held
+		forget()
+	}, nil
+}
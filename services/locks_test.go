@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// lockedWithin reports whether LockRepo acquires the lock within d, releasing
+// it again if so
+func lockedWithin(t *testing.T, owner, repo, scope string, d time.Duration) bool {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(t.Context(), d)
+	defer cancel()
+	unlock, err := LockRepo(ctx, owner, repo, scope)
+	if err != nil {
+		return false
+	}
+	unlock()
+	return true
+}
+
+func TestLockRepoSerializesScope(t *testing.T) {
+	unlock, err := LockRepo(t.Context(), "o", "r", "posts")
+	if err != nil {
+		t.Fatalf("LockRepo: %v", err)
+	}
+
+	if lockedWithin(t, "o", "r", "posts", 50*time.Millisecond) {
+		t.Fatal("second LockRepo of the same scope did not wait")
+	}
+	// Owner and repository names are case-insensitive
+	if lockedWithin(t, "O", "R", "posts", 50*time.Millisecond) {
+		t.Fatal("LockRepo of the same scope in other case did not wait")
+	}
+
+	unlock()
+	if !lockedWithin(t, "o", "r", "posts", time.Second) {
+		t.Fatal("LockRepo did not acquire a released lock")
+	}
+}
+
+func TestLockRepoScopesAreIndependent(t *testing.T) {
+	unlock, err := LockRepo(t.Context(), "o", "r", "posts")
+	if err != nil {
+		t.Fatalf("LockRepo: %v", err)
+	}
+	defer unlock()
+
+	for _, other := range [][3]string{{"o", "r", "pages"}, {"o", "r", "config"}, {"o", "other", "posts"}} {
+		if !lockedWithin(t, other[0], other[1], other[2], time.Second) {
+			t.Errorf("LockRepo(%q, %q, %q) waited for o/r/posts", other[0], other[1], other[2])
+		}
+	}
+}
+
+func TestLockRepoGivesUpWithContext(t *testing.T) {
+	unlock, err := LockRepo(t.Context(), "o", "r", "cancel")
+	if err != nil {
+		t.Fatalf("LockRepo: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := LockRepo(ctx, "o", "r", "cancel"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("LockRepo with a cancelled context: got %v, want context.Canceled", err)
+	}
+
+	// Giving up neither takes nor leaks the lock
+	unlock()
+	if !lockedWithin(t, "o", "r", "cancel", time.Second) {
+		t.Fatal("LockRepo did not acquire the lock after a waiter gave up")
+	}
+	repoLocksMu.Lock()
+	defer repoLocksMu.Unlock()
+	if _, ok := repoLocks["o/r/cancel"]; ok {
+		t.Error("lock is still tracked after every holder and waiter left")
+	}
+}
+
+func TestLockRepoForgetsReleasedLocks(t *testing.T) {
+	unlock, err := LockRepo(t.Context(), "o", "r", "forget")
+	if err != nil {
+		t.Fatalf("LockRepo: %v", err)
+	}
+	unlock()
+
+	repoLocksMu.Lock()
+	defer repoLocksMu.Unlock()
+	if _, ok := repoLocks["o/r/forget"]; ok {
+		t.Error("released lock is still tracked")
+	}
+}
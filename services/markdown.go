@@ -0,0 +1,27 @@
+package services
+
+import (
+	"bytes"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+var (
+	// markdownRenderer renders GitHub Flavored Markdown. Raw HTML in the source
+	// is dropped rather than passed through.
+	markdownRenderer = goldmark.New(goldmark.WithExtensions(extension.GFM))
+	// markdownPolicy strips anything from the rendered HTML that could run
+	// scripts or break out of the page it is embedded in
+	markdownPolicy = bluemonday.UGCPolicy()
+)
+
+// RenderMarkdown returns the sanitized HTML for a Markdown source
+func RenderMarkdown(source string) (string, error) {
+	var html bytes.Buffer
+	if err := markdownRenderer.Convert([]byte(source), &html); err != nil {
+		return "", err
+	}
+	return markdownPolicy.Sanitize(html.String()), nil
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/vachanmn123/vachancms/models"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		// want must appear in the HTML, and none of unwanted
+		want     string
+		unwanted []string
+	}{
+		{name: "markdown", source: "# Hi\n\n**bold**", want: "<h1>Hi</h1>\n<p><strong>bold</strong></p>"},
+		{name: "tables", source: "| a |\n|---|\n| b |", want: "<td>b</td>"},
+		{name: "strikethrough", source: "~~gone~~", want: "<del>gone</del>"},
+		{name: "script", source: "<script>alert(1)</script>\n\ntext", want: "<p>text</p>", unwanted: []string{"script", "alert"}},
+		{name: "event handler", source: `<img src="x" onerror="alert(1)">`, unwanted: []string{"<img", "onerror"}},
+		{name: "javascript link", source: "[x](javascript:alert(1))", want: "x", unwanted: []string{"href", "javascript"}},
+		{name: "link", source: "[x](https://example.com)", want: `<a href="https://example.com" rel="nofollow">x</a>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			html, err := RenderMarkdown(tt.source)
+			if err != nil {
+				t.Fatalf("RenderMarkdown: %v", err)
+			}
+			if !strings.Contains(html, tt.want) {
+				t.Errorf("RenderMarkdown(%q) = %q, want it to contain %q", tt.source, html, tt.want)
+			}
+			for _, unwanted := range tt.unwanted {
+				if strings.Contains(html, unwanted) {
+					t.Errorf("RenderMarkdown(%q) = %q, which contains %q", tt.source, html, unwanted)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderFieldValues(t *testing.T) {
+	contentType := &models.ContentType{Fields: []models.ContentTypeField{
+		{FieldName: "title", FieldType: "text"},
+		{FieldName: "body", FieldType: "markdown"},
+		{FieldName: "intro", FieldType: "group", Fields: []models.ContentTypeField{
+			{FieldName: "text", FieldType: "markdown"},
+		}},
+		{FieldName: "faq", FieldType: "repeater", Fields: []models.ContentTypeField{
+			{FieldName: "answer", FieldType: "markdown"},
+		}},
+	}}
+
+	tests := []struct {
+		name   string
+		values map[string]any
+		want   map[string]string
+	}{
+		{
+			name: "nested",
+			values: map[string]any{
+				"title": "*not markdown*",
+				"body":  "*a*",
+				"intro": map[string]any{"text": "*b*"},
+				"faq":   []any{map[string]any{"answer": "*c*"}, map[string]any{}, map[string]any{"answer": "*d*"}},
+			},
+			want: map[string]string{
+				"body":          "<p><em>a</em></p>\n",
+				"intro.text":    "<p><em>b</em></p>\n",
+				"faq[0].answer": "<p><em>c</em></p>\n",
+				"faq[2].answer": "<p><em>d</em></p>\n",
+			},
+		},
+		{
+			name:   "nothing to render",
+			values: map[string]any{"title": "t", "body": "", "faq": []any{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered, err := RenderFieldValues(contentType, tt.values)
+			if err != nil {
+				t.Fatalf("RenderFieldValues: %v", err)
+			}
+			if !maps.Equal(rendered, tt.want) || (tt.want == nil) != (rendered == nil) {
+				t.Errorf("RenderFieldValues = %v, want %v", rendered, tt.want)
+			}
+		})
+	}
+}
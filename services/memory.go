@@ -0,0 +1,426 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is a Storage backend that keeps repositories in memory. It is
+// meant for tests and local experiments; nothing is persisted.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	repos map[string]*memoryRepo
+}
+
+type memoryRepo struct {
+	defaultBranch string
+	// branches maps a branch name to the id of its head commit
+	branches map[string]string
+	// bases maps a branch name to the commit it was created from, used to work
+	// out which files changed when the branch is merged back.
+	bases   map[string]string
+	commits map[string]map[string][]byte
+	times   map[string]time.Time
+	seq     int
+}
+
+// NewMemoryStorage returns an empty in-memory backend
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{repos: map[string]*memoryRepo{}}
+}
+
+// CreateRepo adds an empty repository with the given default branch
+func (s *MemoryStorage) CreateRepo(user, repo, defaultBranch string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if defaultBranch == "" {
+		defaultBranch = "main"
+	}
+	s.repos[user+"/"+repo] = &memoryRepo{
+		defaultBranch: defaultBranch,
+		branches:      map[string]string{},
+		bases:         map[string]string{},
+		commits:       map[string]map[string][]byte{},
+		times:         map[string]time.Time{},
+	}
+}
+
+func (s *MemoryStorage) getRepo(user, repo string) (*memoryRepo, error) {
+	r, ok := s.repos[user+"/"+repo]
+	if !ok {
+		return nil, fmt.Errorf("repository %s/%s not found", user, repo)
+	}
+	return r, nil
+}
+
+// branchName resolves an empty branch to the default branch
+func (r *memoryRepo) branchName(branch string) string {
+	if branch == "" {
+		return r.defaultBranch
+	}
+	return branch
+}
+
+// snapshot returns the files at a branch or commit id
+func (r *memoryRepo) snapshot(ref string) (map[string][]byte, error) {
+	name := r.branchName(ref)
+	if head, ok := r.branches[name]; ok {
+		return r.commits[head], nil
+	}
+	if files, ok := r.commits[ref]; ok {
+		return files, nil
+	}
+	if name == r.defaultBranch && len(r.branches) == 0 {
+		// Empty repository, nothing has been committed yet
+		return map[string][]byte{}, nil
+	}
+	return nil, fmt.Errorf("ref %s not found", name)
+}
+
+// commit records files as the new head of branch and returns the commit id
+func (r *memoryRepo) commit(branch string, files map[string][]byte) string {
+	r.seq++
+	id := fmt.Sprintf("%040x", r.seq)
+	r.commits[id] = files
+	r.times[id] = time.Now()
+	r.branches[r.branchName(branch)] = id
+	return id
+}
+
+// update applies fn to a copy of the branch's files and commits the result
+func (s *MemoryStorage) update(user, repo, branch string, fn func(files map[string][]byte)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return err
+	}
+	files, err := r.snapshot(branch)
+	if err != nil {
+		return err
+	}
+	files = maps.Clone(files)
+	fn(files)
+	r.commit(branch, files)
+	return nil
+}
+
+func (s *MemoryStorage) GetUser(ctx context.Context) (*User, error) {
+	return &User{Login: "memory", Name: "In-memory user"}, nil
+}
+
+func (s *MemoryStorage) ListRepos(ctx context.Context) ([]*Repository, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.repos))
+	for name := range s.repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	repos := make([]*Repository, 0, len(names))
+	for _, name := range names {
+		repos = append(repos, &Repository{
+			FullName:      name,
+			DefaultBranch: s.repos[name].defaultBranch,
+		})
+	}
+	return repos, nil
+}
+
+func (s *MemoryStorage) GetFileContents(ctx context.Context, user, repo, path string, branch ...string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return "", err
+	}
+	files, err := r.snapshot(branchRef(branch))
+	if err != nil {
+		return "", err
+	}
+	content, ok := files[path]
+	if !ok {
+		return "", &FileNotFoundError{}
+	}
+	return string(content), nil
+}
+
+func (s *MemoryStorage) OpenFile(ctx context.Context, user, repo, path string, branch ...string) (io.ReadCloser, int64, error) {
+	content, err := s.GetFileContents(ctx, user, repo, path, branch...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(bytes.NewReader([]byte(content))), int64(len(content)), nil
+}
+
+func (s *MemoryStorage) CreateOrUpdateFile(ctx context.Context, user, repo, path, message, content string, branch ...string) error {
+	return s.UploadFile(ctx, user, repo, path, message, []byte(content), branch...)
+}
+
+func (s *MemoryStorage) DeleteFile(ctx context.Context, user, repo, path, message string, branch ...string) error {
+	return s.update(user, repo, branchRef(branch), func(files map[string][]byte) {
+		delete(files, path)
+	})
+}
+
+func (s *MemoryStorage) UploadFile(ctx context.Context, user, repo, path, message string, content []byte, branch ...string) error {
+	return s.update(user, repo, branchRef(branch), func(files map[string][]byte) {
+		files[path] = append([]byte(nil), content...)
+	})
+}
+
+func (s *MemoryStorage) GetPagesConfig(ctx context.Context, user, repo string) (*PageConfig, error) {
+	return &PageConfig{Initialized: false}, nil
+}
+
+func (s *MemoryStorage) CreateBranch(ctx context.Context, user, repo, newBranch string, srcBranch ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return err
+	}
+	if _, exists := r.branches[newBranch]; exists {
+		return fmt.Errorf("branch %s already exists", newBranch)
+	}
+	src, ok := r.branches[r.branchName(branchRef(srcBranch))]
+	if !ok {
+		return fmt.Errorf("branch %s not found", r.branchName(branchRef(srcBranch)))
+	}
+	r.branches[newBranch] = src
+	r.bases[newBranch] = src
+	return nil
+}
+
+func (s *MemoryStorage) MergeBranch(ctx context.Context, user, repo, fromBranch, message string, toBranch ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return err
+	}
+	head, ok := r.branches[fromBranch]
+	if !ok {
+		return fmt.Errorf("branch %s not found", fromBranch)
+	}
+	target := r.branchName(branchRef(toBranch))
+	targetFiles, err := r.snapshot(target)
+	if err != nil {
+		return err
+	}
+
+	// Replay only what changed on the source branch since it was created
+	from, base := r.commits[head], r.commits[r.bases[fromBranch]]
+	files := maps.Clone(targetFiles)
+	for path, content := range from {
+		if old, existed := base[path]; !existed || string(old) != string(content) {
+			files[path] = content
+		}
+	}
+	for path := range base {
+		if _, exists := from[path]; !exists {
+			delete(files, path)
+		}
+	}
+	r.commit(target, files)
+
+	delete(r.branches, fromBranch)
+	delete(r.bases, fromBranch)
+	return nil
+}
+
+func (s *MemoryStorage) IsRepoEmpty(ctx context.Context, user, repo string) (bool, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return false, "", err
+	}
+	return len(r.branches) == 0, r.defaultBranch, nil
+}
+
+func (s *MemoryStorage) GetHead(ctx context.Context, user, repo, branch string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return "", err
+	}
+	head, ok := r.branches[r.branchName(branch)]
+	if !ok {
+		return "", fmt.Errorf("branch %s not found", r.branchName(branch))
+	}
+	return head, nil
+}
+
+func (s *MemoryStorage) CommitChanges(ctx context.Context, user, repo, branch, parent, message string, changes []FileChange) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return "", err
+	}
+	name := r.branchName(branch)
+	if r.branches[name] != parent {
+		return "", &BranchMovedError{Branch: name}
+	}
+
+	files := maps.Clone(r.commits[parent])
+	if files == nil {
+		files = map[string][]byte{}
+	}
+	for _, change := range changes {
+		switch {
+		case change.Delete:
+			delete(files, change.Path)
+		case change.Body != nil:
+			content, err := io.ReadAll(change.Body)
+			if err != nil {
+				return "", err
+			}
+			files[change.Path] = content
+		default:
+			files[change.Path] = append([]byte(nil), change.Content...)
+		}
+	}
+	return r.commit(name, files), nil
+}
+
+// Files returns the paths present on a branch, sorted. It is intended for
+// assertions in tests.
+func (s *MemoryStorage) Files(user, repo string, branch ...string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return nil
+	}
+	files, err := r.snapshot(branchRef(branch))
+	if err != nil {
+		return nil
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (s *MemoryStorage) ChangedFiles(ctx context.Context, user, repo, base, head string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return nil, err
+	}
+	from, to := r.commits[base], r.commits[head]
+
+	var paths []string
+	for path, content := range to {
+		if old, ok := from[path]; !ok || string(old) != string(content) {
+			paths = append(paths, path)
+		}
+	}
+	for path := range from {
+		if _, ok := to[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (s *MemoryStorage) ListFiles(ctx context.Context, user, repo, dir, ref string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return nil, err
+	}
+	files, err := r.snapshot(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	paths := []string{}
+	for path := range files {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (s *MemoryStorage) ListBranches(ctx context.Context, user, repo string) ([]*Branch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return nil, err
+	}
+	branches := []*Branch{}
+	for name, head := range r.branches {
+		branches = append(branches, &Branch{Name: name, Head: head})
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		return branches[i].Name < branches[j].Name
+	})
+	return branches, nil
+}
+
+func (s *MemoryStorage) DeleteBranch(ctx context.Context, user, repo, branch string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return err
+	}
+	if _, ok := r.branches[branch]; !ok {
+		return fmt.Errorf("branch %s not found", branch)
+	}
+	delete(r.branches, branch)
+	delete(r.bases, branch)
+	return nil
+}
+
+func (s *MemoryStorage) CommitTime(ctx context.Context, user, repo, sha string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.getRepo(user, repo)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, ok := r.times[sha]
+	if !ok {
+		return time.Time{}, fmt.Errorf("commit %s not found", sha)
+	}
+	return t, nil
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// newMemoryRepo returns a backend holding o/r with a first commit on main
+func newMemoryRepo(t *testing.T, files map[string]string) *MemoryStorage {
+	t.Helper()
+	s := NewMemoryStorage()
+	s.CreateRepo("o", "r", "main")
+	if len(files) == 0 {
+		files = map[string]string{"README.md": "hello"}
+	}
+	changes := []FileChange{}
+	for path, content := range files {
+		changes = append(changes, FileChange{Path: path, Content: []byte(content)})
+	}
+	if _, err := s.CommitChanges(t.Context(), "o", "r", "main", "", "initial", changes); err != nil {
+		t.Fatalf("initial commit: %v", err)
+	}
+	return s
+}
+
+func TestMemoryStorageFiles(t *testing.T) {
+	ctx := t.Context()
+	s := newMemoryRepo(t, nil)
+
+	if err := s.CreateOrUpdateFile(ctx, "o", "r", "data/a.json", "add", `{"a":1}`); err != nil {
+		t.Fatalf("CreateOrUpdateFile: %v", err)
+	}
+	content, err := s.GetFileContents(ctx, "o", "r", "data/a.json")
+	if err != nil || content != `{"a":1}` {
+		t.Fatalf("GetFileContents = %q, %v", content, err)
+	}
+
+	if err := s.DeleteFile(ctx, "o", "r", "data/a.json", "remove"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	var notFound *FileNotFoundError
+	if _, err := s.GetFileContents(ctx, "o", "r", "data/a.json"); !errors.As(err, &notFound) {
+		t.Fatalf("GetFileContents of deleted file: got %v, want *FileNotFoundError", err)
+	}
+	if _, err := s.GetFileContents(ctx, "o", "nope", "README.md"); err == nil {
+		t.Fatal("GetFileContents of unknown repository succeeded")
+	}
+}
+
+func TestMemoryStorageCommitChanges(t *testing.T) {
+	ctx := t.Context()
+	s := newMemoryRepo(t, map[string]string{"a": "1", "b": "2"})
+
+	parent, err := s.GetHead(ctx, "o", "r", "")
+	if err != nil {
+		t.Fatalf("GetHead: %v", err)
+	}
+	head, err := s.CommitChanges(ctx, "o", "r", "", parent, "change", []FileChange{
+		{Path: "a", Content: []byte("one")},
+		{Path: "b", Delete: true},
+		{Path: "c", Content: []byte("3")},
+	})
+	if err != nil {
+		t.Fatalf("CommitChanges: %v", err)
+	}
+	if got := s.Files("o", "r"); !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("files after commit = %v, want [a c]", got)
+	}
+	changed, err := s.ChangedFiles(ctx, "o", "r", parent, head)
+	if err != nil {
+		t.Fatalf("ChangedFiles: %v", err)
+	}
+	if !slices.Equal(changed, []string{"a", "b", "c"}) {
+		t.Errorf("ChangedFiles = %v, want [a b c]", changed)
+	}
+
+	// A commit built on the old head must not land
+	_, err = s.CommitChanges(ctx, "o", "r", "", parent, "stale", []FileChange{{Path: "a", Content: []byte("stale")}})
+	var moved *BranchMovedError
+	if !errors.As(err, &moved) {
+		t.Fatalf("CommitChanges on stale parent: got %v, want *BranchMovedError", err)
+	}
+	if content, _ := s.GetFileContents(ctx, "o", "r", "a"); content != "one" {
+		t.Errorf("a = %q after rejected commit, want %q", content, "one")
+	}
+	if current, _ := s.GetHead(ctx, "o", "r", ""); current != head {
+		t.Errorf("head moved to %s after rejected commit, want %s", current, head)
+	}
+}
+
+func TestMemoryStorageBranches(t *testing.T) {
+	ctx := t.Context()
+	s := newMemoryRepo(t, map[string]string{"a": "1", "b": "2"})
+
+	if err := s.CreateBranch(ctx, "o", "r", "work"); err != nil {
+		t.Fatalf("CreateBranch: %v", err)
+	}
+	if err := s.CreateOrUpdateFile(ctx, "o", "r", "a", "on work", "work", "work"); err != nil {
+		t.Fatalf("CreateOrUpdateFile on branch: %v", err)
+	}
+	// Changes on main since the branch was created survive the merge
+	if err := s.CreateOrUpdateFile(ctx, "o", "r", "b", "on main", "main"); err != nil {
+		t.Fatalf("CreateOrUpdateFile on main: %v", err)
+	}
+	if content, _ := s.GetFileContents(ctx, "o", "r", "a"); content != "1" {
+		t.Errorf("a on main = %q before merge, want %q", content, "1")
+	}
+
+	if err := s.MergeBranch(ctx, "o", "r", "work", "merge"); err != nil {
+		t.Fatalf("MergeBranch: %v", err)
+	}
+	for path, want := range map[string]string{"a": "work", "b": "main"} {
+		if content, _ := s.GetFileContents(ctx, "o", "r", path); content != want {
+			t.Errorf("%s after merge = %q, want %q", path, content, want)
+		}
+	}
+
+	branches, err := s.ListBranches(ctx, "o", "r")
+	if err != nil {
+		t.Fatalf("ListBranches: %v", err)
+	}
+	if len(branches) != 1 || branches[0].Name != "main" {
+		t.Errorf("branches after merge = %v, want only main", branches)
+	}
+}
@@ -0,0 +1,378 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/vachanmn123/vachancms/models"
+)
+
+// FieldMigration is one step of a schema migration. Steps are applied in
+// order, to the content type definition and to every entry.
+type FieldMigration struct {
+	// Op is "rename", "change_type", "drop" or "add"
+	Op string `json:"op" binding:"required"`
+	// Field names the field to rename, change or drop
+	Field string `json:"field,omitempty"`
+	// To is the new name of a renamed field
+	To string `json:"to,omitempty"`
+	// Type, Options, Fields and Schema are the new definition of a changed
+	// field. Rules and the default that do not suit the new type are dropped.
+	Type    string                    `json:"type,omitempty"`
+	Options []string                  `json:"options,omitempty"`
+	Fields  []models.ContentTypeField `json:"fields,omitempty"`
+	Schema  map[string]any            `json:"schema,omitempty"`
+	// Definition is the field to add, and Default the value every existing
+	// entry gets for it (none if omitted)
+	Definition *models.ContentTypeField `json:"definition,omitempty"`
+	Default    any                      `json:"default,omitempty"`
+}
+
+// MigrationFailure is an entry whose value could not be converted
+type MigrationFailure struct {
+	Id    string `json:"id"`
+	Slug  string `json:"slug,omitempty"`
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// MigrationResult reports what a migration did to a content type's entries.
+// Migrated counts the entries that converted, even if the migration was
+// abandoned because others did not.
+type MigrationResult struct {
+	ContentType models.ContentType `json:"content_type"`
+	Migrated    int                `json:"migrated"`
+	Failed      []MigrationFailure `json:"failed"`
+}
+
+// InvalidMigrationError is returned when the migration steps themselves do not
+// fit the content type, before any entry is touched
+type InvalidMigrationError struct {
+	Message string
+}
+
+func (e *InvalidMigrationError) Error() string {
+	return e.Message
+}
+
+// MigrateContentType applies the migration steps to the content type and
+// stages the rewritten entries, slug files, indexes and configs. Entries whose
+// values cannot be converted are reported; with clearInvalid the offending
+// value is removed from them, otherwise nothing is staged at all so no entry
+// is left in a shape the new definition does not describe.
+func MigrateContentType(ctx context.Context, token, owner, repo string, b *CommitBuilder, configFile *models.ConfigFile, ctSlug string, steps []FieldMigration, clearInvalid bool) (*MigrationResult, error) {
+	index := slices.IndexFunc(configFile.ContentTypes, func(ct models.ContentType) bool {
+		return ct.Slug == ctSlug
+	})
+	if index == -1 {
+		return nil, &FileNotFoundError{}
+	}
+	contentType := &configFile.ContentTypes[index]
+	fc := FieldContext{Token: token, Owner: owner, Repo: repo, Builder: b}
+
+	// Defaults are converted once up front, so a bad default fails the whole
+	// migration instead of every entry. Changed fields are kept as they are
+	// right after their step, which is what entries are converted to.
+	defaults := make([]any, len(steps))
+	changed := make([]*models.ContentTypeField, len(steps))
+	for i, step := range steps {
+		field, err := applyFieldMigration(contentType, configFile, step)
+		if err != nil {
+			return nil, err
+		}
+		if step.Op == "change_type" {
+			changed[i] = &field
+		}
+		if step.Op == "change_type" || step.Op == "add" {
+			problems, err := ValidateFieldDefaults(ctx, fc, []models.ContentTypeField{field}, "")
+			if err != nil {
+				return nil, err
+			}
+			if err := definitionError(problems); err != nil {
+				return nil, err
+			}
+		}
+		if step.Op == "add" && step.Default != nil {
+			value, err := ConvertFieldValue(ctx, fc, step.Default, *step.Definition)
+			if err != nil {
+				return nil, &InvalidMigrationError{Message: fmt.Sprintf("Default of field %s: %v", step.Definition.FieldName, err)}
+			}
+			defaults[i] = value
+		}
+	}
+
+	config, err := GetContentValueConfig(ctx, b, ctSlug)
+	if err != nil {
+		return nil, err
+	}
+	if err := MigrateConfigToOrder(ctx, b, ctSlug, config); err != nil {
+		return nil, err
+	}
+
+	result := &MigrationResult{ContentType: *contentType, Failed: []MigrationFailure{}}
+	// writes holds the rewritten entries by path until every entry is known
+	// to have converted
+	type write struct{ path, content string }
+	writes := []write{}
+	for _, id := range config.Order {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		value, err := GetContentValue(ctx, b, ctSlug, id)
+		if err != nil {
+			// Regenerating the indexes skips missing entries as well
+			continue
+		}
+		if value.Value == nil {
+			value.Value = map[string]any{}
+		}
+
+		failed := false
+		for i, step := range steps {
+			field, err := migrateEntryValue(ctx, fc, value.Value, step, changed[i], defaults[i])
+			if err == nil {
+				continue
+			}
+			result.Failed = append(result.Failed, MigrationFailure{Id: id, Slug: value.Slug, Field: field, Error: err.Error()})
+			if clearInvalid {
+				delete(value.Value, field)
+			} else {
+				failed = true
+			}
+		}
+		if failed {
+			continue
+		}
+		if value.Rendered, err = RenderFieldValues(contentType, value.Value); err != nil {
+			return nil, fmt.Errorf("failed to render content value %s: %w", id, err)
+		}
+
+		valueJson, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal content value %s: %w", id, err)
+		}
+		writes = append(writes, write{fmt.Sprintf("data/%s/%s.json", ctSlug, id), string(valueJson)})
+		if value.Slug != "" {
+			writes = append(writes, write{fmt.Sprintf("data/%s/%s.json", ctSlug, value.Slug), string(valueJson)})
+		}
+		result.Migrated++
+	}
+	if len(result.Failed) > 0 && !clearInvalid {
+		return result, nil
+	}
+	for _, w := range writes {
+		b.WriteFile(w.path, w.content)
+	}
+
+	if err := SortContentValues(ctx, b, ctSlug, config, contentType); err != nil {
+		return nil, err
+	}
+	if err := RegenerateIndexes(ctx, b, ctSlug, config); err != nil {
+		return nil, err
+	}
+	if err := SaveContentValueConfig(b, ctSlug, config); err != nil {
+		return nil, err
+	}
+	if err := SaveRepoConfig(b, configFile); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// applyFieldMigration changes the content type definition for one step. The
+// changed or added field must be valid as PUT /content-types would require,
+// and is returned.
+func applyFieldMigration(contentType *models.ContentType, configFile *models.ConfigFile, step FieldMigration) (models.ContentTypeField, error) {
+	fieldIndex := func(name string) int {
+		return slices.IndexFunc(contentType.Fields, func(f models.ContentTypeField) bool {
+			return f.FieldName == name
+		})
+	}
+
+	if !slices.Contains([]string{"rename", "change_type", "drop", "add"}, step.Op) {
+		return models.ContentTypeField{}, &InvalidMigrationError{Message: fmt.Sprintf("Unknown migration operation %s", step.Op)}
+	}
+	if step.Op != "add" && fieldIndex(step.Field) == -1 {
+		return models.ContentTypeField{}, &InvalidMigrationError{Message: fmt.Sprintf("Field %s is not defined in content type", step.Field)}
+	}
+
+	switch step.Op {
+	case "rename":
+		if step.To == "" {
+			return models.ContentTypeField{}, &InvalidMigrationError{Message: fmt.Sprintf("Rename of field %s needs a new name", step.Field)}
+		}
+		if fieldIndex(step.To) != -1 {
+			return models.ContentTypeField{}, &InvalidMigrationError{Message: fmt.Sprintf("Field %s already exists", step.To)}
+		}
+		contentType.Fields[fieldIndex(step.Field)].FieldName = step.To
+		if contentType.SortBy == step.Field {
+			contentType.SortBy = step.To
+		}
+	case "change_type":
+		if step.Type == "" {
+			return models.ContentTypeField{}, &InvalidMigrationError{Message: fmt.Sprintf("Type change of field %s needs a type", step.Field)}
+		}
+		fieldType, ok := LookupFieldType(step.Type)
+		if !ok {
+			return models.ContentTypeField{}, &InvalidMigrationError{Message: fmt.Sprintf("Field %s cannot change to unknown type %s", step.Field, step.Type)}
+		}
+		field := changeFieldType(contentType.Fields[fieldIndex(step.Field)], step, fieldType.Describe())
+		if err := checkMigratedField(contentType, configFile, field); err != nil {
+			return models.ContentTypeField{}, err
+		}
+		contentType.Fields[fieldIndex(step.Field)] = field
+		if contentType.SortBy == step.Field && !fieldType.Describe().Sortable {
+			contentType.SortBy, contentType.SortDirection = "", ""
+		}
+		return field, nil
+	case "drop":
+		i := fieldIndex(step.Field)
+		contentType.Fields = slices.Delete(contentType.Fields, i, i+1)
+		if contentType.SortBy == step.Field {
+			contentType.SortBy, contentType.SortDirection = "", ""
+		}
+	case "add":
+		if step.Definition == nil || step.Definition.FieldName == "" || step.Definition.FieldType == "" {
+			return models.ContentTypeField{}, &InvalidMigrationError{Message: "Adding a field needs a definition with a name and type"}
+		}
+		if fieldIndex(step.Definition.FieldName) != -1 {
+			return models.ContentTypeField{}, &InvalidMigrationError{Message: fmt.Sprintf("Field %s already exists", step.Definition.FieldName)}
+		}
+		if err := checkMigratedField(contentType, configFile, *step.Definition); err != nil {
+			return models.ContentTypeField{}, err
+		}
+		contentType.Fields = append(contentType.Fields, *step.Definition)
+		return *step.Definition, nil
+	}
+	return models.ContentTypeField{}, nil
+}
+
+// changeFieldType returns field with the type and settings of a change_type
+// step. Its name and required flag are kept, as are the rules the new type
+// still supports; the default was a value of the old type and is dropped.
+func changeFieldType(field models.ContentTypeField, step FieldMigration, description FieldTypeDescription) models.ContentTypeField {
+	field.FieldType = step.Type
+	field.Options = step.Options
+	field.Fields = step.Fields
+	field.Schema = step.Schema
+	field.Default = nil
+
+	rules := fieldRules(field.FieldType)
+	if !rules.Length {
+		field.MinLength, field.MaxLength, field.Pattern = nil, nil, ""
+	}
+	if !rules.Range {
+		field.Min, field.Max, field.Step, field.Integer = nil, nil, nil, false
+	}
+	if !rules.Items {
+		field.MinItems, field.MaxItems = 0, 0
+	}
+	if !description.Unique {
+		field.Unique = false
+	}
+	return field
+}
+
+// checkMigratedField checks a field a migration defines, including where its
+// references point
+func checkMigratedField(contentType *models.ContentType, configFile *models.ConfigFile, field models.ContentTypeField) error {
+	fields := []models.ContentTypeField{field}
+	problems := ValidateFieldDefinitions(fields, "")
+	problems = append(problems, ValidateReferenceTargets(fields, "", contentType.Slug, configFile)...)
+	return definitionError(problems)
+}
+
+// definitionError reports the problems with a field a migration defines, if
+// any, in one message
+func definitionError(problems []models.FieldError) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.Message
+	}
+	return &InvalidMigrationError{Message: strings.Join(messages, "; ")}
+}
+
+// migrateEntryValue applies one step to an entry's values, converting them to
+// field for a change_type step. On failure it returns the name of the field
+// that could not be converted.
+func migrateEntryValue(ctx context.Context, fc FieldContext, values map[string]any, step FieldMigration, field *models.ContentTypeField, defaultValue any) (string, error) {
+	switch step.Op {
+	case "rename":
+		if value, ok := values[step.Field]; ok {
+			values[step.To] = value
+			delete(values, step.Field)
+		}
+	case "change_type":
+		value, ok := values[step.Field]
+		if !ok || value == nil {
+			return "", nil
+		}
+		converted, err := ConvertFieldValue(ctx, fc, value, *field)
+		if err != nil {
+			return step.Field, err
+		}
+		values[step.Field] = converted
+	case "drop":
+		delete(values, step.Field)
+	case "add":
+		if _, ok := values[step.Definition.FieldName]; !ok && defaultValue != nil {
+			values[step.Definition.FieldName] = defaultValue
+		}
+	}
+	return "", nil
+}
+
+// ConvertFieldValue converts a stored value to the shape the field expects,
+// e.g. "42" to 42 for a number field. It fails when the value has no sensible
+// equivalent, such as "abc" for a number or an unknown select option.
+func ConvertFieldValue(ctx context.Context, fc FieldContext, value any, field models.ContentTypeField) (any, error) {
+	fieldType, ok := LookupFieldType(field.FieldType)
+	if !ok {
+		return nil, fmt.Errorf("unsupported field type %s", field.FieldType)
+	}
+	if converter, ok := fieldType.(ValueConverter); ok {
+		return converter.Convert(ctx, fc, &field, value)
+	}
+
+	// Other types, such as groups and those registered by the application,
+	// are not converted, only checked
+	fieldErrors, err := fieldType.Validate(ctx, fc, &field, field.FieldName, value)
+	if err != nil {
+		return nil, err
+	}
+	if len(fieldErrors) > 0 {
+		return nil, errors.New(fieldErrors[0].Message)
+	}
+	return fieldType.Normalize(&field, value), nil
+}
+
+// DestructiveFieldChanges lists the fields of existing, located like "intro.text"
+// for sub-fields, that updated removes or gives another type. Entries holding
+// values for them would no longer validate, so such changes have to go
+// through MigrateContentType.
+func DestructiveFieldChanges(existing, updated []models.ContentTypeField) []string {
+	return destructiveFieldChanges(existing, updated, "")
+}
+
+func destructiveFieldChanges(existing, updated []models.ContentTypeField, prefix string) []string {
+	changes := []string{}
+	for _, field := range existing {
+		i := slices.IndexFunc(updated, func(f models.ContentTypeField) bool { return f.FieldName == field.FieldName })
+		switch {
+		case i == -1 || updated[i].FieldType != field.FieldType:
+			changes = append(changes, prefix+field.FieldName)
+		case len(field.Fields) > 0:
+			changes = append(changes, destructiveFieldChanges(field.Fields, updated[i].Fields, prefix+field.FieldName+".")...)
+		}
+	}
+	return changes
+}
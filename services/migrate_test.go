@@ -0,0 +1,396 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vachanmn123/vachancms/models"
+)
+
+// newMigrationRepo returns a repository with a posts content type holding
+// entry 1 (slug hello) and entry 2
+func newMigrationRepo(t *testing.T) *MemoryStorage {
+	t.Helper()
+	maxLength := 10
+	configFile := models.ConfigFile{ContentTypes: []models.ContentType{{
+		Name: "Posts",
+		Slug: "posts",
+		Fields: []models.ContentTypeField{
+			{FieldName: "title", FieldType: "text", IsRequired: true, MaxLength: &maxLength},
+			{FieldName: "views", FieldType: "text"},
+			{FieldName: "old", FieldType: "text"},
+		},
+	}}}
+	entries := []models.ContentValue{
+		{Id: "1", Slug: "hello", Value: map[string]any{"title": "Hello", "views": "42", "old": "x"}},
+		{Id: "2", Value: map[string]any{"title": "Second", "views": "many"}},
+	}
+	valueConfig := models.ContentValueConfigFile{
+		TotalPages:   1,
+		TotalItems:   2,
+		ItemsPerPage: 10,
+		Items:        map[string]int{"1": 1, "2": 1},
+		Slugs:        map[string]string{"hello": "1"},
+		Order:        []string{"1", "2"},
+	}
+
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		return string(data)
+	}
+	return newMemoryRepo(t, map[string]string{
+		"config/config.json":      encode(configFile),
+		"data/posts/config.json":  encode(valueConfig),
+		"data/posts/1.json":       encode(entries[0]),
+		"data/posts/hello.json":   encode(entries[0]),
+		"data/posts/2.json":       encode(entries[1]),
+		"data/posts/index-1.json": encode(models.ContentValueIndexFile{Page: 1, Items: entries}),
+	})
+}
+
+// stagedValues returns the values of entry path as staged in b
+func stagedValues(t *testing.T, b *CommitBuilder, path string) map[string]any {
+	t.Helper()
+	content, err := b.GetFileContents(t.Context(), path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	var value models.ContentValue
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		t.Fatalf("parsing %s: %v", path, err)
+	}
+	return value.Value
+}
+
+func TestMigrateContentType(t *testing.T) {
+	tests := []struct {
+		name         string
+		steps        []FieldMigration
+		clearInvalid bool
+		// want are the values of entries 1 and 2 after the migration; entries
+		// that failed keep their old values
+		want         [2]map[string]any
+		wantMigrated int
+		wantFailed   []MigrationFailure
+		// wantFields are the field names of the migrated content type
+		wantFields []string
+	}{
+		{
+			name:  "rename",
+			steps: []FieldMigration{{Op: "rename", Field: "title", To: "headline"}},
+			want: [2]map[string]any{
+				{"headline": "Hello", "views": "42", "old": "x"},
+				{"headline": "Second", "views": "many"},
+			},
+			wantMigrated: 2,
+			wantFields:   []string{"headline", "views", "old"},
+		},
+		{
+			name:  "drop",
+			steps: []FieldMigration{{Op: "drop", Field: "old"}},
+			want: [2]map[string]any{
+				{"title": "Hello", "views": "42"},
+				{"title": "Second", "views": "many"},
+			},
+			wantMigrated: 2,
+			wantFields:   []string{"title", "views"},
+		},
+		{
+			name: "add with default",
+			steps: []FieldMigration{{
+				Op:         "add",
+				Definition: &models.ContentTypeField{FieldName: "draft", FieldType: "boolean"},
+				Default:    "false",
+			}},
+			want: [2]map[string]any{
+				{"title": "Hello", "views": "42", "old": "x", "draft": false},
+				{"title": "Second", "views": "many", "draft": false},
+			},
+			wantMigrated: 2,
+			wantFields:   []string{"title", "views", "old", "draft"},
+		},
+		{
+			name:  "change_type reports failures",
+			steps: []FieldMigration{{Op: "change_type", Field: "views", Type: "number"}},
+			// Without clearInvalid no entry is rewritten
+			want: [2]map[string]any{
+				{"title": "Hello", "views": "42", "old": "x"},
+				{"title": "Second", "views": "many"},
+			},
+			wantMigrated: 1,
+			wantFailed:   []MigrationFailure{{Id: "2", Field: "views", Error: `"many" is not a number`}},
+			wantFields:   []string{"title", "views", "old"},
+		},
+		{
+			name:         "change_type clearing invalid values",
+			steps:        []FieldMigration{{Op: "change_type", Field: "views", Type: "number"}},
+			clearInvalid: true,
+			want: [2]map[string]any{
+				{"title": "Hello", "views": float64(42), "old": "x"},
+				{"title": "Second"},
+			},
+			wantMigrated: 2,
+			wantFailed:   []MigrationFailure{{Id: "2", Field: "views", Error: `"many" is not a number`}},
+			wantFields:   []string{"title", "views", "old"},
+		},
+		{
+			name: "steps in order",
+			steps: []FieldMigration{
+				{Op: "rename", Field: "views", To: "count"},
+				{Op: "change_type", Field: "count", Type: "number"},
+				{Op: "drop", Field: "old"},
+			},
+			clearInvalid: true,
+			want: [2]map[string]any{
+				{"title": "Hello", "count": float64(42)},
+				{"title": "Second"},
+			},
+			wantMigrated: 2,
+			wantFailed:   []MigrationFailure{{Id: "2", Field: "count", Error: `"many" is not a number`}},
+			wantFields:   []string{"title", "count"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			s := newMigrationRepo(t)
+			b := newTestBuilder(t, s, "")
+			configFile, err := LoadRepoConfig(ctx, b)
+			if err != nil {
+				t.Fatalf("LoadRepoConfig: %v", err)
+			}
+
+			result, err := MigrateContentType(ctx, "", "o", "r", b, configFile, "posts", tt.steps, tt.clearInvalid)
+			if err != nil {
+				t.Fatalf("MigrateContentType: %v", err)
+			}
+			if result.Migrated != tt.wantMigrated {
+				t.Errorf("Migrated = %d, want %d", result.Migrated, tt.wantMigrated)
+			}
+			if !reflect.DeepEqual(result.Failed, append([]MigrationFailure{}, tt.wantFailed...)) {
+				t.Errorf("Failed = %+v, want %+v", result.Failed, tt.wantFailed)
+			}
+			fields := []string{}
+			for _, field := range result.ContentType.Fields {
+				fields = append(fields, field.FieldName)
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("fields = %v, want %v", fields, tt.wantFields)
+			}
+
+			for i, path := range []string{"data/posts/1.json", "data/posts/2.json"} {
+				if got := stagedValues(t, b, path); !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("%s = %v, want %v", path, got, tt.want[i])
+				}
+			}
+			// The slug file and the index follow the entry
+			if got := stagedValues(t, b, "data/posts/hello.json"); !reflect.DeepEqual(got, tt.want[0]) {
+				t.Errorf("slug file = %v, want %v", got, tt.want[0])
+			}
+			var index models.ContentValueIndexFile
+			content, _ := b.GetFileContents(ctx, "data/posts/index-1.json")
+			if err := json.Unmarshal([]byte(content), &index); err != nil || len(index.Items) != 2 {
+				t.Fatalf("index = %s, %v", content, err)
+			}
+			for i, item := range index.Items {
+				if !reflect.DeepEqual(item.Value, tt.want[i]) {
+					t.Errorf("index item %s = %v, want %v", item.Id, item.Value, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateContentTypeAbandonsFailedMigration(t *testing.T) {
+	ctx := t.Context()
+	b := newTestBuilder(t, newMigrationRepo(t), "")
+	configFile, err := LoadRepoConfig(ctx, b)
+	if err != nil {
+		t.Fatalf("LoadRepoConfig: %v", err)
+	}
+
+	// The rename succeeds for both entries, the change_type fails for entry 2
+	steps := []FieldMigration{
+		{Op: "rename", Field: "title", To: "headline"},
+		{Op: "change_type", Field: "views", Type: "number"},
+	}
+	result, err := MigrateContentType(ctx, "", "o", "r", b, configFile, "posts", steps, false)
+	if err != nil {
+		t.Fatalf("MigrateContentType: %v", err)
+	}
+	want := []MigrationFailure{{Id: "2", Field: "views", Error: `"many" is not a number`}}
+	if !reflect.DeepEqual(result.Failed, want) || result.Migrated != 1 {
+		t.Errorf("MigrateContentType = %+v, want 1 migrated and %+v failed", result, want)
+	}
+	if b.HasChanges() {
+		t.Error("MigrateContentType staged changes for a migration with failures")
+	}
+	if got := stagedValues(t, b, "data/posts/1.json"); got["title"] != "Hello" {
+		t.Errorf("data/posts/1.json = %v, want it untouched", got)
+	}
+}
+
+func TestMigrateContentTypeDryRun(t *testing.T) {
+	ctx := t.Context()
+	s := newMigrationRepo(t)
+	head, _ := s.GetHead(ctx, "o", "r", "")
+	b := newTestBuilder(t, s, "")
+	configFile, err := LoadRepoConfig(ctx, b)
+	if err != nil {
+		t.Fatalf("LoadRepoConfig: %v", err)
+	}
+
+	// A dry run is a migration whose staged changes are never committed
+	result, err := MigrateContentType(ctx, "", "o", "r", b, configFile, "posts", []FieldMigration{{Op: "drop", Field: "old"}}, false)
+	if err != nil || result.Migrated != 2 {
+		t.Fatalf("MigrateContentType = %+v, %v", result, err)
+	}
+	if current, _ := s.GetHead(ctx, "o", "r", ""); current != head {
+		t.Error("MigrateContentType committed on its own")
+	}
+	if content, _ := s.GetFileContents(ctx, "o", "r", "data/posts/1.json"); !strings.Contains(content, `"old":"x"`) {
+		t.Fatalf("data/posts/1.json = %q", content)
+	}
+	if !b.HasChanges() {
+		t.Error("MigrateContentType staged nothing")
+	}
+}
+
+func TestMigrateContentTypeChangesRules(t *testing.T) {
+	ctx := t.Context()
+	b := newTestBuilder(t, newMigrationRepo(t), "")
+	configFile, err := LoadRepoConfig(ctx, b)
+	if err != nil {
+		t.Fatalf("LoadRepoConfig: %v", err)
+	}
+
+	steps := []FieldMigration{{Op: "change_type", Field: "title", Type: "number"}}
+	result, err := MigrateContentType(ctx, "", "o", "r", b, configFile, "posts", steps, true)
+	if err != nil {
+		t.Fatalf("MigrateContentType: %v", err)
+	}
+	// The text rule is dropped, the required flag kept
+	title := result.ContentType.Fields[0]
+	if title.FieldType != "number" || title.MaxLength != nil || !title.IsRequired {
+		t.Errorf("title = %+v, want a required number field without a max length", title)
+	}
+}
+
+func TestMigrateContentTypeRefusesInvalidSteps(t *testing.T) {
+	tests := []struct {
+		name  string
+		slug  string
+		steps []FieldMigration
+		// want is the message of the *InvalidMigrationError, "" for a
+		// *FileNotFoundError
+		want string
+	}{
+		{name: "unknown content type", slug: "pages", steps: []FieldMigration{{Op: "drop", Field: "old"}}},
+		{name: "unknown operation", steps: []FieldMigration{{Op: "merge", Field: "old"}}, want: "Unknown migration operation merge"},
+		{name: "unknown field", steps: []FieldMigration{{Op: "drop", Field: "body"}}, want: "Field body is not defined in content type"},
+		{
+			name:  "existing field added",
+			steps: []FieldMigration{{Op: "add", Definition: &models.ContentTypeField{FieldName: "old", FieldType: "text"}}},
+			want:  "Field old already exists",
+		},
+		{
+			name:  "invalid default",
+			steps: []FieldMigration{{Op: "add", Definition: &models.ContentTypeField{FieldName: "n", FieldType: "number"}, Default: "lots"}},
+			want:  `Default of field n: "lots" is not a number`,
+		},
+		{
+			name:  "unknown type",
+			steps: []FieldMigration{{Op: "change_type", Field: "old", Type: "colour"}},
+			want:  "Field old cannot change to unknown type colour",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			s := newMigrationRepo(t)
+			b := newTestBuilder(t, s, "")
+			configFile, err := LoadRepoConfig(ctx, b)
+			if err != nil {
+				t.Fatalf("LoadRepoConfig: %v", err)
+			}
+			slug := tt.slug
+			if slug == "" {
+				slug = "posts"
+			}
+
+			_, err = MigrateContentType(ctx, "", "o", "r", b, configFile, slug, tt.steps, false)
+			var invalid *InvalidMigrationError
+			var notFound *FileNotFoundError
+			switch {
+			case tt.want == "" && !errors.As(err, &notFound):
+				t.Fatalf("MigrateContentType: got %v, want *FileNotFoundError", err)
+			case tt.want != "" && (!errors.As(err, &invalid) || invalid.Message != tt.want):
+				t.Fatalf("MigrateContentType: got %v, want %q", err, tt.want)
+			}
+			if b.HasChanges() {
+				t.Error("a refused migration staged changes")
+			}
+		})
+	}
+}
+
+func TestDestructiveFieldChanges(t *testing.T) {
+	existing := []models.ContentTypeField{
+		{FieldName: "title", FieldType: "text"},
+		{FieldName: "views", FieldType: "number"},
+		{FieldName: "intro", FieldType: "group", Fields: []models.ContentTypeField{
+			{FieldName: "text", FieldType: "markdown"},
+			{FieldName: "image", FieldType: "media"},
+		}},
+	}
+	tests := []struct {
+		name    string
+		updated []models.ContentTypeField
+		want    []string
+	}{
+		{name: "unchanged", updated: existing, want: []string{}},
+		{
+			name: "field added and rules changed",
+			updated: []models.ContentTypeField{
+				{FieldName: "title", FieldType: "text", IsRequired: true},
+				existing[1],
+				existing[2],
+				{FieldName: "draft", FieldType: "boolean"},
+			},
+			want: []string{},
+		},
+		{
+			name:    "field removed and retyped",
+			updated: []models.ContentTypeField{{FieldName: "views", FieldType: "text"}, existing[2]},
+			want:    []string{"title", "views"},
+		},
+		{
+			name: "sub-field removed",
+			updated: []models.ContentTypeField{existing[0], existing[1], {FieldName: "intro", FieldType: "group", Fields: []models.ContentTypeField{
+				{FieldName: "text", FieldType: "markdown"},
+			}}},
+			want: []string{"intro.image"},
+		},
+		{
+			name:    "group retyped",
+			updated: []models.ContentTypeField{existing[0], existing[1], {FieldName: "intro", FieldType: "repeater", Fields: existing[2].Fields}},
+			want:    []string{"intro"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DestructiveFieldChanges(existing, tt.updated); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DestructiveFieldChanges = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v62/github"
+)
+
+const (
+	// maxRateLimitRetries is how often an idempotent request is retried
+	maxRateLimitRetries = 3
+	// maxRateLimitWait is the longest we block a request in total waiting for
+	// a limit to reset; anything longer fails fast so the user is not left
+	// hanging (and the shared client's timeout is not hit).
+	maxRateLimitWait = 10 * time.Second
+)
+
+// retryBaseDelay is the first backoff delay, doubled on every attempt
+var retryBaseDelay = 500 * time.Millisecond
+
+// RateLimitError is returned when the backend refuses requests until Reset
+type RateLimitError struct {
+	Reset time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, resets at %s", e.Reset.UTC().Format(time.RFC3339))
+}
+
+// RateLimitStatus is the last known request budget for a user
+type RateLimitStatus struct {
+	Resource  string    `json:"resource"`
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+var (
+	rateLimitsMu sync.Mutex
+	// rateLimits holds the last RateLimitStatus seen per token key and resource
+	rateLimits = map[string]map[string]*RateLimitStatus{}
+)
+
+// GetRateLimits returns the last known request budget of the user's token
+// for every resource (core, search, graphql, ...) seen so far.
+func GetRateLimits(token string) []RateLimitStatus {
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+
+	statuses := []RateLimitStatus{}
+	for _, status := range rateLimits[tokenKey(token)] {
+		statuses = append(statuses, *status)
+	}
+	return statuses
+}
+
+// rateLimitTransport records rate limit headers, retries idempotent requests
+// that hit a rate limit or a transient server error, and turns rate limited
+// responses it will not retry into a *RateLimitError.
+type rateLimitTransport struct {
+	base http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+	var waited time.Duration
+
+	for attempt := 0; ; attempt++ {
+		res, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		recordRateLimit(req, res)
+
+		wait, limited := rateLimitWait(res, attempt)
+		transient := res.StatusCode == http.StatusBadGateway ||
+			res.StatusCode == http.StatusServiceUnavailable ||
+			res.StatusCode == http.StatusGatewayTimeout
+		if !limited && !transient {
+			return res, nil
+		}
+		if transient {
+			wait = retryBaseDelay << attempt
+		}
+
+		if !idempotent || attempt >= maxRateLimitRetries || waited+wait > maxRateLimitWait {
+			if limited {
+				drainBody(res)
+				return nil, &RateLimitError{Reset: time.Now().Add(wait)}
+			}
+			return res, nil
+		}
+
+		drainBody(res)
+		waited += wait
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// rateLimitWait reports whether res was rejected by a primary or secondary
+// rate limit and how long to wait before trying again.
+func rateLimitWait(res *http.Response, attempt int) (time.Duration, bool) {
+	if res.StatusCode != http.StatusForbidden && res.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	// Secondary limits tell us exactly how long to back off
+	if retryAfter := res.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	// Primary limit exhausted, wait for the window to reset
+	if remaining, ok := headerInt(res.Header, "X-RateLimit-Remaining", "RateLimit-Remaining"); ok && remaining == 0 {
+		if reset, ok := headerInt(res.Header, "X-RateLimit-Reset", "RateLimit-Reset"); ok {
+			return max(time.Until(time.Unix(int64(reset), 0)), 0), true
+		}
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		return retryBaseDelay << attempt, true
+	}
+	// A plain 403 is a permission problem, not a rate limit
+	return 0, false
+}
+
+// recordRateLimit stores the budget reported in the response headers
+func recordRateLimit(req *http.Request, res *http.Response) {
+	limit, ok := headerInt(res.Header, "X-RateLimit-Limit", "RateLimit-Limit")
+	if !ok {
+		return
+	}
+	remaining, _ := headerInt(res.Header, "X-RateLimit-Remaining", "RateLimit-Remaining")
+	reset, _ := headerInt(res.Header, "X-RateLimit-Reset", "RateLimit-Reset")
+	resource := res.Header.Get("X-RateLimit-Resource")
+	if resource == "" {
+		resource = "core"
+	}
+
+	token := req.Header.Get("Authorization")
+	if i := strings.IndexByte(token, ' '); i >= 0 {
+		token = token[i+1:]
+	}
+	if token == "" {
+		token = req.Header.Get("Private-Token")
+	}
+	key := tokenKey(token)
+
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+	if rateLimits[key] == nil {
+		rateLimits[key] = map[string]*RateLimitStatus{}
+	}
+	status := &RateLimitStatus{
+		Resource:  resource,
+		Limit:     limit,
+		Remaining: remaining,
+	}
+	if reset > 0 {
+		status.Reset = time.Unix(int64(reset), 0)
+	}
+	rateLimits[key][resource] = status
+}
+
+// headerInt parses the first of the given headers that is present
+func headerInt(header http.Header, names ...string) (int, bool) {
+	for _, name := range names {
+		if value := header.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// drainBody discards and closes a response body so the connection is reused
+func drainBody(res *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+}
+
+// AsRateLimitError reports whether err was caused by a rate limit, either one
+// raised by rateLimitTransport or one the GitHub client detected itself.
+func AsRateLimitError(err error) (*RateLimitError, bool) {
+	var limited *RateLimitError
+	if errors.As(err, &limited) {
+		return limited, true
+	}
+	var primary *github.RateLimitError
+	if errors.As(err, &primary) {
+		return &RateLimitError{Reset: primary.Rate.Reset.Time}, true
+	}
+	var secondary *github.AbuseRateLimitError
+	if errors.As(err, &secondary) {
+		return &RateLimitError{Reset: time.Now().Add(secondary.GetRetryAfter())}, true
+	}
+	return nil, false
+}
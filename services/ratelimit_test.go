@@ -0,0 +1,178 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedServer answers each request with the next of responses, repeating
+// the last one, and counts the requests it got
+type scriptedServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses []scriptedResponse
+	requests  int
+}
+
+type scriptedResponse struct {
+	status  int
+	headers map[string]string
+}
+
+func newScriptedServer(t *testing.T, responses ...scriptedResponse) *scriptedServer {
+	t.Helper()
+	s := &scriptedServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		response := s.responses[min(s.requests, len(s.responses)-1)]
+		s.requests++
+		s.mu.Unlock()
+		for name, value := range response.headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(response.status)
+		fmt.Fprint(w, "{}")
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// roundTrip sends one request through a rateLimitTransport
+func (s *scriptedServer) roundTrip(t *testing.T, method, token string) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(t.Context(), method, s.URL, strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := (&rateLimitTransport{base: http.DefaultTransport}).RoundTrip(req)
+	if res != nil {
+		drainBody(res)
+	}
+	return res, err
+}
+
+// fastRetries shortens the backoff for the duration of a test
+func fastRetries(t *testing.T) {
+	previous := retryBaseDelay
+	retryBaseDelay = time.Millisecond
+	t.Cleanup(func() { retryBaseDelay = previous })
+}
+
+func TestRateLimitTransportRetries(t *testing.T) {
+	fastRetries(t)
+	ok := scriptedResponse{status: http.StatusOK}
+	tooMany := scriptedResponse{status: http.StatusTooManyRequests}
+	retryAfter := scriptedResponse{status: http.StatusForbidden, headers: map[string]string{"Retry-After": "0"}}
+	unavailable := scriptedResponse{status: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		name      string
+		method    string
+		responses []scriptedResponse
+		// wantStatus is the status returned, 0 for a *RateLimitError
+		wantStatus   int
+		wantRequests int
+	}{
+		{name: "GET after Retry-After", method: http.MethodGet, responses: []scriptedResponse{retryAfter, ok}, wantStatus: 200, wantRequests: 2},
+		{name: "HEAD after backoff", method: http.MethodHead, responses: []scriptedResponse{tooMany, tooMany, ok}, wantStatus: 200, wantRequests: 3},
+		{name: "GET after server error", method: http.MethodGet, responses: []scriptedResponse{unavailable, ok}, wantStatus: 200, wantRequests: 2},
+		{name: "GET giving up", method: http.MethodGet, responses: []scriptedResponse{tooMany}, wantRequests: maxRateLimitRetries + 1},
+		{name: "POST rate limited", method: http.MethodPost, responses: []scriptedResponse{retryAfter, ok}, wantRequests: 1},
+		{name: "PUT rate limited", method: http.MethodPut, responses: []scriptedResponse{tooMany, ok}, wantRequests: 1},
+		{name: "POST server error", method: http.MethodPost, responses: []scriptedResponse{unavailable, ok}, wantStatus: 503, wantRequests: 1},
+		{
+			name:         "plain 403",
+			method:       http.MethodGet,
+			responses:    []scriptedResponse{{status: http.StatusForbidden, headers: map[string]string{"X-RateLimit-Remaining": "10"}}, ok},
+			wantStatus:   403,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScriptedServer(t, tt.responses...)
+			res, err := s.roundTrip(t, tt.method, "tok")
+
+			var limited *RateLimitError
+			switch {
+			case tt.wantStatus == 0 && !errors.As(err, &limited):
+				t.Errorf("RoundTrip: got %v, want *RateLimitError", err)
+			case tt.wantStatus != 0 && (err != nil || res.StatusCode != tt.wantStatus):
+				t.Errorf("RoundTrip = %v, %v; want status %d", res, err, tt.wantStatus)
+			}
+			if s.requests != tt.wantRequests {
+				t.Errorf("%d requests, want %d", s.requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestRateLimitTransportExhaustedLimit(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusTooManyRequests} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			// The window resets too late to wait for it
+			reset := time.Now().Add(time.Hour).Truncate(time.Second)
+			s := newScriptedServer(t, scriptedResponse{status: status, headers: map[string]string{
+				"X-RateLimit-Remaining": "0",
+				"X-RateLimit-Reset":     fmt.Sprint(reset.Unix()),
+			}})
+
+			_, err := s.roundTrip(t, http.MethodGet, "tok")
+			var limited *RateLimitError
+			if !errors.As(err, &limited) {
+				t.Fatalf("RoundTrip: got %v, want *RateLimitError", err)
+			}
+			if diff := limited.Reset.Sub(reset); diff < -time.Second || diff > time.Second {
+				t.Errorf("Reset = %s, want %s", limited.Reset, reset)
+			}
+			if s.requests != 1 {
+				t.Errorf("%d requests, want 1", s.requests)
+			}
+		})
+	}
+}
+
+func TestGetRateLimits(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+	for token, remaining := range map[string]string{"rate-token-a": "4999", "rate-token-b": "12"} {
+		s := newScriptedServer(t, scriptedResponse{status: http.StatusOK, headers: map[string]string{
+			"X-RateLimit-Limit":     "5000",
+			"X-RateLimit-Remaining": remaining,
+			"X-RateLimit-Reset":     fmt.Sprint(reset.Unix()),
+			"X-RateLimit-Resource":  "search",
+		}})
+		if _, err := s.roundTrip(t, http.MethodGet, token); err != nil {
+			t.Fatalf("RoundTrip: %v", err)
+		}
+	}
+
+	tests := []struct {
+		token string
+		want  []RateLimitStatus
+	}{
+		{token: "rate-token-a", want: []RateLimitStatus{{Resource: "search", Limit: 5000, Remaining: 4999, Reset: reset}}},
+		{token: "rate-token-b", want: []RateLimitStatus{{Resource: "search", Limit: 5000, Remaining: 12, Reset: reset}}},
+		{token: "rate-token-unused", want: []RateLimitStatus{}},
+	}
+	for _, tt := range tests {
+		got := GetRateLimits(tt.token)
+		if len(got) != len(tt.want) {
+			t.Errorf("GetRateLimits(%s) = %+v, want %+v", tt.token, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Resource != tt.want[i].Resource || got[i].Limit != tt.want[i].Limit ||
+				got[i].Remaining != tt.want[i].Remaining || !got[i].Reset.Equal(tt.want[i].Reset) {
+				t.Errorf("GetRateLimits(%s) = %+v, want %+v", tt.token, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/vachanmn123/vachancms/models"
+)
+
+// RepoSettingsPath is where the repository settings live on the default branch
+const RepoSettingsPath = ".vachancms.json"
+
+// branchNameRegex accepts the branch names git accepts, minus a few edge
+// cases no content branch needs
+var branchNameRegex = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._/-]*$`)
+
+// ValidBranchName reports whether name can be used as a content branch
+func ValidBranchName(name string) bool {
+	return branchNameRegex.MatchString(name) &&
+		!strings.Contains(name, "..") &&
+		!strings.Contains(name, "//") &&
+		!strings.HasSuffix(name, "/") &&
+		!strings.HasSuffix(name, ".lock")
+}
+
+// repoSettingsKey is the context key of a request's repoSettingsCache
+type repoSettingsKey struct{}
+
+// repoSettingsCache holds the settings of the repositories a request has
+// touched, keyed by owner/repo
+type repoSettingsCache struct {
+	mu       sync.Mutex
+	settings map[string]models.RepoSettingsFile
+}
+
+// WithRepoSettingsCache returns a context under which the settings of each
+// repository are read once and then reused, so the storage wrappers do not
+// each fetch .vachancms.json again. It is meant to span a single request.
+func WithRepoSettingsCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, repoSettingsKey{}, &repoSettingsCache{settings: map[string]models.RepoSettingsFile{}})
+}
+
+// cachedRepoSettings returns the settings remembered by ctx, if any
+func cachedRepoSettings(ctx context.Context, owner, repo string) (*models.RepoSettingsFile, bool) {
+	cache, ok := ctx.Value(repoSettingsKey{}).(*repoSettingsCache)
+	if !ok {
+		return nil, false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	settings, ok := cache.settings[owner+"/"+repo]
+	return &settings, ok
+}
+
+// rememberRepoSettings stores settings in ctx's cache, if it has one
+func rememberRepoSettings(ctx context.Context, owner, repo string, settings *models.RepoSettingsFile) {
+	if cache, ok := ctx.Value(repoSettingsKey{}).(*repoSettingsCache); ok {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		cache.settings[owner+"/"+repo] = *settings
+	}
+}
+
+// GetRepoSettings reads .vachancms.json from the default branch. Repositories
+// without one get the zero settings, which keep everything on the default
+// branch. Under WithRepoSettingsCache the file is only read the first time.
+func GetRepoSettings(ctx context.Context, token, owner, repo string) (*models.RepoSettingsFile, error) {
+	if settings, ok := cachedRepoSettings(ctx, owner, repo); ok {
+		return settings, nil
+	}
+
+	settings := &models.RepoSettingsFile{}
+	content, err := storageFor(token).GetFileContents(ctx, owner, repo, RepoSettingsPath)
+	if err != nil {
+		var notFound *FileNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("failed to fetch repository settings: %w", err)
+		}
+	} else if err := json.Unmarshal([]byte(content), settings); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", RepoSettingsPath, err)
+	}
+	rememberRepoSettings(ctx, owner, repo, settings)
+	return settings, nil
+}
+
+// ContentBranch returns the branch the CMS reads and commits content on. An
+// empty name means the repository's default branch.
+func ContentBranch(ctx context.Context, token, owner, repo string) (string, error) {
+	settings, err := GetRepoSettings(ctx, token, owner, repo)
+	if err != nil {
+		return "", err
+	}
+	return settings.ContentBranch, nil
+}
+
+// CleanBasePath normalizes a base path such as "/site/cms/" to "site/cms". It
+// reports false for paths that leave the repository or point into .git.
+func CleanBasePath(basePath string) (string, bool) {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return "", true
+	}
+	cleaned := path.Clean(basePath)
+	if cleaned == "." {
+		return "", true
+	}
+	for _, segment := range strings.Split(cleaned, "/") {
+		if segment == ".." || segment == ".git" {
+			return "", false
+		}
+	}
+	return cleaned, true
+}
+
+// SaveRepoSettings commits .vachancms.json to the default branch. Empty
+// repositories get it through the Contents API, like the rest of an initial
+// commit.
+func SaveRepoSettings(ctx context.Context, token, owner, repo string, settings *models.RepoSettingsFile, message string) error {
+	content, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	storage := storageFor(token)
+	isEmpty, defaultBranch, err := storage.IsRepoEmpty(ctx, owner, repo)
+	if err != nil {
+		return err
+	}
+	if isEmpty {
+		err = storage.CreateOrUpdateFile(ctx, owner, repo, RepoSettingsPath, message, string(content), defaultBranch)
+	} else {
+		var b *CommitBuilder
+		b, err = newCommitBuilder(ctx, storage, owner, repo, defaultBranch, "")
+		if err != nil {
+			return err
+		}
+		b.WriteFile(RepoSettingsPath, string(content))
+		err = b.Commit(ctx, message)
+	}
+	if err != nil {
+		return err
+	}
+	rememberRepoSettings(ctx, owner, repo, settings)
+	return nil
+}
+
+// contentLocation returns the branch and base path CMS paths resolve against.
+// A branch named by the caller wins over the configured content branch. The
+// settings come from the request's cache when the caller set one up.
+func contentLocation(ctx context.Context, token, owner, repo string, branch []string) ([]string, string, error) {
+	settings, err := GetRepoSettings(ctx, token, owner, repo)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(branch) == 0 || branch[0] == "" {
+		branch = []string{settings.ContentBranch}
+	}
+	return branch, settings.BasePath, nil
+}
+
+// repoPath turns a path relative to the CMS root into one relative to the
+// repository root
+func repoPath(basePath, p string) string {
+	if basePath == "" {
+		return p
+	}
+	return path.Join(basePath, p)
+}
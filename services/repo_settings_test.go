@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vachanmn123/vachancms/models"
+)
+
+// settingsCountingStorage counts how often .vachancms.json is read
+type settingsCountingStorage struct {
+	*MemoryStorage
+	reads int
+}
+
+func (s *settingsCountingStorage) GetFileContents(ctx context.Context, user, repo, path string, branch ...string) (string, error) {
+	if path == RepoSettingsPath {
+		s.reads++
+	}
+	return s.MemoryStorage.GetFileContents(ctx, user, repo, path, branch...)
+}
+
+func TestRepoSettingsAreReadOncePerRequest(t *testing.T) {
+	s := &settingsCountingStorage{MemoryStorage: newMemoryRepo(t, map[string]string{
+		RepoSettingsPath:       `{"base_path":"cms"}`,
+		"cms/config/conf.json": "cms",
+	})}
+	useStorage(t, s)
+
+	read := func(ctx context.Context) {
+		t.Helper()
+		if content, err := GetFileContents(ctx, "", "o", "r", "config/conf.json"); err != nil || content != "cms" {
+			t.Fatalf("GetFileContents = %q, %v; want %q", content, err, "cms")
+		}
+		if _, err := NewCommitBuilder(ctx, "", "o", "r"); err != nil {
+			t.Fatalf("NewCommitBuilder: %v", err)
+		}
+	}
+
+	read(t.Context())
+	if s.reads != 2 {
+		t.Errorf("settings read %d times without a cache, want 2", s.reads)
+	}
+
+	s.reads = 0
+	ctx := WithRepoSettingsCache(t.Context())
+	read(ctx)
+	read(ctx)
+	if s.reads != 1 {
+		t.Errorf("settings read %d times with a cache, want 1", s.reads)
+	}
+
+	// Saved settings replace the cached ones
+	if err := SaveRepoSettings(ctx, "", "o", "r", &models.RepoSettingsFile{}, "move to root"); err != nil {
+		t.Fatalf("SaveRepoSettings: %v", err)
+	}
+	if err := CreateOrUpdateFile(ctx, "", "o", "r", "config/conf.json", "root", "root"); err != nil {
+		t.Fatalf("CreateOrUpdateFile: %v", err)
+	}
+	if content, _ := s.MemoryStorage.GetFileContents(ctx, "o", "r", "config/conf.json"); content != "root" {
+		t.Errorf("config/conf.json = %q after moving to the root, want %q", content, "root")
+	}
+	if s.reads != 1 {
+		t.Errorf("settings read %d times after saving them, want 1", s.reads)
+	}
+}
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vachanmn123/vachancms/config"
+)
+
+// Repository is the backend-agnostic description of a repository the
+// signed-in user can open in the CMS.
+type Repository struct {
+	FullName      string `json:"full_name"`
+	Description   string `json:"description"`
+	Private       bool   `json:"private"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+// User is the signed-in account as the backend knows it
+type User struct {
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+// Branch is a branch and the commit it points at
+type Branch struct {
+	Name string `json:"name"`
+	Head string `json:"head"`
+}
+
+type PageConfig struct {
+	Initialized bool
+	URL         string
+}
+
+// Storage is implemented by every backend that can hold a CMS repository.
+// All paths are relative to the repository root, and an empty or omitted
+// branch means the repository's default branch. Implementations must return
+// a *FileNotFoundError when a requested file does not exist, and should stop
+// and return the context's error once ctx is done.
+type Storage interface {
+	GetUser(ctx context.Context) (*User, error)
+	ListRepos(ctx context.Context) ([]*Repository, error)
+	GetFileContents(ctx context.Context, user, repo, path string, branch ...string) (string, error)
+	// OpenFile streams a file of any size the backend supports, returning its
+	// size in bytes. The caller must close the reader.
+	OpenFile(ctx context.Context, user, repo, path string, branch ...string) (io.ReadCloser, int64, error)
+	CreateOrUpdateFile(ctx context.Context, user, repo, path, message, content string, branch ...string) error
+	DeleteFile(ctx context.Context, user, repo, path, message string, branch ...string) error
+	UploadFile(ctx context.Context, user, repo, path, message string, content []byte, branch ...string) error
+	CreateBranch(ctx context.Context, user, repo, newBranch string, srcBranch ...string) error
+	ListBranches(ctx context.Context, user, repo string) ([]*Branch, error)
+	DeleteBranch(ctx context.Context, user, repo, branch string) error
+	MergeBranch(ctx context.Context, user, repo, fromBranch, message string, toBranch ...string) error
+	IsRepoEmpty(ctx context.Context, user, repo string) (bool, string, error)
+	GetPagesConfig(ctx context.Context, user, repo string) (*PageConfig, error)
+
+	// GetHead returns the SHA of the commit the branch currently points at
+	GetHead(ctx context.Context, user, repo, branch string) (string, error)
+	// CommitChanges writes all changes as one commit whose parent is parent,
+	// then moves branch to it. It must fail with a *BranchMovedError without
+	// touching the branch if the branch no longer points at parent.
+	CommitChanges(ctx context.Context, user, repo, branch, parent, message string, changes []FileChange) (string, error)
+	// ListFiles returns the path of every file below dir at a branch or
+	// commit. A directory that does not exist has no files.
+	ListFiles(ctx context.Context, user, repo, dir, ref string) ([]string, error)
+	// ChangedFiles lists the paths that differ between two commits
+	ChangedFiles(ctx context.Context, user, repo, base, head string) ([]string, error)
+	// CommitTime returns when a commit was made
+	CommitTime(ctx context.Context, user, repo, sha string) (time.Time, error)
+}
+
+// StorageFactory returns the Storage to use for a request authenticated with
+// the given access token.
+type StorageFactory func(token string) Storage
+
+var (
+	storageMu      sync.RWMutex
+	storageFactory StorageFactory = NewGitHubStorage
+)
+
+// SetStorageFactory replaces the backend used by all services. It is meant to
+// be called once at startup (or from tests) before any request is served.
+func SetStorageFactory(factory StorageFactory) {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	storageFactory = factory
+}
+
+// SetupStorage selects the backend configured for this deployment
+func SetupStorage(cfg *config.Config) error {
+	switch cfg.StorageBackend {
+	case "", "github":
+		SetStorageFactory(NewGitHubStorage)
+	case "gitlab":
+		SetStorageFactory(func(token string) Storage {
+			return NewGitLabStorage(cfg.GitLabURL, token)
+		})
+	case "local":
+		if cfg.JWTSecret == "" {
+			return fmt.Errorf("JWT_SECRET must be set with the local storage backend")
+		}
+		if info, err := os.Stat(cfg.LocalReposDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("LOCAL_REPOS_DIR %q is not a directory", cfg.LocalReposDir)
+		}
+		SetStorageFactory(func(token string) Storage {
+			name, email, ok := ParseLocalAccessToken(token)
+			if !ok {
+				name, email = cfg.LocalUserName, cfg.LocalUserEmail
+			}
+			return NewLocalStorage(cfg.LocalReposDir, name, email)
+		})
+	default:
+		return fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+	return nil
+}
+
+// storageFor returns the configured backend for the given access token
+func storageFor(token string) Storage {
+	storageMu.RLock()
+	defer storageMu.RUnlock()
+	return storageFactory(token)
+}
+
+type FileNotFoundError struct{}
+
+func (e *FileNotFoundError) Error() string {
+	return "file not found"
+}
+
+func GetUser(ctx context.Context, token string) (*User, error) {
+	return storageFor(token).GetUser(ctx)
+}
+
+func ListRepos(ctx context.Context, token string) ([]*Repository, error) {
+	return storageFor(token).ListRepos(ctx)
+}
+
+// The wrappers below take paths relative to the CMS root (the configured base
+// path) and use the repository's content branch unless a branch is named
+// explicitly.
+
+func GetFileContents(ctx context.Context, token, user, repo, path string, branch ...string) (string, error) {
+	branch, basePath, err := contentLocation(ctx, token, user, repo, branch)
+	if err != nil {
+		return "", err
+	}
+	return storageFor(token).GetFileContents(ctx, user, repo, repoPath(basePath, path), branch...)
+}
+
+func OpenFile(ctx context.Context, token, user, repo, path string, branch ...string) (io.ReadCloser, int64, error) {
+	branch, basePath, err := contentLocation(ctx, token, user, repo, branch)
+	if err != nil {
+		return nil, 0, err
+	}
+	return storageFor(token).OpenFile(ctx, user, repo, repoPath(basePath, path), branch...)
+}
+
+func CreateOrUpdateFile(ctx context.Context, token, user, repo, path, message, content string, branch ...string) error {
+	branch, basePath, err := contentLocation(ctx, token, user, repo, branch)
+	if err != nil {
+		return err
+	}
+	return storageFor(token).CreateOrUpdateFile(ctx, user, repo, repoPath(basePath, path), message, content, branch...)
+}
+
+func DeleteFile(ctx context.Context, token, user, repo, path, message string, branch ...string) error {
+	branch, basePath, err := contentLocation(ctx, token, user, repo, branch)
+	if err != nil {
+		return err
+	}
+	return storageFor(token).DeleteFile(ctx, user, repo, repoPath(basePath, path), message, branch...)
+}
+
+func UploadFile(ctx context.Context, token, user, repo, path, message string, content []byte, branch ...string) error {
+	branch, basePath, err := contentLocation(ctx, token, user, repo, branch)
+	if err != nil {
+		return err
+	}
+	return storageFor(token).UploadFile(ctx, user, repo, repoPath(basePath, path), message, content, branch...)
+}
+
+func GetPagesConfig(ctx context.Context, token, user, repo string) (*PageConfig, error) {
+	return storageFor(token).GetPagesConfig(ctx, user, repo)
+}
+
+func CreateBranch(ctx context.Context, token, user, repo, newBranch string, srcBranch ...string) error {
+	srcBranch, _, err := contentLocation(ctx, token, user, repo, srcBranch)
+	if err != nil {
+		return err
+	}
+	return storageFor(token).CreateBranch(ctx, user, repo, newBranch, srcBranch...)
+}
+
+func ListBranches(ctx context.Context, token, user, repo string) ([]*Branch, error) {
+	return storageFor(token).ListBranches(ctx, user, repo)
+}
+
+func MergeBranch(ctx context.Context, token, user, repo, fromBranch, message string, toBranch ...string) error {
+	toBranch, _, err := contentLocation(ctx, token, user, repo, toBranch)
+	if err != nil {
+		return err
+	}
+	return storageFor(token).MergeBranch(ctx, user, repo, fromBranch, message, toBranch...)
+}
+
+func IsRepoEmpty(ctx context.Context, token, user, repo string) (bool, string, error) {
+	return storageFor(token).IsRepoEmpty(ctx, user, repo)
+}
+
+// Every backend must satisfy Storage
+var (
+	_ Storage = (*GitHubStorage)(nil)
+	_ Storage = (*GitLabStorage)(nil)
+	_ Storage = (*LocalStorage)(nil)
+	_ Storage = (*MemoryStorage)(nil)
+)